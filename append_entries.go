@@ -1,27 +1,44 @@
 package raft
 
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
 //
 //------------------------------------------------------------------------------
 
-// The request sent to a server to append entries to the log.
+// The request sent to a server to append entries to the log. Peers that
+// support compression may receive the entries gzipped in Compressed instead.
+// The trace ID is only set when the sender has a tracer.
 type AppendEntriesRequest struct {
-	peer         *Peer
-	Term         uint64      `json:"term"`
-	LeaderName   string      `json:"leaderName"`
-	PrevLogIndex uint64      `json:"prevLogIndex"`
-	PrevLogTerm  uint64      `json:"prevLogTerm"`
-	Entries      []*LogEntry `json:"entries"`
-	CommitIndex  uint64      `json:"commitIndex"`
+	peer            *Peer
+	ProtocolVersion int         `json:"protocolVersion,omitempty"`
+	Term            uint64      `json:"term"`
+	LeaderName      string      `json:"leaderName"`
+	PrevLogIndex    uint64      `json:"prevLogIndex"`
+	PrevLogTerm     uint64      `json:"prevLogTerm"`
+	Entries         []*LogEntry `json:"entries"`
+	Compressed      []byte      `json:"compressed,omitempty"`
+	CommitIndex     uint64      `json:"commitIndex"`
+	TraceID         string      `json:"traceId,omitempty"`
 }
 
-// The response returned from a server appending entries to the log.
+// The response returned from a server appending entries to the log. The
+// protocol version is the highest version supported by the responding server
+// and the applied index is the last entry it has applied.
 type AppendEntriesResponse struct {
-	peer    *Peer
-	Term    uint64 `json:"term"`
-	Success bool   `json:"success"`
+	peer            *Peer
+	ProtocolVersion int    `json:"protocolVersion,omitempty"`
+	Term            uint64 `json:"term"`
+	Success         bool   `json:"success"`
+	AppliedIndex    uint64 `json:"appliedIndex,omitempty"`
 }
 
 //------------------------------------------------------------------------------
@@ -33,19 +50,97 @@ type AppendEntriesResponse struct {
 // Creates a new AppendEntries request.
 func NewAppendEntriesRequest(term uint64, leaderName string, prevLogIndex uint64, prevLogTerm uint64, entries []*LogEntry, commitIndex uint64) *AppendEntriesRequest {
 	return &AppendEntriesRequest{
-		Term:         term,
-		LeaderName:   leaderName,
-		PrevLogIndex: prevLogIndex,
-		PrevLogTerm:  prevLogTerm,
-		Entries:      entries,
-		CommitIndex:  commitIndex,
+		ProtocolVersion: MaxProtocolVersion,
+		Term:            term,
+		LeaderName:      leaderName,
+		PrevLogIndex:    prevLogIndex,
+		PrevLogTerm:     prevLogTerm,
+		Entries:         entries,
+		CommitIndex:     commitIndex,
 	}
 }
 
 // Creates a new AppendEntries response.
 func NewAppendEntriesResponse(term uint64, success bool) *AppendEntriesResponse {
 	return &AppendEntriesResponse{
-		Term:    term,
-		Success: success,
+		ProtocolVersion: MaxProtocolVersion,
+		Term:            term,
+		Success:         success,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Compression
+//--------------------------------------
+
+// Returns a copy of the request with its entries gzipped if their encoded
+// size exceeds the threshold. The request itself is returned if it is not
+// worth compressing.
+func (req *AppendEntriesRequest) compress(threshold int) (*AppendEntriesRequest, error) {
+	if threshold <= 0 || len(req.Entries) == 0 {
+		return req, nil
+	}
+
+	var b bytes.Buffer
+	for _, entry := range req.Entries {
+		if err := entry.Encode(&b); err != nil {
+			return nil, err
+		}
+	}
+	if b.Len() <= threshold {
+		return req, nil
+	}
+
+	var z bytes.Buffer
+	w := gzip.NewWriter(&z)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	compressed := *req
+	compressed.Entries, compressed.Compressed = nil, z.Bytes()
+	return &compressed, nil
+}
+
+// Restores the entries of a compressed request or of a request received
+// through a codec using the log to instantiate their commands.
+func (req *AppendEntriesRequest) decompress(log *Log) error {
+	if req.Compressed == nil {
+		for _, entry := range req.Entries {
+			if err := entry.resolve(log); err != nil {
+				return fmt.Errorf("raft.AppendEntriesRequest: Unable to decode entry: %v", err)
+			}
+		}
+		return nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(req.Compressed))
+	if err != nil {
+		return fmt.Errorf("raft.AppendEntriesRequest: Unable to decompress entries: %v", err)
+	}
+	defer r.Close()
+
+	var entries []*LogEntry
+	reader := bufio.NewReader(r)
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+		entry := NewLogEntry(log, 0, 0, nil)
+		if _, err := entry.Decode(reader); err != nil {
+			return fmt.Errorf("raft.AppendEntriesRequest: Unable to decompress entries: %v", err)
+		}
+		entries = append(entries, entry)
 	}
+	req.Entries, req.Compressed = entries, nil
+	return nil
 }
@@ -0,0 +1,63 @@
+package raft
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A codec serializes RPC requests and responses for a transport. Log entries
+// are carried in their log encoding by every codec and their commands are
+// instantiated by the receiving server.
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+// A codec that encodes RPCs as JSON. It is the easiest to inspect and is the
+// default for transports that serialize RPCs.
+type JSONCodec struct{}
+
+// A codec that encodes RPCs with encoding/gob. It is more compact and faster
+// than JSON but is only readable by Go peers.
+type GobCodec struct{}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// JSON
+//--------------------------------------
+
+// Encodes a value as JSON.
+func (c JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Decodes a JSON value.
+func (c JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+//--------------------------------------
+// Gob
+//--------------------------------------
+
+// Encodes a value with gob.
+func (c GobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+// Decodes a gob value.
+func (c GobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
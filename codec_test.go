@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that every RPC survives a round trip through each codec.
+func TestCodecRoundTrip(t *testing.T) {
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	entries := []*LogEntry{
+		NewLogEntry(log, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(log, 2, 2, &TestCommand2{100}),
+	}
+
+	codecs := map[string]Codec{"json": JSONCodec{}, "gob": GobCodec{}}
+	for name, codec := range codecs {
+		voteReq := &RequestVoteRequest{ProtocolVersion: 2, Term: 3, CandidateName: "1", LastLogIndex: 4, LastLogTerm: 2, PreVote: true, TraceID: "abc"}
+		voteResp := NewRequestVoteResponse(3, true)
+		appendResp := NewAppendEntriesResponse(2, true)
+		for _, v := range []interface{}{voteReq, voteResp, appendResp} {
+			out := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+			if err := transcode(codec, v, out); err != nil {
+				t.Fatalf("%s: Unable to round trip %T: %v", name, v, err)
+			}
+			if !reflect.DeepEqual(v, out) {
+				t.Fatalf("%s: %T changed: %v != %v", name, v, out, v)
+			}
+		}
+
+		appendReq := NewAppendEntriesRequest(2, "1", 0, 0, entries, 1)
+		out := &AppendEntriesRequest{}
+		if err := transcode(codec, appendReq, out); err != nil {
+			t.Fatalf("%s: Unable to round trip AppendEntriesRequest: %v", name, err)
+		}
+		if err := out.decompress(log); err != nil {
+			t.Fatalf("%s: Unable to decode entries: %v", name, err)
+		}
+		if out.Term != 2 || out.LeaderName != "1" || out.CommitIndex != 1 || len(out.Entries) != len(entries) {
+			t.Fatalf("%s: AppendEntriesRequest changed: %v", name, out)
+		}
+		for i, entry := range out.Entries {
+			var expected, actual bytes.Buffer
+			entries[i].Encode(&expected)
+			entry.Encode(&actual)
+			if expected.String() != actual.String() {
+				t.Fatalf("%s: Entry %d changed: %q != %q", name, i, actual.String(), expected.String())
+			}
+		}
+	}
+}
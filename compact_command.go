@@ -0,0 +1,58 @@
+package raft
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// The compact command is stored in the start entry of a compacted log. It
+// records the membership of the cluster as of the last removed entry along
+// with any election priorities and voting weights that differ from the
+// default.
+type CompactCommand struct {
+	Peers      []string       `json:"peers"`
+	Priorities map[string]int `json:"priorities,omitempty"`
+	Weights    map[string]int `json:"weights,omitempty"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// This function marks the command as internal.
+func (c *CompactCommand) InternalCommand() bool {
+	return true
+}
+
+// The name of the command in the log.
+func (c *CompactCommand) CommandName() string {
+	return "raft:compact"
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Validates that the command can be executed on the current state machine.
+func (c *CompactCommand) Validate(server *Server) error {
+	return nil
+}
+
+// Updates the state machine to join each of the recorded servers.
+func (c *CompactCommand) Apply(server *Server) {
+	for _, name := range c.Peers {
+		command := &JoinCommand{Name: name}
+		if priority, ok := c.Priorities[name]; ok {
+			command.Priority = &priority
+		}
+		if weight, ok := c.Weights[name]; ok {
+			command.Weight = &weight
+		}
+		command.Apply(server)
+	}
+}
@@ -0,0 +1,63 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A configuration bundles the settings required to create a server. Zero
+// timeouts are replaced with the defaults and a nil transport leaves the
+// server handlers to be set individually.
+type Config struct {
+	Name             string
+	Path             string
+	ElectionTimeout  time.Duration
+	HeartbeatTimeout time.Duration
+	Transport        Transport
+	ApplyFunc        func(*Server, Command)
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Validates that the configuration can be used to create a server. The
+// election timeout must exceed the heartbeat timeout or followers will
+// continually start elections between heartbeats.
+func (c *Config) Validate() error {
+	if c.Name == "" {
+		return errors.New("raft.Config: Name cannot be blank")
+	}
+	if c.ElectionTimeout < 0 || c.HeartbeatTimeout < 0 {
+		return fmt.Errorf("raft.Config: Timeouts cannot be negative: (ELECTION=%v, HEARTBEAT=%v)", c.ElectionTimeout, c.HeartbeatTimeout)
+	}
+	if c.electionTimeout() <= c.heartbeatTimeout() {
+		return fmt.Errorf("raft.Config: Election timeout must exceed heartbeat timeout: (ELECTION=%v, HEARTBEAT=%v)", c.electionTimeout(), c.heartbeatTimeout())
+	}
+	return nil
+}
+
+// Retrieves the election timeout or the default if one is not set.
+func (c *Config) electionTimeout() time.Duration {
+	if c.ElectionTimeout == 0 {
+		return DefaultElectionTimeout
+	}
+	return c.ElectionTimeout
+}
+
+// Retrieves the heartbeat timeout or the default if one is not set.
+func (c *Config) heartbeatTimeout() time.Duration {
+	if c.HeartbeatTimeout == 0 {
+		return DefaultHeartbeatTimeout
+	}
+	return c.HeartbeatTimeout
+}
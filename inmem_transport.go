@@ -0,0 +1,396 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An in-memory transport delivers RPCs directly between servers in the same
+// process. This is primarily useful for testing clusters without sockets.
+//
+// Network faults can be injected between servers. A partition or isolation
+// causes RPCs to be dropped entirely, a latency delays RPCs sent in one
+// direction and a drop rate causes a random fraction of RPCs sent in one
+// direction to be dropped. Vote responses can also be scripted so that a test
+// decides which server wins an election.
+//
+// RPCs are passed by reference unless a codec is set, in which case every
+// request and response is serialized and decoded as a network transport
+// would.
+//
+// Middleware can intercept every RequestVote and AppendEntries RPC before it
+// is delivered to inject arbitrary faults.
+type InmemTransport struct {
+	servers    map[string]*Server
+	partitions map[string]bool
+	isolated   map[string]bool
+	latencies  map[string]time.Duration
+	dropRates  map[string]float64
+	votes      map[string]bool
+	codec      Codec
+	middleware []RPCMiddleware
+	rand       *rand.Rand
+	mutex      sync.Mutex
+}
+
+// The context of an RPC passed to transport middleware. Middleware can set
+// the number of extra copies of the RPC that are delivered before it.
+type RPCContext struct {
+	From       string
+	To         string
+	Duplicates int
+}
+
+// Middleware receives each outbound RequestVoteRequest or
+// AppendEntriesRequest and returns the request to deliver in its place. It
+// can modify a copy of the request, sleep to delay or reorder it and return
+// an error to drop it. The error is returned to the sender. A request that is
+// shared with the sender must not be modified.
+type RPCMiddleware func(ctx *RPCContext, rpc interface{}) (interface{}, error)
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Creates a new in-memory transport.
+func NewInmemTransport() *InmemTransport {
+	return &InmemTransport{
+		servers:    make(map[string]*Server),
+		partitions: make(map[string]bool),
+		isolated:   make(map[string]bool),
+		latencies:  make(map[string]time.Duration),
+		dropRates:  make(map[string]float64),
+		votes:      make(map[string]bool),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Membership
+//--------------------------------------
+
+// Adds a server to the transport and sets the server to send its RPCs
+// through the transport.
+func (t *InmemTransport) AddServer(server *Server) {
+	t.mutex.Lock()
+	t.servers[server.Name()] = server
+	t.mutex.Unlock()
+
+	server.SetTransport(t)
+}
+
+// Removes a server from the transport. RPCs sent to the server will fail.
+func (t *InmemTransport) RemoveServer(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.servers, name)
+}
+
+//--------------------------------------
+// Partitions
+//--------------------------------------
+
+// Drops all RPCs sent between two servers in either direction.
+func (t *InmemTransport) Partition(a string, b string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.partitions[partitionKey(a, b)] = true
+}
+
+// Restores delivery of RPCs between two servers.
+func (t *InmemTransport) Heal(a string, b string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.partitions, partitionKey(a, b))
+}
+
+// Drops all RPCs sent to or from a server.
+func (t *InmemTransport) Isolate(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.isolated[name] = true
+}
+
+// Restores delivery of RPCs to and from an isolated server.
+func (t *InmemTransport) Reconnect(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.isolated, name)
+}
+
+//--------------------------------------
+// Faults
+//--------------------------------------
+
+// Sets the delay applied to RPCs sent from one server to another. A zero
+// duration removes the delay.
+func (t *InmemTransport) SetLatency(from string, to string, d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if d <= 0 {
+		delete(t.latencies, linkKey(from, to))
+	} else {
+		t.latencies[linkKey(from, to)] = d
+	}
+}
+
+// Sets the probability, between 0 and 1, that an RPC sent from one server to
+// another is dropped. A zero probability removes the drop rate.
+func (t *InmemTransport) DropRate(from string, to string, p float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if p <= 0 {
+		delete(t.dropRates, linkKey(from, to))
+	} else {
+		t.dropRates[linkKey(from, to)] = p
+	}
+}
+
+//--------------------------------------
+// Votes
+//--------------------------------------
+
+// Scripts the response to RequestVote RPCs sent from a candidate to a voter.
+// The voter is not consulted so its term and vote are left unchanged. This is
+// only meant for tests that need a specific election outcome. Partitions and
+// other faults still apply to the RPC.
+func (t *InmemTransport) ScriptVote(candidate string, voter string, granted bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.votes[linkKey(candidate, voter)] = granted
+}
+
+// Removes the scripted vote response so RPCs reach the voter again.
+func (t *InmemTransport) ClearVote(candidate string, voter string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.votes, linkKey(candidate, voter))
+}
+
+//--------------------------------------
+// Middleware
+//--------------------------------------
+
+// Adds middleware that intercepts RequestVote and AppendEntries RPCs after
+// partitions and other faults have been applied. Middleware runs in the order
+// it was added.
+func (t *InmemTransport) Use(middleware RPCMiddleware) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.middleware = append(t.middleware, middleware)
+}
+
+// Passes an RPC through the middleware and returns the RPC to deliver along
+// with the number of extra copies to deliver.
+func (t *InmemTransport) intercept(from string, to string, rpc interface{}) (interface{}, int, error) {
+	t.mutex.Lock()
+	middleware := t.middleware
+	t.mutex.Unlock()
+
+	ctx := &RPCContext{From: from, To: to}
+	for _, fn := range middleware {
+		var err error
+		if rpc, err = fn(ctx, rpc); err != nil {
+			return nil, 0, err
+		}
+	}
+	return rpc, ctx.Duplicates, nil
+}
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Retrieves the codec used to serialize RPCs or nil if RPCs are passed by
+// reference.
+func (t *InmemTransport) Codec() Codec {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.codec
+}
+
+// Sets the codec used to serialize RPCs. Passing nil passes RPCs by
+// reference again.
+func (t *InmemTransport) SetCodec(codec Codec) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.codec = codec
+}
+
+// Encodes a value with the codec and decodes it into another value of the
+// same type.
+func transcode(codec Codec, in interface{}, out interface{}) error {
+	var b bytes.Buffer
+	if err := codec.Encode(&b, in); err != nil {
+		return fmt.Errorf("raft.InmemTransport: Unable to encode: %v", err)
+	}
+	if err := codec.Decode(&b, out); err != nil {
+		return fmt.Errorf("raft.InmemTransport: Unable to decode: %v", err)
+	}
+	return nil
+}
+
+// Generates a direction-independent key for a pair of server names.
+func partitionKey(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "/" + b
+}
+
+// Generates a key for RPCs sent from one server to another.
+func linkKey(from string, to string) string {
+	return from + "->" + to
+}
+
+// Retrieves the server an RPC should be delivered to. Returns an error if
+// the server does not exist or if the RPC is dropped. Any latency set for the
+// link is applied before returning.
+func (t *InmemTransport) route(from string, to string) (*Server, error) {
+	t.mutex.Lock()
+	if t.isolated[from] || t.isolated[to] {
+		t.mutex.Unlock()
+		return nil, fmt.Errorf("raft.InmemTransport: Isolated: %s -> %s", from, to)
+	}
+	if t.partitions[partitionKey(from, to)] {
+		t.mutex.Unlock()
+		return nil, fmt.Errorf("raft.InmemTransport: Partitioned: %s -> %s", from, to)
+	}
+	if p := t.dropRates[linkKey(from, to)]; p > 0 && t.rand.Float64() < p {
+		t.mutex.Unlock()
+		return nil, fmt.Errorf("raft.InmemTransport: Dropped: %s -> %s", from, to)
+	}
+	server := t.servers[to]
+	latency := t.latencies[linkKey(from, to)]
+	t.mutex.Unlock()
+
+	if server == nil {
+		return nil, fmt.Errorf("raft.InmemTransport: Server not found: %s", to)
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return server, nil
+}
+
+//--------------------------------------
+// RPCs
+//--------------------------------------
+
+// Sends a command to a peer.
+func (t *InmemTransport) SendDo(server *Server, peer *Peer, command Command) error {
+	target, err := t.route(server.Name(), peer.Name())
+	if err != nil {
+		return err
+	}
+	return target.Do(command)
+}
+
+// Sends a RequestVote RPC to a peer.
+func (t *InmemTransport) SendRequestVote(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	target, err := t.route(server.Name(), peer.Name())
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	granted, scripted := t.votes[linkKey(server.Name(), peer.Name())]
+	t.mutex.Unlock()
+	if scripted {
+		return NewRequestVoteResponse(req.Term, granted), nil
+	}
+
+	rpc, duplicates, err := t.intercept(server.Name(), peer.Name(), req)
+	if err != nil {
+		return nil, err
+	}
+	req, ok := rpc.(*RequestVoteRequest)
+	if !ok {
+		return nil, fmt.Errorf("raft.InmemTransport: Middleware returned %T for a RequestVote RPC", rpc)
+	}
+	for i := 0; i < duplicates; i++ {
+		t.deliverRequestVote(target, req)
+	}
+	return t.deliverRequestVote(target, req)
+}
+
+// Delivers a RequestVote RPC to a server through the codec if one is set.
+func (t *InmemTransport) deliverRequestVote(target *Server, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	codec := t.Codec()
+	if codec == nil {
+		return target.RequestVote(req)
+	}
+	wireReq := &RequestVoteRequest{}
+	if err := transcode(codec, req, wireReq); err != nil {
+		return nil, err
+	}
+	resp, err := target.RequestVote(wireReq)
+	if resp != nil {
+		wireResp := &RequestVoteResponse{}
+		if err := transcode(codec, resp, wireResp); err != nil {
+			return nil, err
+		}
+		resp = wireResp
+	}
+	return resp, err
+}
+
+// Sends an AppendEntries RPC to a peer.
+func (t *InmemTransport) SendAppendEntries(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	target, err := t.route(server.Name(), peer.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	rpc, duplicates, err := t.intercept(server.Name(), peer.Name(), req)
+	if err != nil {
+		return nil, err
+	}
+	req, ok := rpc.(*AppendEntriesRequest)
+	if !ok {
+		return nil, fmt.Errorf("raft.InmemTransport: Middleware returned %T for an AppendEntries RPC", rpc)
+	}
+	for i := 0; i < duplicates; i++ {
+		t.deliverAppendEntries(target, req)
+	}
+	return t.deliverAppendEntries(target, req)
+}
+
+// Delivers an AppendEntries RPC to a server through the codec if one is set.
+func (t *InmemTransport) deliverAppendEntries(target *Server, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	codec := t.Codec()
+	if codec == nil {
+		return target.AppendEntries(req)
+	}
+	wireReq := &AppendEntriesRequest{}
+	if err := transcode(codec, req, wireReq); err != nil {
+		return nil, err
+	}
+	resp, err := target.AppendEntries(wireReq)
+	if resp != nil {
+		wireResp := &AppendEntriesResponse{}
+		if err := transcode(codec, resp, wireResp); err != nil {
+			return nil, err
+		}
+		resp = wireResp
+	}
+	return resp, err
+}
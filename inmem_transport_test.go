@@ -0,0 +1,283 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that servers connected through an in-memory transport can form a cluster.
+func TestInmemTransportCluster(t *testing.T) {
+	servers, _ := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	if servers[0].MemberCount() != 3 {
+		t.Fatalf("Expected member count to be 3, got %v", servers[0].MemberCount())
+	}
+}
+
+// Ensure that RPCs between partitioned servers are dropped until healed.
+func TestInmemTransportPartition(t *testing.T) {
+	transport := NewInmemTransport()
+	leader, follower := newTestServer("1"), newTestServer("2")
+	transport.AddServer(leader)
+	transport.AddServer(follower)
+	follower.Start()
+	defer follower.Stop()
+
+	peer := NewPeer(leader, "2", TestHeartbeatTimeout)
+	defer peer.stop()
+	req := NewAppendEntriesRequest(1, "1", 0, 0, []*LogEntry{}, 0)
+
+	transport.Partition("2", "1")
+	if _, err := transport.SendAppendEntries(leader, peer, req); err == nil || err.Error() != "raft.InmemTransport: Partitioned: 1 -> 2" {
+		t.Fatalf("Partitioned RPC should have been dropped: %v", err)
+	}
+
+	transport.Heal("1", "2")
+	if resp, err := transport.SendAppendEntries(leader, peer, req); !(err == nil && resp.Success && resp.Term == 1) {
+		t.Fatalf("Healed RPC should have been delivered: %v", err)
+	}
+}
+
+// Ensure that RPCs are delayed by the latency set for a link.
+func TestInmemTransportLatency(t *testing.T) {
+	transport := NewInmemTransport()
+	leader, follower := newTestServer("1"), newTestServer("2")
+	transport.AddServer(leader)
+	transport.AddServer(follower)
+	follower.Start()
+	defer follower.Stop()
+
+	peer := NewPeer(leader, "2", TestHeartbeatTimeout)
+	defer peer.stop()
+	req := NewAppendEntriesRequest(1, "1", 0, 0, []*LogEntry{}, 0)
+
+	transport.SetLatency("1", "2", 20*time.Millisecond)
+	t0 := time.Now()
+	if _, err := transport.SendAppendEntries(leader, peer, req); err != nil {
+		t.Fatalf("Delayed RPC should have been delivered: %v", err)
+	}
+	if d := time.Since(t0); d < 20*time.Millisecond {
+		t.Fatalf("RPC was not delayed: %v", d)
+	}
+}
+
+// Ensure that RPCs are dropped according to the drop rate set for a link.
+func TestInmemTransportDropRate(t *testing.T) {
+	transport := NewInmemTransport()
+	leader, follower := newTestServer("1"), newTestServer("2")
+	transport.AddServer(leader)
+	transport.AddServer(follower)
+	follower.Start()
+	defer follower.Stop()
+
+	peer := NewPeer(leader, "2", TestHeartbeatTimeout)
+	defer peer.stop()
+	req := NewAppendEntriesRequest(1, "1", 0, 0, []*LogEntry{}, 0)
+
+	transport.DropRate("1", "2", 1)
+	if _, err := transport.SendAppendEntries(leader, peer, req); err == nil || err.Error() != "raft.InmemTransport: Dropped: 1 -> 2" {
+		t.Fatalf("RPC should have been dropped: %v", err)
+	}
+	transport.DropRate("1", "2", 0)
+	if _, err := transport.SendAppendEntries(leader, peer, req); err != nil {
+		t.Fatalf("RPC should have been delivered: %v", err)
+	}
+}
+
+// Ensure that the majority elects a new leader when the leader is isolated and
+// that the old leader steps down once it is reconnected.
+func TestInmemTransportIsolateLeader(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	leader := servers[0]
+	if leader.State() != Leader {
+		t.Fatalf("Expected server 1 to be leader: %v", leader.State())
+	}
+	term := leader.currentTerm
+
+	transport.Isolate("1")
+	time.Sleep(500 * time.Millisecond)
+	if servers[1].State() != Leader && servers[2].State() != Leader {
+		t.Fatalf("Expected leader re-election: 2=%v, 3=%v", servers[1].State(), servers[2].State())
+	}
+
+	transport.Reconnect("1")
+	time.Sleep(100 * time.Millisecond)
+	// The old leader may legitimately win a later election once reconnected
+	// but it must not still be leading in its original term.
+	if leader.State() == Leader && leader.currentTerm == term {
+		t.Fatalf("Expected old leader to step down: %v (term=%v)", leader.State(), term)
+	}
+}
+
+// Ensure that scripted vote responses decide which server wins an election.
+func TestInmemTransportScriptedVotes(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// Server 3 can only be elected with server 2's vote.
+	transport.ScriptVote("3", "2", false)
+	transport.Isolate("1")
+	for i := 0; i < 100 && servers[1].State() != Leader; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if servers[1].State() != Leader || servers[2].State() == Leader {
+		t.Fatalf("Expected server 2 to be elected: 2=%v, 3=%v", servers[1].State(), servers[2].State())
+	}
+
+	transport.ClearVote("3", "2")
+	if _, scripted := transport.votes[linkKey("3", "2")]; scripted {
+		t.Fatalf("Scripted vote not cleared")
+	}
+}
+
+// Ensure that a cluster replicates commands when every RPC is serialized.
+func TestInmemTransportCodec(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}} {
+		servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+		transport.SetCodec(codec)
+		time.Sleep(100 * time.Millisecond)
+
+		leader := servers[0]
+		if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+			t.Fatalf("%T: Unable to commit: %v", codec, err)
+		}
+		time.Sleep(TestHeartbeatTimeout * 2)
+		for _, server := range servers {
+			if server.log.CommitIndex() != leader.log.CommitIndex() {
+				t.Fatalf("%T: Server %s did not commit: %v != %v", codec, server.Name(), server.log.CommitIndex(), leader.log.CommitIndex())
+			}
+		}
+		servers.Stop()
+	}
+}
+
+// Ensure that middleware can drop, modify and duplicate RPCs.
+func TestInmemTransportMiddleware(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+	leader := servers[0]
+
+	// Entries are withheld from server 3 and every request to server 2 is
+	// delivered twice. Server 3 stops hearing from the leader so it must not
+	// stand for election.
+	servers[2].SetPriority(0)
+	var mutex sync.Mutex
+	seen := map[string]int{}
+	transport.Use(func(ctx *RPCContext, rpc interface{}) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[ctx.To]++
+		if req, ok := rpc.(*AppendEntriesRequest); ok && ctx.To == "3" && len(req.Entries) > 0 {
+			return nil, fmt.Errorf("Dropped by middleware")
+		} else if ctx.To == "2" {
+			ctx.Duplicates = 1
+		}
+		return rpc, nil
+	})
+	transport.Use(func(ctx *RPCContext, rpc interface{}) (interface{}, error) {
+		if req, ok := rpc.(*AppendEntriesRequest); ok && ctx.To == "2" {
+			modified := *req
+			modified.CommitIndex = 0
+			return &modified, nil
+		}
+		return rpc, nil
+	})
+
+	commitIndex := servers[1].CommitIndex()
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	time.Sleep(TestHeartbeatTimeout * 3)
+	if index := servers[1].LastIndex(); index != leader.LastIndex() {
+		t.Fatalf("Server 2 should have received the entry: %v != %v", index, leader.LastIndex())
+	}
+	if index := servers[1].CommitIndex(); index != commitIndex {
+		t.Fatalf("Server 2 should not learn the new commit index: %v != %v", index, commitIndex)
+	}
+	if index := servers[2].LastIndex(); index == leader.LastIndex() {
+		t.Fatalf("Server 3 should not have received the entry: %v", index)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if seen["2"] == 0 || seen["3"] == 0 {
+		t.Fatalf("Middleware should see every RPC: %v", seen)
+	}
+}
+
+// Ensure that a cluster never changes a committed entry while RPCs are
+// randomly dropped, duplicated and delayed.
+func TestInmemTransportMiddlewareFuzz(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	var mutex sync.Mutex
+	r := rand.New(rand.NewSource(1))
+	transport.Use(func(ctx *RPCContext, rpc interface{}) (interface{}, error) {
+		mutex.Lock()
+		n, delay := r.Float64(), time.Duration(r.Intn(10))*time.Millisecond
+		mutex.Unlock()
+		switch {
+		case n < 0.1:
+			return nil, fmt.Errorf("Dropped by middleware")
+		case n < 0.2:
+			ctx.Duplicates = 1
+		case n < 0.3:
+			time.Sleep(delay)
+		}
+		return rpc, nil
+	})
+
+	committed := map[uint64]uint32{}
+	commitIndices := map[string]uint64{}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		for _, server := range servers {
+			if server.State() == Leader {
+				server.Do(&TestCommand1{"foo", 10})
+				break
+			}
+		}
+
+		// Every server must agree with the entries committed so far and its
+		// commit index must never move backwards.
+		for _, server := range servers {
+			index := server.CommitIndex()
+			if index < commitIndices[server.Name()] {
+				t.Fatalf("Server %s commit index moved backwards: %v < %v", server.Name(), index, commitIndices[server.Name()])
+			}
+			commitIndices[server.Name()] = index
+			if index == 0 {
+				continue
+			}
+			entries, err := server.LogEntries(1, index)
+			if err != nil {
+				t.Fatalf("Unable to read server %s log: %v", server.Name(), err)
+			}
+			for _, entry := range entries {
+				if checksum, ok := committed[entry.Index()]; ok && checksum != entry.Checksum() {
+					t.Fatalf("Server %s changed committed entry %v", server.Name(), entry.Index())
+				}
+				committed[entry.Index()] = entry.Checksum()
+			}
+		}
+	}
+	if len(committed) < 10 {
+		t.Fatalf("Too few entries committed: %v", len(committed))
+	}
+}
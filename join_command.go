@@ -11,9 +11,13 @@ import (
 //
 //------------------------------------------------------------------------------
 
-// The join command allows a server to gain membership into a cluster.
+// The join command allows a server to gain membership into a cluster. The
+// election priority and voting weight are only recorded if they differ from
+// the default.
 type JoinCommand struct {
-	Name string `join:"name"`
+	Name     string `join:"name"`
+	Priority *int   `json:"priority,omitempty"`
+	Weight   *int   `json:"weight,omitempty"`
 }
 
 //------------------------------------------------------------------------------
@@ -49,10 +53,26 @@ func (c *JoinCommand) Validate(server *Server) error {
 	return nil
 }
 
-// Updates the state machine to join the server to the cluster.
+// Updates the state machine to join the server to the cluster. Servers that
+// are already members are not added again. A removed server that is added
+// back becomes a follower.
 func (c *JoinCommand) Apply(server *Server) {
-	if server.name != c.Name {
+	if server.name == c.Name {
+		server.setRemoved(false)
+		if c.Priority != nil {
+			server.priority = *c.Priority
+		}
+		if c.Weight != nil {
+			server.weight = *c.Weight
+		}
+	} else if server.peers[c.Name] == nil {
 		peer := NewPeer(server, c.Name, server.heartbeatTimeout)
+		if c.Priority != nil {
+			peer.priority = *c.Priority
+		}
+		if c.Weight != nil {
+			peer.weight = *c.Weight
+		}
 		server.peers[peer.name] = peer
 	}
 }
@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// The leave command removes a server from the membership of a cluster.
+type LeaveCommand struct {
+	Name string `json:"name"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// This function marks the command as internal.
+func (c *LeaveCommand) InternalCommand() bool {
+	return true
+}
+
+// The name of the command in the log.
+func (c *LeaveCommand) CommandName() string {
+	return "raft:leave"
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Validates that the command can be executed on the current state machine.
+func (c *LeaveCommand) Validate(server *Server) error {
+	if c.Name == "" {
+		return errors.New("raft.LeaveCommand: Cannot remove unnamed server")
+	}
+	if server.peers[c.Name] == nil {
+		return fmt.Errorf("raft.LeaveCommand: Server with name is not registered (%s)", c.Name)
+	}
+	return nil
+}
+
+// Updates the state machine to remove the server from the cluster. A leader
+// sends the removed server one last request so that it learns its removal is
+// committed. A server applying its own removal stops standing for election.
+func (c *LeaveCommand) Apply(server *Server) {
+	if server.name == c.Name {
+		server.setRemoved(true)
+	} else if peer := server.peers[c.Name]; peer != nil {
+		delete(server.peers, c.Name)
+		if server.state == Leader {
+			go func() {
+				peer.flush()
+				peer.stop()
+			}()
+		} else {
+			peer.stop()
+		}
+	}
+}
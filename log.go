@@ -18,12 +18,17 @@ import (
 
 // A log is a collection of log entries that are persisted to durable storage.
 type Log struct {
-	ApplyFunc    func(Command)
-	file         *os.File
-	entries      []*LogEntry
-	commitIndex  uint64
-	commandTypes map[string]Command
-	mutex        sync.Mutex
+	ApplyFunc      func(Command)
+	ApplyBatchFunc func([]*LogEntry)
+	applyEntryFunc func(*LogEntry)
+	file           *os.File
+	path           string
+	start          *LogEntry
+	entries        []*LogEntry
+	commitIndex    uint64
+	commandTypes   map[string]Command
+	unknownPolicy  UnknownCommandPolicy
+	mutex          sync.Mutex
 }
 
 //------------------------------------------------------------------------------
@@ -34,8 +39,11 @@ type Log struct {
 
 // Creates a new log.
 func NewLog() *Log {
-	l := &Log{commandTypes: make(map[string]Command)}
+	l := &Log{commandTypes: make(map[string]Command), unknownPolicy: UnknownCommandFail}
 	l.AddCommandType(&JoinCommand{})
+	l.AddCommandType(&LeaveCommand{})
+	l.AddCommandType(&NoopCommand{})
+	l.AddCommandType(&CompactCommand{})
 	return l
 }
 
@@ -55,11 +63,47 @@ func (l *Log) CurrentIndex() uint64 {
 	defer l.mutex.Unlock()
 
 	if len(l.entries) == 0 {
-		return 0
+		return l.startIndex()
 	}
 	return l.entries[len(l.entries)-1].index
 }
 
+// The index of the first entry in the log that has not been removed by
+// compaction. This is zero if the log has no entries.
+func (l *Log) FirstIndex() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.entries) == 0 {
+		return 0
+	}
+	return l.entries[0].index
+}
+
+// The index of the last entry removed from the front of the log by
+// compaction. This is zero if the log has not been compacted.
+func (l *Log) StartIndex() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.startIndex()
+}
+
+// The entry that marks the start of a compacted log or nil if the log has not
+// been compacted.
+func (l *Log) startEntry() *LogEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.start
+}
+
+// The start index without a lock.
+func (l *Log) startIndex() uint64 {
+	if l.start == nil {
+		return 0
+	}
+	return l.start.index
+}
+
 // The next index in the log.
 func (l *Log) NextIndex() uint64 {
 	return l.CurrentIndex() + 1
@@ -67,6 +111,8 @@ func (l *Log) NextIndex() uint64 {
 
 // The last committed index in the log.
 func (l *Log) CommitIndex() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.commitIndex
 }
 
@@ -74,7 +120,7 @@ func (l *Log) CommitIndex() uint64 {
 func (l *Log) IsEmpty() bool {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
-	return (len(l.entries) == 0)
+	return (len(l.entries) == 0 && l.start == nil)
 }
 
 // A list of all the log entries. This should only be used for debugging purposes.
@@ -92,11 +138,32 @@ func (l *Log) CurrentTerm() uint64 {
 	defer l.mutex.Unlock()
 
 	if len(l.entries) == 0 {
-		return 0
+		return l.startTerm()
 	}
 	return l.entries[len(l.entries)-1].term
 }
 
+// The term of the last entry removed from the front of the log by compaction.
+// This function does not obtain a lock.
+func (l *Log) startTerm() uint64 {
+	if l.start == nil {
+		return 0
+	}
+	return l.start.term
+}
+
+// The term of the entry at the given index, including the entry that marks
+// the start of a compacted log. This function does not obtain a lock.
+func (l *Log) termAt(index uint64) (uint64, bool) {
+	startIndex := l.startIndex()
+	if index < startIndex || index > startIndex+uint64(len(l.entries)) {
+		return 0, false
+	} else if index == startIndex {
+		return l.startTerm(), true
+	}
+	return l.entries[index-startIndex-1].term, true
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -140,17 +207,52 @@ func (l *Log) AddCommandType(command Command) {
 	l.commandTypes[command.CommandName()] = command
 }
 
+// Sets how committed commands whose type has not been registered are handled.
+func (l *Log) SetUnknownCommandPolicy(policy UnknownCommandPolicy) error {
+	switch policy {
+	case UnknownCommandFail, UnknownCommandSkip, UnknownCommandPanic:
+	default:
+		return fmt.Errorf("raft.Log: Invalid unknown command policy: %s", policy)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.unknownPolicy = policy
+	return nil
+}
+
+// Applies the unknown command policy to an entry. This function does not
+// obtain a lock.
+func (l *Log) checkUnknownCommand(entry *LogEntry) error {
+	c, ok := entry.command.(*UnknownCommand)
+	if !ok {
+		return nil
+	}
+	switch l.unknownPolicy {
+	case UnknownCommandSkip:
+		warn("raft.Log: Skipping unknown command (%s) at index %d", c.Name, entry.index)
+		return nil
+	case UnknownCommandPanic:
+		panic(fmt.Sprintf("raft.Log: Unknown command (%s) at index %d", c.Name, entry.index))
+	}
+	return fmt.Errorf("raft.Log: Unknown command (%s) at index %d", c.Name, entry.index)
+}
+
 //--------------------------------------
 // State
 //--------------------------------------
 
 // Opens the log file and reads existing entries. The log can remain open and
-// continue to append entries to the end of the log.
+// continue to append entries to the end of the log. An incomplete final entry
+// left by an interrupted write is truncated from the file. Any other entry
+// that cannot be decoded, such as one whose checksum does not match its
+// content, means the log is corrupt and an error is returned.
 func (l *Log) Open(path string) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
+	l.path = path
 
-	// Read all the entries from the log if one exists.
+	// Read all the entries from the log if one exists. A log that has been
+	// compacted begins with a start entry holding a compact command.
 	var lastIndex int = 0
 	if _, err := os.Stat(path); !os.IsNotExist(err) {
 		// Open the log file.
@@ -171,6 +273,14 @@ func (l *Log) Open(path string) error {
 			entry := NewLogEntry(l, 0, 0, nil)
 			n, err := entry.Decode(reader)
 			if err != nil {
+				// A complete line after the last good entry was written in
+				// full and cannot be recovered by truncating it.
+				if _, serr := file.Seek(int64(lastIndex), io.SeekStart); serr != nil {
+					return serr
+				}
+				if _, rerr := bufio.NewReader(file).ReadString('\n'); rerr != io.EOF {
+					return fmt.Errorf("raft.Log: Corrupt entry at offset %d: %v", lastIndex, err)
+				}
 				warn("raft.Log: %v", err)
 				warn("raft.Log: Recovering (%d)", lastIndex)
 				file.Close()
@@ -183,7 +293,11 @@ func (l *Log) Open(path string) error {
 			lastIndex += n
 
 			// Append entry.
-			l.entries = append(l.entries, entry)
+			if _, ok := entry.command.(*CompactCommand); ok && l.start == nil && len(l.entries) == 0 {
+				l.start = entry
+			} else {
+				l.entries = append(l.entries, entry)
+			}
 		}
 
 		file.Close()
@@ -199,16 +313,33 @@ func (l *Log) Open(path string) error {
 	return nil
 }
 
-// Closes the log file.
+// Flushes the committed entries written to the log file to stable storage.
+func (l *Log) Sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return errors.New("raft.Log: Log not open")
+	}
+	return l.file.Sync()
+}
+
+// Closes the log file after syncing it so that every committed entry is
+// durable once the log is closed.
 func (l *Log) Close() {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
 	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			warn("raft.Log: Unable to sync: %v", err)
+		}
 		l.file.Close()
 		l.file = nil
 	}
 	l.entries = make([]*LogEntry, 0)
+	l.start = nil
+	l.commitIndex = 0
 }
 
 //--------------------------------------
@@ -217,7 +348,7 @@ func (l *Log) Close() {
 
 // Creates a log entry associated with this log.
 func (l *Log) CreateEntry(term uint64, command Command) *LogEntry {
-	return NewLogEntry(l, l.NextIndex(), term, command)
+	return NewLogEntryWithType(l, l.NextIndex(), term, commandEntryType(command), command)
 }
 
 // Checks if the log contains a given index/term combination.
@@ -225,31 +356,89 @@ func (l *Log) ContainsEntry(index uint64, term uint64) bool {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	if index == 0 || index > uint64(len(l.entries)) {
+	startIndex := l.startIndex()
+	if index == 0 || index < startIndex || index > startIndex+uint64(len(l.entries)) {
 		return false
+	} else if index == startIndex {
+		return (l.startTerm() == term)
 	}
-	return (l.entries[index-1].term == term)
+	return (l.entries[index-startIndex-1].term == term)
 }
 
-// Retrieves a list of entries after a given index. This function also returns
-// the term of the index provided.
+// Retrieves a copy of the entries after a given index so that the caller can
+// use them after the log is truncated. This function also returns the term
+// of the index provided.
 func (l *Log) GetEntriesAfter(index uint64) ([]*LogEntry, uint64) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
 	// Return an error if the index doesn't exist.
-	if index > uint64(len(l.entries)) {
+	startIndex := l.startIndex()
+	if index > startIndex+uint64(len(l.entries)) {
 		panic(fmt.Sprintf("raft.Log: Index is beyond end of log: %v", index))
+	} else if index < startIndex {
+		panic(fmt.Sprintf("raft.Log: Index has been compacted: %v", index))
 	}
 
 	// If we're going from the beginning of the log then return the whole log.
-	if index == 0 {
-		return l.entries, 0
+	entries := make([]*LogEntry, len(l.entries)-int(index-startIndex))
+	copy(entries, l.entries[index-startIndex:])
+	if index == startIndex {
+		return entries, l.startTerm()
+	}
+	return entries, l.entries[index-startIndex-1].term
+}
+
+// Retrieves a copy of the entries between the start and end index, inclusive.
+// An error is returned if the range is empty or extends outside of the log.
+func (l *Log) GetEntriesBetween(start uint64, end uint64) ([]*LogEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	startIndex := l.startIndex()
+	if start == 0 || start > end {
+		return nil, fmt.Errorf("raft.Log: Invalid entry range: (START=%v, END=%v)", start, end)
+	}
+	if start <= startIndex {
+		return nil, fmt.Errorf("raft.Log: Entry range has been compacted (MIN=%v): (START=%v, END=%v)", startIndex+1, start, end)
+	}
+	if end > startIndex+uint64(len(l.entries)) {
+		return nil, fmt.Errorf("raft.Log: Entry range is beyond end of log (MAX=%v): (START=%v, END=%v)", startIndex+uint64(len(l.entries)), start, end)
 	}
 
-	// Determine the term at the given entry and return a subslice.
-	term := l.entries[index-1].term
-	return l.entries[index:], term
+	entries := make([]*LogEntry, end-start+1)
+	copy(entries, l.entries[start-startIndex-1:end-startIndex])
+	return entries, nil
+}
+
+// Retrieves the index of the last committed configuration entry. The start
+// index is returned if no retained committed entry changes the configuration
+// since the membership is recorded when the log is compacted.
+func (l *Log) configurationIndex() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i := int(l.commitIndex-l.startIndex()) - 1; i >= 0; i-- {
+		if commandEntryType(l.entries[i].command) == EntryConfiguration {
+			return l.entries[i].index
+		}
+	}
+	return l.startIndex()
+}
+
+// Retrieves the last configuration entry that has not been committed or nil
+// if every configuration entry has been committed. Only the uncommitted tail
+// of the log is searched.
+func (l *Log) pendingConfiguration() *LogEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i := len(l.entries) - 1; i >= 0 && l.entries[i].index > l.commitIndex; i-- {
+		if commandEntryType(l.entries[i].command) == EntryConfiguration {
+			return l.entries[i]
+		}
+	}
+	return nil
 }
 
 //--------------------------------------
@@ -264,10 +453,12 @@ func (l *Log) CommitInfo() (index uint64, term uint64) {
 	// If we don't have any entries then just return zeros.
 	if l.commitIndex == 0 {
 		return 0, 0
+	} else if l.commitIndex == l.startIndex() {
+		return l.startIndex(), l.startTerm()
 	}
 
 	// Return the last index & term from the last committed entry.
-	lastCommitEntry := l.entries[l.commitIndex-1]
+	lastCommitEntry := l.entries[l.commitIndex-l.startIndex()-1]
 	return lastCommitEntry.index, lastCommitEntry.term
 }
 
@@ -277,7 +468,7 @@ func (l *Log) SetCommitIndex(index uint64) error {
 	defer l.mutex.Unlock()
 
 	// Panic if we don't have any way to apply commands.
-	if l.ApplyFunc == nil {
+	if l.ApplyFunc == nil && l.ApplyBatchFunc == nil && l.applyEntryFunc == nil {
 		panic("raft.Log: Apply function not set")
 	}
 
@@ -285,27 +476,52 @@ func (l *Log) SetCommitIndex(index uint64) error {
 	if index < l.commitIndex {
 		return fmt.Errorf("raft.Log: Commit index (%d) ahead of requested commit index (%d)", l.commitIndex, index)
 	}
-	if index > uint64(len(l.entries)) {
-		return fmt.Errorf("raft.Log: Commit index (%d) out of range (%d)", index, len(l.entries))
+	startIndex := l.startIndex()
+	if index > startIndex+uint64(len(l.entries)) {
+		return fmt.Errorf("raft.Log: Commit index (%d) out of range (%d)", index, startIndex+uint64(len(l.entries)))
 	}
 
 	// Find all entries whose index is between the previous index and the current index.
+	var batch []*LogEntry
+	var err error
 	for i := l.commitIndex + 1; i <= index; i++ {
-		entry := l.entries[i-1]
+		entry := l.entries[i-startIndex-1]
+
+		// Unknown commands are checked before they are written so that a
+		// failed commit stops at the entry.
+		if err = l.checkUnknownCommand(entry); err != nil {
+			break
+		}
 
 		// Write to storage.
-		if err := entry.Encode(l.file); err != nil {
-			return err
+		if err = entry.Encode(l.file); err != nil {
+			break
+		}
+
+		// Entries are collected when they are applied in a single batch.
+		if l.ApplyBatchFunc != nil {
+			batch = append(batch, entry)
+			continue
 		}
 
 		// Apply the changes to the state machine.
-		l.ApplyFunc(entry.command)
+		if l.applyEntryFunc != nil {
+			l.applyEntryFunc(entry)
+		} else {
+			l.ApplyFunc(entry.command)
+		}
 
 		// Update commit index.
 		l.commitIndex = entry.index
 	}
 
-	return nil
+	// Apply the entries that were written in a batch.
+	if len(batch) > 0 {
+		l.ApplyBatchFunc(batch)
+		l.commitIndex = batch[len(batch)-1].index
+	}
+
+	return err
 }
 
 //--------------------------------------
@@ -319,31 +535,193 @@ func (l *Log) Truncate(index uint64, term uint64) error {
 	defer l.mutex.Unlock()
 
 	// Do not allow committed entries to be truncated.
-	if index < l.CommitIndex() {
-		return fmt.Errorf("raft.Log: Index is already committed (%v): (IDX=%v, TERM=%v)", l.CommitIndex(), index, term)
+	if index < l.commitIndex {
+		return fmt.Errorf("raft.Log: Index is already committed (%v): (IDX=%v, TERM=%v)", l.commitIndex, index, term)
 	}
 
 	// Do not truncate past end of entries.
-	if index > uint64(len(l.entries)) {
-		return fmt.Errorf("raft.Log: Entry index does not exist (MAX=%v): (IDX=%v, TERM=%v)", len(l.entries), index, term)
+	startIndex := l.startIndex()
+	if index > startIndex+uint64(len(l.entries)) {
+		return fmt.Errorf("raft.Log: Entry index does not exist (MAX=%v): (IDX=%v, TERM=%v)", startIndex+uint64(len(l.entries)), index, term)
 	}
 
 	// If we're truncating everything then just clear the entries.
-	if index == 0 {
+	if index == startIndex {
+		if index > 0 && l.startTerm() != term {
+			return fmt.Errorf("raft.Log: Entry at index does not have matching term (%v): (IDX=%v, TERM=%v)", l.startTerm(), index, term)
+		}
 		l.entries = []*LogEntry{}
 	} else {
 		// Do not truncate if the entry at index does not have the matching term.
-		entry := l.entries[index-1]
+		entry := l.entries[index-startIndex-1]
 		if len(l.entries) > 0 && entry.term != term {
 			return fmt.Errorf("raft.Log: Entry at index does not have matching term (%v): (IDX=%v, TERM=%v)", entry.term, index, term)
 		}
 
 		// Otherwise truncate up to the desired entry.
-		if index < uint64(len(l.entries)) {
-			l.entries = l.entries[0:index]
+		if index-startIndex < uint64(len(l.entries)) {
+			l.entries = l.entries[0 : index-startIndex]
+		}
+	}
+
+	return nil
+}
+
+//--------------------------------------
+// Compaction
+//--------------------------------------
+
+// Removes the committed entries up to and including the given index from the
+// front of the log. The log file is rewritten to begin with a start entry in
+// place of the removed entries. The start entry records the index and term of
+// the last removed entry along with a command that describes the removed state
+// such as the membership.
+func (l *Log) Compact(index uint64, command Command) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return errors.New("raft.Log: Log is not open")
+	}
+	if index > l.commitIndex {
+		return fmt.Errorf("raft.Log: Cannot compact uncommitted entries (%v): (IDX=%v)", l.commitIndex, index)
+	}
+	startIndex := l.startIndex()
+	if index <= startIndex {
+		return nil
+	}
+	start := NewLogEntryWithType(l, index, l.entries[index-startIndex-1].term, EntryConfiguration, command)
+	entries := l.entries[index-startIndex:]
+
+	// Write the start entry and the remaining committed entries to a new file
+	// and move it over the existing log.
+	path := l.path + ".compact"
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err = start.Encode(file); err == nil {
+		for _, entry := range entries[:l.commitIndex-index] {
+			if err = entry.Encode(file); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path, l.path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("raft.Log: Unable to compact: %v", err)
+	}
+
+	// Reopen the log for appending.
+	l.file.Close()
+	if l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return err
+	}
+
+	l.start = start
+	l.entries = append([]*LogEntry{}, entries...)
+	return nil
+}
+
+//--------------------------------------
+// Export
+//--------------------------------------
+
+// Writes the start entry of a compacted log followed by the committed entries
+// to a writer in the log file format. Uncommitted entries are not written.
+func (l *Log) Export(w io.Writer) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return errors.New("raft.Log: Log is not open")
+	}
+	if l.start != nil {
+		if err := l.start.Encode(w); err != nil {
+			return err
 		}
 	}
+	for _, entry := range l.entries[:l.commitIndex-l.startIndex()] {
+		if err := entry.Encode(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads entries written by Export and writes them to a new log file at the
+// given path. Every entry is decoded so a corrupted checksum or an unknown
+// command fails the import, as does an entry that does not follow the
+// previous one or a first entry that is neither the first index nor the start
+// of a compacted log. The log must not be open and the path must not already
+// hold entries.
+func (l *Log) Import(path string, r io.Reader) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
+	if l.file != nil {
+		return errors.New("raft.Log: Cannot import into an open log")
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		return errors.New("raft.Log: Cannot import into a non-empty log")
+	}
+
+	// Decode and check the entries before anything is written.
+	var entries []*LogEntry
+	reader := bufio.NewReader(r)
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+		entry := NewLogEntry(l, 0, 0, nil)
+		if _, err := entry.Decode(reader); err != nil {
+			return err
+		}
+		if c, ok := entry.command.(*UnknownCommand); ok {
+			return fmt.Errorf("raft.Log: Unregistered command type: %s", c.Name)
+		}
+		if len(entries) == 0 {
+			if _, ok := entry.command.(*CompactCommand); !ok && entry.index != 1 {
+				return fmt.Errorf("raft.Log: Import does not begin at the start of the log: (IDX=%v)", entry.index)
+			}
+		} else {
+			prev := entries[len(entries)-1]
+			if entry.index != prev.index+1 || entry.term < prev.term {
+				return fmt.Errorf("raft.Log: Entry out of order: (%x:%x) after (%x:%x)", entry.term, entry.index, prev.term, prev.index)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	// Write the entries to a new file and move it into place.
+	tmp := path + ".import"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = entry.Encode(file); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("raft.Log: Unable to import: %v", err)
+	}
 	return nil
 }
 
@@ -10,18 +10,41 @@ import (
 	"io"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const (
+	// A command entry is applied to the state machine.
+	EntryCommand EntryType = "command"
+
+	// A configuration entry changes the membership of the cluster.
+	EntryConfiguration EntryType = "config"
+
+	// A no-op entry is committed but is not applied to the state machine.
+	EntryNoop EntryType = "noop"
+)
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
 //
 //------------------------------------------------------------------------------
 
-// A log entry stores a single item in the log.
+// The type of a log entry determines how it is applied once committed.
+type EntryType string
+
+// A log entry stores a single item in the log. An entry received through a
+// codec holds its encoding until the receiving log instantiates its command.
 type LogEntry struct {
-	log     *Log
-	index   uint64
-	term    uint64
-	command Command
+	log       *Log
+	index     uint64
+	term      uint64
+	entryType EntryType
+	command   Command
+	encoded   []byte
 }
 
 //------------------------------------------------------------------------------
@@ -30,14 +53,54 @@ type LogEntry struct {
 //
 //------------------------------------------------------------------------------
 
-// Creates a new log entry associated with a log.
+// Creates a new command entry associated with a log.
 func NewLogEntry(log *Log, index uint64, term uint64, command Command) *LogEntry {
+	return NewLogEntryWithType(log, index, term, EntryCommand, command)
+}
+
+// Creates a new log entry of the given type associated with a log.
+func NewLogEntryWithType(log *Log, index uint64, term uint64, entryType EntryType, command Command) *LogEntry {
 	return &LogEntry{
-		log:     log,
-		index:   index,
-		term:    term,
-		command: command,
+		log:       log,
+		index:     index,
+		term:      term,
+		entryType: entryType,
+		command:   command,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// The index of the entry in the log.
+func (e *LogEntry) Index() uint64 {
+	return e.index
+}
+
+// The term that the entry was created in.
+func (e *LogEntry) Term() uint64 {
+	return e.term
+}
+
+// The type of the entry.
+func (e *LogEntry) Type() EntryType {
+	return e.entryType
+}
+
+// The command stored in the entry.
+func (e *LogEntry) Command() Command {
+	return e.command
+}
+
+// The name of the command stored in the entry.
+func (e *LogEntry) CommandName() string {
+	if e.command == nil {
+		return ""
 	}
+	return e.command.CommandName()
 }
 
 //------------------------------------------------------------------------------
@@ -50,29 +113,67 @@ func NewLogEntry(log *Log, index uint64, term uint64, command Command) *LogEntry
 // Encoding
 //--------------------------------------
 
-// Encodes the log entry to a buffer.
+// Encodes the log entry to a buffer. Each entry is written as a single line
+// that begins with its checksum.
 func (e *LogEntry) Encode(w io.Writer) error {
 	if w == nil {
 		return errors.New("raft.LogEntry: Writer required to encode")
 	}
 
-	encodedCommand, err := json.Marshal(e.command)
+	line, err := e.encodeLine()
 	if err != nil {
 		return err
 	}
 
-	// Write log line to temporary buffer.
+	// Write log entry with checksum.
+	_, err = fmt.Fprintf(w, "%08x %s", crc32.ChecksumIEEE(line), line)
+	return err
+}
+
+// Writes the index, term, entry type, command name and command of the entry
+// as the line that follows the checksum.
+func (e *LogEntry) encodeLine() ([]byte, error) {
+	encodedCommand, err := json.Marshal(e.command)
+	if err != nil {
+		return nil, err
+	}
+
 	var b bytes.Buffer
-	if _, err = fmt.Fprintf(&b, "%016x %016x %s %s\n", e.index, e.term, e.command.CommandName(), encodedCommand); err != nil {
-		return err
+	if _, err = fmt.Fprintf(&b, "%016x %016x %s %s %s\n", e.index, e.term, e.entryType, e.command.CommandName(), encodedCommand); err != nil {
+		return nil, err
 	}
+	return b.Bytes(), nil
+}
 
-	// Generate checksum.
-	checksum := crc32.ChecksumIEEE(b.Bytes())
+// Retrieves the checksum that identifies the entry in the log. It is the
+// IEEE CRC-32 of the encoded line following the checksum, which holds the
+// index, term, entry type and command bytes, so the same entry always has the
+// same checksum. Decoding fails if the stored checksum does not match the
+// line so an entry that was corrupted on disk is not loaded. An entry read
+// from a line written before the entry type was recorded was verified against
+// that line and has a different checksum once encoded again. Zero is returned
+// if the command cannot be encoded.
+func (e *LogEntry) Checksum() uint32 {
+	checksum, _ := e.checksum()
+	return checksum
+}
 
-	// Write log entry with checksum.
-	_, err = fmt.Fprintf(w, "%08x %s", checksum, b.String())
-	return err
+// Calculates the checksum of the entry and returns any encoding error.
+func (e *LogEntry) checksum() (uint32, error) {
+	line, err := e.encodeLine()
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(line), nil
+}
+
+// Calculates the number of bytes in the encoded entry.
+func (e *LogEntry) encodedSize() (int, error) {
+	var b bytes.Buffer
+	if err := e.Encode(&b); err != nil {
+		return 0, err
+	}
+	return b.Len(), nil
 }
 
 // Decodes the log entry from a buffer. Returns the number of bytes read.
@@ -118,16 +219,30 @@ func (e *LogEntry) Decode(r io.Reader) (pos int, err error) {
 		return
 	}
 
-	// Read term, index and command name.
-	var commandName string
-	if _, err = fmt.Fscanf(b, "%016x %016x %s ", &e.index, &e.term, &commandName); err != nil {
+	// Read term, index, entry type and command name. Entries written before
+	// the entry type was recorded are typed by their command.
+	var field, commandName string
+	if _, err = fmt.Fscanf(b, "%016x %016x %s ", &e.index, &e.term, &field); err != nil {
 		err = fmt.Errorf("raft.LogEntry: Unable to scan: %v", err)
 		return
 	}
+	switch EntryType(field) {
+	case EntryCommand, EntryConfiguration, EntryNoop:
+		e.entryType = EntryType(field)
+		if _, err = fmt.Fscanf(b, "%s ", &commandName); err != nil {
+			err = fmt.Errorf("raft.LogEntry: Unable to scan: %v", err)
+			return
+		}
+	default:
+		commandName = field
+	}
 
-	// Instantiate command by name.
-	command, err := e.log.NewCommand(commandName)
-	if err != nil {
+	// Instantiate command by name. Commands that have not been registered are
+	// kept as they were written and handled when they are applied.
+	var command Command
+	if e.log.commandTypes[commandName] == nil {
+		command = &UnknownCommand{Name: commandName}
+	} else if command, err = e.log.NewCommand(commandName); err != nil {
 		err = fmt.Errorf("raft.LogEntry: Unable to instantiate command (%s): %v", commandName, err)
 		return
 	}
@@ -138,6 +253,9 @@ func (e *LogEntry) Decode(r io.Reader) (pos int, err error) {
 		return
 	}
 	e.command = command
+	if e.entryType == "" {
+		e.entryType = commandEntryType(command)
+	}
 
 	// Make sure there's only an EOF remaining.
 	c, err := b.ReadByte()
@@ -149,3 +267,75 @@ func (e *LogEntry) Decode(r io.Reader) (pos int, err error) {
 	err = nil
 	return
 }
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes the entry as a JSON string holding its log encoding.
+func (e *LogEntry) MarshalJSON() ([]byte, error) {
+	b, err := e.wireEncoding()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(b))
+}
+
+// Keeps the log encoding of an entry until it is resolved by a log.
+func (e *LogEntry) UnmarshalJSON(b []byte) error {
+	var encoded string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return err
+	}
+	e.encoded = []byte(encoded)
+	return nil
+}
+
+// Encodes the entry for gob as its log encoding.
+func (e *LogEntry) GobEncode() ([]byte, error) {
+	return e.wireEncoding()
+}
+
+// Keeps the log encoding of an entry until it is resolved by a log.
+func (e *LogEntry) GobDecode(b []byte) error {
+	e.encoded = append([]byte(nil), b...)
+	return nil
+}
+
+// Retrieves the log encoding of the entry, reusing the encoding it was
+// received with if its command has not been instantiated.
+func (e *LogEntry) wireEncoding() ([]byte, error) {
+	if e.encoded != nil {
+		return e.encoded, nil
+	}
+	var b bytes.Buffer
+	if err := e.Encode(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Instantiates the command of an entry received through a codec using the
+// command types registered with the log.
+func (e *LogEntry) resolve(log *Log) error {
+	if e.encoded == nil {
+		return nil
+	}
+	e.log = log
+	if _, err := e.Decode(bytes.NewReader(e.encoded)); err != nil {
+		return err
+	}
+	e.encoded = nil
+	return nil
+}
+
+// Retrieves the type of entry used to store a command.
+func commandEntryType(command Command) EntryType {
+	switch command.(type) {
+	case *JoinCommand, *LeaveCommand:
+		return EntryConfiguration
+	case *NoopCommand:
+		return EntryNoop
+	}
+	return EntryCommand
+}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -44,8 +45,8 @@ func TestLogNewLog(t *testing.T) {
 	if err := log.SetCommitIndex(2); err != nil {
 		t.Fatalf("Unable to partially commit: %v", err)
 	}
-	expected := `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n" +
-		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}` + "\n"
+	expected := `94ed6591 0000000000000001 0000000000000001 command cmd_1 {"val":"foo","i":20}` + "\n" +
+		`a766f5ac 0000000000000002 0000000000000001 command cmd_2 {"x":100}` + "\n"
 	actual, _ := ioutil.ReadFile(path)
 	if string(actual) != expected {
 		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
@@ -58,9 +59,9 @@ func TestLogNewLog(t *testing.T) {
 	if err := log.SetCommitIndex(3); err != nil {
 		t.Fatalf("Unable to commit: %v", err)
 	}
-	expected = `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n" +
-		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}` + "\n" +
-		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}` + "\n"
+	expected = `94ed6591 0000000000000001 0000000000000001 command cmd_1 {"val":"foo","i":20}` + "\n" +
+		`a766f5ac 0000000000000002 0000000000000001 command cmd_2 {"x":100}` + "\n" +
+		`14776541 0000000000000003 0000000000000002 command cmd_1 {"val":"bar","i":0}` + "\n"
 	actual, _ = ioutil.ReadFile(path)
 	if string(actual) != expected {
 		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
@@ -70,6 +71,32 @@ func TestLogNewLog(t *testing.T) {
 	}
 }
 
+// Ensure that committed entries survive closing and reopening the log.
+func TestLogCloseAndReopen(t *testing.T) {
+	log, path := setupLog("")
+	defer os.Remove(path)
+	log.AppendEntry(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}))
+	log.AppendEntry(NewLogEntry(log, 2, 3, &TestCommand2{100}))
+	if err := log.SetCommitIndex(2); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if err := log.Sync(); err != nil {
+		t.Fatalf("Unable to sync: %v", err)
+	}
+	log.Close()
+	if err := log.Sync(); err == nil || err.Error() != "raft.Log: Log not open" {
+		t.Fatalf("Sync of a closed log should have failed: %v", err)
+	}
+
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	defer log.Close()
+	if log.CurrentIndex() != 2 || log.CurrentTerm() != 3 || !reflect.DeepEqual(log.entries[1], NewLogEntry(log, 2, 3, &TestCommand2{100})) {
+		t.Fatalf("Unexpected log after reopen: %v/%v", log.CurrentIndex(), log.CurrentTerm())
+	}
+}
+
 // Ensure that we can decode and encode to an existing log.
 func TestLogExistingLog(t *testing.T) {
 	log, path := setupLog(`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n" +
@@ -93,6 +120,31 @@ func TestLogExistingLog(t *testing.T) {
 	}
 }
 
+// Ensure that entry types are decoded and that entries written without a type are typed by their command.
+func TestLogEntryTypes(t *testing.T) {
+	log, path := setupLog(`93fbf55f 0000000000000001 0000000000000001 config raft:join {"Name":"2"}` + "\n" +
+		`74f7e275 0000000000000002 0000000000000001 noop raft:nop {}` + "\n" +
+		`30d99c05 0000000000000003 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n")
+	defer log.Close()
+	defer os.Remove(path)
+
+	if len(log.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(log.entries))
+	}
+	if !reflect.DeepEqual(log.entries[0], NewLogEntryWithType(log, 1, 1, EntryConfiguration, &JoinCommand{Name: "2"})) {
+		t.Fatalf("Unexpected entry[0]: %v", log.entries[0])
+	}
+	if !reflect.DeepEqual(log.entries[1], NewLogEntryWithType(log, 2, 1, EntryNoop, &NoopCommand{})) {
+		t.Fatalf("Unexpected entry[1]: %v", log.entries[1])
+	}
+	if !reflect.DeepEqual(log.entries[2], NewLogEntry(log, 3, 1, &TestCommand1{"foo", 20})) {
+		t.Fatalf("Unexpected entry[2]: %v", log.entries[2])
+	}
+	if entry := log.CreateEntry(1, &JoinCommand{Name: "3"}); entry.Type() != EntryConfiguration {
+		t.Fatalf("Unexpected entry type: %v", entry.Type())
+	}
+}
+
 // Ensure that we can check the contents of the log by index/term.
 func TestLogContainsEntries(t *testing.T) {
 	log, path := setupLog(`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n" +
@@ -167,7 +219,7 @@ func TestLogRecovery(t *testing.T) {
 	}
 	expected = `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n" +
 		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}` + "\n" +
-		`3f3f884c 0000000000000003 0000000000000002 cmd_1 {"val":"bat","i":-5}` + "\n"
+		`672976b8 0000000000000003 0000000000000002 command cmd_1 {"val":"bat","i":-5}` + "\n"
 	actual, _ = ioutil.ReadFile(path)
 	if string(actual) != expected {
 		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
@@ -175,6 +227,49 @@ func TestLogRecovery(t *testing.T) {
 	warn("--- END RECOVERY TEST\n")
 }
 
+// Ensure that an entry's checksum is derived from its content and matches the
+// identifier written to the log.
+func TestLogEntryChecksum(t *testing.T) {
+	entry := NewLogEntry(nil, 3, 2, &TestCommand1{"bat", -5})
+	if checksum := entry.Checksum(); checksum != 0x672976b8 {
+		t.Fatalf("Unexpected checksum: %08x", checksum)
+	}
+	if checksum := NewLogEntry(nil, 3, 2, &TestCommand1{"bat", -5}).Checksum(); checksum != entry.Checksum() {
+		t.Fatalf("Checksum should be deterministic: %08x != %08x", checksum, entry.Checksum())
+	}
+	for _, other := range []*LogEntry{
+		NewLogEntry(nil, 4, 2, &TestCommand1{"bat", -5}),
+		NewLogEntry(nil, 3, 3, &TestCommand1{"bat", -5}),
+		NewLogEntry(nil, 3, 2, &TestCommand1{"bat", -6}),
+	} {
+		if other.Checksum() == entry.Checksum() {
+			t.Fatalf("Checksum should change with the entry: %v", other)
+		}
+	}
+}
+
+// Ensure that an entry that was modified after it was written fails
+// verification when the log is opened and the log is left untouched.
+func TestLogTamperedEntry(t *testing.T) {
+	contents := `94ed6591 0000000000000001 0000000000000001 command cmd_1 {"val":"foo","i":20}` + "\n" +
+		`a766f5ac 0000000000000002 0000000000000001 command cmd_2 {"x":101}` + "\n" +
+		`672976b8 0000000000000003 0000000000000002 command cmd_1 {"val":"bat","i":-5}` + "\n"
+	path := setupLogFile(contents)
+	defer os.Remove(path)
+	log := NewLog()
+	log.ApplyFunc = func(c Command) {}
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err == nil || !strings.HasPrefix(err.Error(), "raft.Log: Corrupt entry at offset 78:") {
+		t.Fatalf("Tampered entry should have failed to open: %v", err)
+	}
+	log.Close()
+	actual, _ := ioutil.ReadFile(path)
+	if string(actual) != contents {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", contents, string(actual))
+	}
+}
+
 //--------------------------------------
 // Append
 //--------------------------------------
@@ -226,3 +321,54 @@ func TestLogTruncate(t *testing.T) {
 	}
 
 }
+
+//--------------------------------------
+// Compaction
+//--------------------------------------
+
+// Ensure that committed entries can be removed from the front of the log.
+func TestLogCompact(t *testing.T) {
+	log, path := setupLog(`94ed6591 0000000000000001 0000000000000001 command cmd_1 {"val":"foo","i":20}` + "\n" +
+		`a766f5ac 0000000000000002 0000000000000001 command cmd_2 {"x":100}` + "\n" +
+		`14776541 0000000000000003 0000000000000002 command cmd_1 {"val":"bar","i":0}` + "\n")
+	defer os.Remove(path)
+	if err := log.AppendEntry(NewLogEntry(log, 4, 2, &TestCommand2{200})); err != nil {
+		t.Fatalf("Unable to append: %v", err)
+	}
+
+	// Uncommitted entries cannot be compacted.
+	if err := log.Compact(4, &CompactCommand{}); err == nil || err.Error() != "raft.Log: Cannot compact uncommitted entries (3): (IDX=4)" {
+		t.Fatalf("Compacting uncommitted entries shouldn't work: %v", err)
+	}
+	if err := log.Compact(2, &CompactCommand{Peers: []string{"1"}}); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if log.StartIndex() != 2 || log.CurrentIndex() != 4 || len(log.entries) != 2 || !log.ContainsEntry(2, 1) || log.ContainsEntry(1, 1) {
+		t.Fatalf("Unexpected log after compaction: %v/%v/%v", log.StartIndex(), log.CurrentIndex(), len(log.entries))
+	}
+	if _, err := log.GetEntriesBetween(2, 3); err == nil || err.Error() != "raft.Log: Entry range has been compacted (MIN=3): (START=2, END=3)" {
+		t.Fatalf("Compacted entries shouldn't be retrievable: %v", err)
+	}
+
+	// Committing after compaction appends to the rewritten file.
+	if err := log.SetCommitIndex(4); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	expected := `fc507584 0000000000000002 0000000000000001 config raft:compact {"peers":["1"]}` + "\n" +
+		`14776541 0000000000000003 0000000000000002 command cmd_1 {"val":"bar","i":0}` + "\n" +
+		`5b8852df 0000000000000004 0000000000000002 command cmd_2 {"x":200}` + "\n"
+	actual, _ := ioutil.ReadFile(path)
+	if string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
+	}
+
+	// Reopening the log restores the start of the log.
+	log.Close()
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	if index, term := log.CommitInfo(); log.StartIndex() != 2 || len(log.entries) != 2 || index != 4 || term != 2 {
+		t.Fatalf("Unexpected log after reopening: %v/%v [IDX=%v, TERM=%v]", log.StartIndex(), len(log.entries), index, term)
+	}
+}
@@ -0,0 +1,30 @@
+package raft
+
+import (
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The names of the timings reported to a metrics sink. The replication round
+// trip time is reported per peer with the peer name appended.
+const (
+	MetricCommitLatency  = "raft.commitLatency"
+	MetricReplicationRTT = "raft.replicationRTT."
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A metrics sink receives timing observations from a server so that they can
+// be aggregated into histograms or summaries.
+type MetricsSink interface {
+	ObserveDuration(name string, d time.Duration)
+}
@@ -0,0 +1,43 @@
+package raft
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// The no-op command is stored in no-op entries which are committed but not
+// applied to the state machine.
+type NoopCommand struct {
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// This function marks the command as internal.
+func (c *NoopCommand) InternalCommand() bool {
+	return true
+}
+
+// The name of the command in the log.
+func (c *NoopCommand) CommandName() string {
+	return "raft:nop"
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Validates that the command can be executed on the current state machine.
+func (c *NoopCommand) Validate(server *Server) error {
+	return nil
+}
+
+// A no-op does not change the state machine.
+func (c *NoopCommand) Apply(server *Server) {
+}
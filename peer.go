@@ -2,10 +2,33 @@ package raft
 
 import (
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The number of election timeouts that a peer may go without answering any
+// AppendEntries RPC before it is flagged as unreachable.
+const UnreachableElectionTimeouts = 3
+
+// An error returned by an internal flush once the server that started it no
+// longer holds its lock on behalf of the flush.
+var errFlushReleased = errors.New("raft.Peer: Flush released")
+
+// The events reported to a server's reachability function when a peer
+// becomes unreachable or answers again.
+const (
+	PeerReachable   = "peerReachable"
+	PeerUnreachable = "peerUnreachable"
+)
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -14,11 +37,36 @@ import (
 
 // A peer is a reference to another server involved in the consensus protocol.
 type Peer struct {
-	server         *Server
-	name           string
-	prevLogIndex   uint64
-	mutex          sync.Mutex
-	heartbeatTimer *Timer
+	server          *Server
+	name            string
+	prevLogIndex    uint64
+	matchIndex      uint64
+	appliedIndex    uint64
+	protocolVersion int
+	mutex           sync.Mutex
+	heartbeatTimer  *Timer
+	lastFlush       time.Time
+	paused          bool
+	priority        int
+	weight          int
+	lastAttempt     time.Time
+	lastAck         time.Time
+	unackedSince    time.Time
+	unreachable     bool
+	observer        bool
+	stopped         chan bool
+}
+
+// The replication state of a peer as seen by the leader. LastAttempt is the
+// time of the last AppendEntries RPC sent to the peer and LastAck is the time
+// of the last response received from it, whether or not it succeeded.
+type PeerStatus struct {
+	Name         string    `json:"name"`
+	MatchIndex   uint64    `json:"matchIndex"`
+	AppliedIndex uint64    `json:"appliedIndex"`
+	LastAttempt  time.Time `json:"lastAttempt"`
+	LastAck      time.Time `json:"lastAck"`
+	Reachable    bool      `json:"reachable"`
 }
 
 //------------------------------------------------------------------------------
@@ -30,9 +78,13 @@ type Peer struct {
 // Creates a new peer.
 func NewPeer(server *Server, name string, heartbeatTimeout time.Duration) *Peer {
 	p := &Peer{
-		server:         server,
-		name:           name,
-		heartbeatTimer: NewTimer(heartbeatTimeout, heartbeatTimeout),
+		server:          server,
+		name:            name,
+		protocolVersion: server.maxProtocolVersion,
+		heartbeatTimer:  NewTimer(heartbeatTimeout, heartbeatTimeout),
+		priority:        DefaultPriority,
+		weight:          DefaultWeight,
+		stopped:         make(chan bool),
 	}
 	
 	// Start the heartbeat timeout.
@@ -52,6 +104,68 @@ func (p *Peer) Name() string {
 	return p.name
 }
 
+// Retrieves the election priority of the peer as recorded when it joined.
+func (p *Peer) Priority() int {
+	return p.priority
+}
+
+// Retrieves the voting weight of the peer as recorded when it joined.
+func (p *Peer) Weight() int {
+	return p.weight
+}
+
+// Retrieves the index of the last entry the peer has acknowledged.
+func (p *Peer) PrevLogIndex() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.prevLogIndex
+}
+
+// Retrieves the index of the last entry the peer is known to have stored.
+func (p *Peer) MatchIndex() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.matchIndex
+}
+
+// Retrieves the index of the last entry the peer reported having applied.
+func (p *Peer) AppliedIndex() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.appliedIndex
+}
+
+// Retrieves the replication state of the peer. A peer is unreachable if it
+// has not answered any request for UnreachableElectionTimeouts election
+// timeouts while requests were being sent to it. This detects a peer that can
+// receive requests but whose responses are lost as well as one that cannot be
+// reached at all.
+func (p *Peer) Status() PeerStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return PeerStatus{
+		Name:         p.name,
+		MatchIndex:   p.matchIndex,
+		AppliedIndex: p.appliedIndex,
+		LastAttempt:  p.lastAttempt,
+		LastAck:      p.lastAck,
+		Reachable:    p.reachable(),
+	}
+}
+
+// Checks whether the peer has answered recently without a lock.
+func (p *Peer) reachable() bool {
+	return p.unackedSince.IsZero() || time.Since(p.unackedSince) < UnreachableElectionTimeouts*p.server.ElectionTimeout()
+}
+
+// Clears the match index when the server becomes leader since entries stored
+// under an earlier leader may have been overwritten.
+func (p *Peer) resetMatchIndex() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.matchIndex = 0
+}
+
 // Retrieves the heartbeat timeout.
 func (p *Peer) HeartbeatTimeout() time.Duration {
 	return p.heartbeatTimer.MinDuration()
@@ -62,6 +176,32 @@ func (p *Peer) SetHeartbeatTimeout(duration time.Duration) {
 	p.heartbeatTimer.SetDuration(duration)
 }
 
+// Retrieves the protocol version used when sending requests to the peer.
+func (p *Peer) ProtocolVersion() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.protocolVersion
+}
+
+// Downgrades the protocol version used with the peer if the peer reports that
+// it only supports an older version.
+func (p *Peer) setProtocolVersion(version int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.negotiateProtocolVersion(version)
+}
+
+// Negotiates the protocol version without a lock.
+func (p *Peer) negotiateProtocolVersion(version int) {
+	if version == 0 {
+		version = MinProtocolVersion
+	}
+	if version > p.server.maxProtocolVersion {
+		version = p.server.maxProtocolVersion
+	}
+	p.protocolVersion = version
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -72,24 +212,28 @@ func (p *Peer) SetHeartbeatTimeout(duration time.Duration) {
 // State
 //--------------------------------------
 
-// Resumes the peer heartbeating.
+// Resumes the peer heartbeating. The peer lock is not obtained since the
+// timer is safe for concurrent use and a flush holds the lock while waiting on
+// the remote server.
 func (p *Peer) resume() {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
 	p.heartbeatTimer.Reset()
 }
 
 // Pauses the peer to prevent heartbeating.
 func (p *Peer) pause() {
+	p.heartbeatTimer.Pause()
+}
+
+// Sets whether AppendEntries RPCs to the peer are withheld. The peer remains
+// a member while paused.
+func (p *Peer) setReplicationPaused(paused bool) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	p.heartbeatTimer.Pause()
+	p.paused = paused
 }
 
 // Stops the peer entirely.
 func (p *Peer) stop() {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
 	p.heartbeatTimer.Stop()
 }
 
@@ -102,18 +246,37 @@ func (p *Peer) stop() {
 // returns the current term from the peer, whether the flush was successful
 // and any associated error message.
 func (p *Peer) flush() (uint64, bool, error) {
+	// The request is generated before obtaining the peer lock since the
+	// server may be holding its own lock while waiting on this peer.
 	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	req, handler := p.server.createAppendEntriesRequest(p.prevLogIndex)
-	return p.sendFlushRequest(req, handler)
+	prevLogIndex := p.prevLogIndex
+	p.mutex.Unlock()
+	req, handler := p.server.createAppendEntriesRequest(prevLogIndex)
+
+	p.mutex.Lock()
+	term, success, err := p.sendFlushRequest(req, handler)
+	p.mutex.Unlock()
+
+	// The peer may now complete a quorum for uncommitted entries.
+	if success && !p.observer {
+		p.server.mutex.Lock()
+		p.server.advanceCommitIndex()
+		p.server.mutex.Unlock()
+	}
+	return term, success, err
 }
 
 // Sends an AppendEntries RPC but does not obtain a lock on the server. This
-// method should only be called from the server.
-func (p *Peer) internalFlush() (uint64, bool, error) {
+// method should only be called from the server. The request is generated by
+// the create function which returns false once the server lock is no longer
+// held on behalf of the flush, in which case errFlushReleased is returned.
+func (p *Peer) internalFlush(create func(prevLogIndex uint64) (*AppendEntriesRequest, func(*Server, *Peer, *AppendEntriesRequest) (*AppendEntriesResponse, error), bool)) (uint64, bool, error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	req, handler := p.server.createInternalAppendEntriesRequest(p.prevLogIndex)
+	req, handler, ok := create(p.prevLogIndex)
+	if !ok {
+		return 0, false, errFlushReleased
+	}
 	return p.sendFlushRequest(req, handler)
 }
 
@@ -124,37 +287,135 @@ func (p *Peer) sendFlushRequest(req *AppendEntriesRequest, handler func(*Server,
 		return 0, false, errors.New("raft.Peer: Request or handler required")
 	}
 
+	// Do not send anything while replication to the peer is paused.
+	if p.paused {
+		return 0, false, errors.New("raft.Peer: Replication paused")
+	}
+
+	// Refuse to talk to a peer that only understands an unsupported protocol.
+	if p.protocolVersion < p.server.minProtocolVersion {
+		return 0, false, fmt.Errorf("raft.Peer: Incompatible protocol version: %v", p.protocolVersion)
+	}
+	req.ProtocolVersion = p.protocolVersion
+	req.TraceID = p.server.newTraceID()
+
+	// Withhold the entries that do not fit in the replication bandwidth. The
+	// request is still sent so that it serves as a heartbeat.
+	limited := false
+	if len(req.Entries) > 0 && p.server.replicationLimit.Rate() > 0 {
+		sizes := make([]int, len(req.Entries))
+		for i, entry := range req.Entries {
+			size, err := entry.encodedSize()
+			if err != nil {
+				return 0, false, fmt.Errorf("raft.Peer: Unable to encode entry: %v", err)
+			}
+			sizes[i] = size
+		}
+		if n := p.server.replicationLimit.take(sizes); n < len(req.Entries) {
+			trimmed := *req
+			trimmed.Entries = req.Entries[:n]
+			req, limited = &trimmed, n == 0
+		}
+	}
+
+	// Compress large batches of entries for peers that understand it. The
+	// uncompressed request is kept to track the entries that were sent.
+	wireReq := req
+	if p.protocolVersion >= CompressionProtocolVersion {
+		var err error
+		if wireReq, err = req.compress(int(atomic.LoadInt32(&p.server.compressionThreshold))); err != nil {
+			return 0, false, fmt.Errorf("raft.Peer: Unable to compress entries: %v", err)
+		}
+	}
+
 	// Generate an AppendEntries request based on the state of the server and
 	// log. Send the request through the user-provided handler and process the
 	// result.
-	resp, err := handler(p.server, p, req)
+	p.server.trace(TraceEvent{ID: req.TraceID, Kind: TraceSend, RPC: TraceAppendEntries, Peer: p.name, Index: req.PrevLogIndex, Count: len(req.Entries)})
+	sent := time.Now()
+	p.lastAttempt = sent
+	if p.unackedSince.IsZero() {
+		p.unackedSince = sent
+	}
+	resp, err := p.sendWithTimeout(wireReq, handler)
 	p.heartbeatTimer.Reset()
 	if resp == nil {
+		if !p.unreachable && !p.reachable() {
+			p.unreachable = true
+			warn("raft.Peer: Peer has not responded for %v: %s", time.Since(p.unackedSince), p.name)
+			p.server.reportReachability(p.name, PeerUnreachable)
+		}
 		return 0, false, err
 	}
+	if p.unreachable {
+		p.server.reportReachability(p.name, PeerReachable)
+	}
+	p.lastAck, p.unackedSince, p.unreachable = time.Now(), time.Time{}, false
+	p.negotiateProtocolVersion(resp.ProtocolVersion)
+	if resp.AppliedIndex > p.appliedIndex {
+		p.appliedIndex = resp.AppliedIndex
+	}
 
 	// If successful then update the previous log index. If it was
 	// unsuccessful then decrement the previous log index and we'll try again
-	// next time.
+	// next time. Responses to requests that were generated from an older
+	// previous log index are ignored so that the index never moves backwards.
 	if resp.Success {
+		p.lastFlush = sent
+		p.server.observeDuration(MetricReplicationRTT+p.name, time.Since(sent))
+		if index := req.PrevLogIndex + uint64(len(req.Entries)); index > p.matchIndex {
+			p.matchIndex = index
+		}
 		if len(req.Entries) > 0 {
-			p.prevLogIndex = req.Entries[len(req.Entries)-1].index
+			if index := req.Entries[len(req.Entries)-1].index; index > p.prevLogIndex {
+				p.prevLogIndex = index
+			}
 		}
 	} else {
-		if p.prevLogIndex > 0 {
+		if p.prevLogIndex > 0 && p.prevLogIndex == req.PrevLogIndex {
 			p.prevLogIndex--
 		}
 	}
 
+	// A request that carried none of its entries made no progress so the
+	// caller should wait for bandwidth before flushing again.
+	if limited && err == nil {
+		err = errors.New("raft.Peer: Replication rate limited")
+	}
 	return resp.Term, resp.Success, err
 }
 
+// Sends a request through a handler and waits up to the server's RPC timeout
+// for the response. A hung peer then fails like any other unreachable peer
+// and is retried after the next heartbeat timeout. The response to a request
+// that timed out is discarded when it arrives.
+func (p *Peer) sendWithTimeout(req *AppendEntriesRequest, handler func(*Server, *Peer, *AppendEntriesRequest) (*AppendEntriesResponse, error)) (*AppendEntriesResponse, error) {
+	type result struct {
+		resp *AppendEntriesResponse
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		resp, err := handler(p.server, p, req)
+		c <- result{resp, err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.resp, r.err
+	case <-time.After(p.server.RPCTimeout()):
+		return nil, fmt.Errorf("raft.Peer: RPC timed out: %v", p.name)
+	}
+}
+
 //--------------------------------------
 // Heartbeat
 //--------------------------------------
 
-// Listens to the heartbeat timeout and flushes an AppendEntries RPC.
+// Listens to the heartbeat timeout and flushes an AppendEntries RPC. The
+// stopped channel is closed once the function exits.
 func (p *Peer) heartbeatTimeoutFunc() {
+	defer close(p.stopped)
 	for {
 		// Grab the current timer channel.
 		p.mutex.Lock()
@@ -172,9 +433,50 @@ func (p *Peer) heartbeatTimeoutFunc() {
 		// Flush the peer when we get a heartbeat timeout. If the channel is
 		// closed then the peer is getting cleaned up and we should exit.
 		if _, ok := <- c; ok {
-			p.flush()
+			// Observers are only streamed to by a leader while attached
+			// and never affect its leadership.
+			if p.observer {
+				p.server.mutex.Lock()
+				leader := p.server.state == Leader
+				attached := p.server.observers[p.name] == p
+				p.server.mutex.Unlock()
+				if !attached {
+					return
+				} else if leader {
+					p.flush()
+				}
+				continue
+			}
+			// An idle leader skips the heartbeat but restarts the timer so
+			// that one is sent once the slow interval has passed.
+			if p.quiescent() {
+				p.resume()
+			} else if !p.recentlyFlushed() {
+				p.flush()
+			}
+			p.server.stepDownWithoutQuorum()
+			p.server.evictUnreachable(p)
 		} else {
 			break
 		}
 	}
 }
+
+// Checks if the leader is idle and sent the peer an AppendEntries RPC within
+// the slow heartbeat interval.
+func (p *Peer) quiescent() bool {
+	interval := p.server.idleHeartbeatInterval()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return interval > 0 && time.Since(p.lastAttempt) < interval
+}
+
+// Checks if the peer successfully received an AppendEntries RPC within the
+// heartbeat timeout. Any AppendEntries RPC resets the peer's election timer
+// and restarts the heartbeat timer so a timeout that fired while entries were
+// being replicated does not need to send another heartbeat.
+func (p *Peer) recentlyFlushed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return time.Since(p.lastFlush) < p.HeartbeatTimeout()
+}
@@ -1,5 +1,9 @@
 package raft
 
+import (
+	"time"
+)
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -7,19 +11,48 @@ package raft
 //------------------------------------------------------------------------------
 
 // The request sent to a server to vote for a candidate to become a leader.
+// A pre-vote only asks whether the vote would be granted. The server answers
+// it without changing its term or vote. The trace ID is only set when the
+// sender has a tracer.
 type RequestVoteRequest struct {
-	peer          *Peer
-	Term          uint64 `json:"term"`
-	CandidateName string `json:"candidateName"`
-	LastLogIndex  uint64 `json:"lastLogIndex"`
-	LastLogTerm   uint64 `json:"lastLogTerm"`
+	peer            *Peer
+	ProtocolVersion int    `json:"protocolVersion,omitempty"`
+	Term            uint64 `json:"term"`
+	CandidateName   string `json:"candidateName"`
+	LastLogIndex    uint64 `json:"lastLogIndex"`
+	LastLogTerm     uint64 `json:"lastLogTerm"`
+	PreVote         bool   `json:"preVote,omitempty"`
+	TraceID         string `json:"traceId,omitempty"`
 }
 
 // The response returned from a server after a vote for a candidate to become a leader.
+// The protocol version is the highest version supported by the responding server.
 type RequestVoteResponse struct {
-	peer        *Peer
-	Term        uint64 `json:"term"`
-	VoteGranted bool   `json:"voteGranted"`
+	peer            *Peer
+	ProtocolVersion int    `json:"protocolVersion,omitempty"`
+	Term            uint64 `json:"term"`
+	VoteGranted     bool   `json:"voteGranted"`
+}
+
+// The outcome of a vote requested from a peer during an election. The error
+// explains why the vote was denied or could not be requested.
+type VoteResult struct {
+	Peer    string
+	Granted bool
+	Term    uint64
+	Err     error
+}
+
+// A single round of an election run by this server. The votes include the
+// candidate's own vote and votes that were denied or could not be requested
+// are counted against. Votes that arrived after the round ended are not
+// counted.
+type ElectionRecord struct {
+	Term         uint64        `json:"term"`
+	Elected      bool          `json:"elected"`
+	Duration     time.Duration `json:"duration"`
+	VotesFor     int           `json:"votesFor"`
+	VotesAgainst int           `json:"votesAgainst"`
 }
 
 //------------------------------------------------------------------------------
@@ -31,17 +64,19 @@ type RequestVoteResponse struct {
 // Creates a new RequestVote request.
 func NewRequestVoteRequest(term uint64, candidateName string, lastLogIndex uint64, lastLogTerm uint64) *RequestVoteRequest {
 	return &RequestVoteRequest{
-		Term:          term,
-		CandidateName: candidateName,
-		LastLogIndex:  lastLogIndex,
-		LastLogTerm:   lastLogTerm,
+		ProtocolVersion: MaxProtocolVersion,
+		Term:            term,
+		CandidateName:   candidateName,
+		LastLogIndex:    lastLogIndex,
+		LastLogTerm:     lastLogTerm,
 	}
 }
 
 // Creates a new RequestVote response.
 func NewRequestVoteResponse(term uint64, voteGranted bool) *RequestVoteResponse {
 	return &RequestVoteResponse{
-		Term:        term,
-		VoteGranted: voteGranted,
+		ProtocolVersion: MaxProtocolVersion,
+		Term:            term,
+		VoteGranted:     voteGranted,
 	}
 }
@@ -1,9 +1,18 @@
 package raft
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +27,7 @@ const (
 	Follower  = "follower"
 	Candidate = "candidate"
 	Leader    = "leader"
+	Removed   = "removed"
 )
 
 const (
@@ -25,6 +35,81 @@ const (
 	DefaultElectionTimeout  = 150 * time.Millisecond
 )
 
+// The range of RPC protocol versions understood by this implementation. A
+// request without a version is treated as the minimum version since it was
+// sent by a server that predates version negotiation. Version 2 allows the
+// entries of an AppendEntries request to be compressed. Version 3 allows
+// pre-vote RequestVote requests.
+const (
+	MinProtocolVersion         = 1
+	MaxProtocolVersion         = 3
+	CompressionProtocolVersion = 2
+	PreVoteProtocolVersion     = 3
+)
+
+// The number of election rounds kept in the election history.
+const ElectionHistorySize = 16
+
+// The period over which election rounds are counted for the election rate
+// limit.
+const ElectionRateWindow = time.Minute
+
+// The fraction of the election timeout that a leader lease must stay below to
+// tolerate clocks on different servers advancing at different rates.
+const LeaderLeaseClockDrift = 0.1
+
+// The number of apply results retained for ApplyStatus before the oldest
+// results are evicted.
+const DefaultApplyResultCacheSize = 1024
+
+// The election priority of a server that has not set one. A server with a
+// priority of zero never starts an election on its own.
+const DefaultPriority = 1
+
+// The voting weight of a server that has not set one. Elections and commits
+// require servers carrying more than half of the total weight.
+const DefaultWeight = 1
+
+// The default number of members below which a leader never automatically
+// evicts an unreachable peer.
+const DefaultAutoEvictMinSize = 3
+
+// Errors returned when changing the membership of the cluster.
+var (
+	ErrPeerExists  = errors.New("raft.Server: Peer already exists")
+	ErrUnknownPeer = errors.New("raft.Server: Unknown peer")
+)
+
+// An error returned when a command is executed on a server that has not
+// joined itself or another server and so has no cluster to replicate to.
+var ErrNotBootstrapped = errors.New("raft.Server: Not bootstrapped")
+
+// An error returned when another server uses this server's name. Servers are
+// identified by name alone so two servers sharing a name would corrupt votes
+// and membership.
+var ErrDuplicateName = errors.New("raft.Server: Duplicate server name")
+
+// An error returned when a command is submitted while the maximum number of
+// commands are already waiting to be committed.
+var ErrTooManyPending = errors.New("raft.Server: Too many pending commands")
+
+// An error returned when the leader steps down before a command it appended
+// was committed. The command may still be committed by the next leader.
+var ErrLeadershipLost = errors.New("raft.Server: Leadership lost before command was committed")
+
+// An error returned when a quorum does not store a command within the command
+// timeout. Replication continues so the command may still be committed.
+var ErrCommandTimeout = errors.New("raft.Server: Command timed out before it was committed")
+
+// An error returned when a command is submitted while the uncompacted log
+// holds the maximum number of entries.
+var ErrLogFull = errors.New("raft.Server: Log full")
+
+// An error returned when a command is submitted to a leader that has not
+// heard from a quorum within the election timeout. The command is not
+// appended to the log.
+var ErrNoQuorum = errors.New("raft.Server: No quorum reachable")
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -35,6 +120,7 @@ const (
 // candidate or a leader.
 type Server struct {
 	ApplyFunc            func(*Server, Command)
+	ApplyResultFunc      func(*Server, Command) interface{}
 	DoHandler            func(*Server, *Peer, Command) error
 	RequestVoteHandler   func(*Server, *Peer, *RequestVoteRequest) (*RequestVoteResponse, error)
 	AppendEntriesHandler func(*Server, *Peer, *AppendEntriesRequest) (*AppendEntriesResponse, error)
@@ -44,13 +130,102 @@ type Server struct {
 	currentTerm          uint64
 	votedFor             string
 	log                  *Log
-	leader               *Peer
+	commitChannel        chan *LogEntry
+	leader               string
 	peers                map[string]*Peer
+	observers            map[string]*Peer
 	mutex                sync.Mutex
 	electionTimer        *Timer
 	heartbeatTimeout     time.Duration
+	quiescentIdleAfter   time.Duration
+	quiescentInterval    time.Duration
+	lastWrite            time.Time
+	minProtocolVersion   int
+	maxProtocolVersion   int
+	writeQuorum          int
+	readQuorum           int
+	leaderStickiness     bool
+	checkQuorum          bool
+	failWithoutQuorum    bool
+	autoEvictTimeout     time.Duration
+	autoEvictMinSize     int
+	evicting             bool
+	removed              bool
+	leaderSince          time.Time
+	priority             int
+	weight               int
+	lastContact          time.Time
+	leaderLease          time.Duration
+	leaseExpiration      time.Time
+	readRound            uint64
+	readConfirmedRound   uint64
+	readConfirmedTerm    uint64
+	lastApplied          uint64
+	applied              *sync.Cond
+	applyResults         map[uint64]interface{}
+	applyResultIndices   []uint64
+	applyResultCacheSize int
+	pendingCommands      int32
+	maxPendingCommands   int32
+	rollbackFunc         func([]*LogEntry)
+	proposalFilter       func(Command) error
+	maxInflightEntries   int
+	maxEntriesPerRequest int
+	compressionThreshold int32
+	replicationLimit     tokenBucket
+	maxLogEntries        int
+	blockOnFullLog       bool
+	rpcTimeout           int64
+	commandTimeout       int64
+	electionBackoff      time.Duration
+	electionRateLimit    int
+	electionTimes        []time.Time
+	applyBatchFunc       func([]*LogEntry) []interface{}
+	asyncApply           bool
+	persistApplied       bool
+	applyQueue           []*LogEntry
+	applyReady           *sync.Cond
+	applyWorker          bool
+	applyStopped         bool
+	metrics              MetricsSink
+	tracer               func(TraceEvent)
+	reachabilityFunc     func(string, string)
+	traceSequence        uint64
+	lastElection         []VoteResult
+	electionHistory      []ElectionRecord
+	startedAt            time.Time
+}
+
+// An error returned when a command is sent to a server that is not the leader.
+type NotLeaderError struct {
+	State string
+}
+
+// A consistent view of a server's state for monitoring. LastContact is the
+// time of the last AppendEntries RPC accepted from a leader and Uptime is the
+// time since the server was started.
+type ServerStats struct {
+	Name        string        `json:"name"`
+	State       string        `json:"state"`
+	Term        uint64        `json:"term"`
+	Leader      string        `json:"leader"`
+	CommitIndex uint64        `json:"commitIndex"`
+	LastApplied uint64        `json:"lastApplied"`
+	LastContact time.Time     `json:"lastContact"`
+	Uptime      time.Duration `json:"uptime"`
+}
+
+// A member recorded in a serialized configuration. A configuration without
+// weights gives each member the default weight.
+type configurationMember struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight,omitempty"`
 }
 
+// A sortable list of log indices.
+type uint64Slice []uint64
+
 //------------------------------------------------------------------------------
 //
 // Constructor
@@ -63,26 +238,72 @@ func NewServer(name string, path string) (*Server, error) {
 		return nil, errors.New("raft.Server: Name cannot be blank")
 	}
 	s := &Server{
-		name:          name,
-		path:          path,
-		state:         Stopped,
-		peers:         make(map[string]*Peer),
-		log:           NewLog(),
-		electionTimer: NewTimer(DefaultElectionTimeout, DefaultElectionTimeout*2),
-		heartbeatTimeout: DefaultHeartbeatTimeout,
+		name:                 name,
+		path:                 path,
+		state:                Stopped,
+		peers:                make(map[string]*Peer),
+		observers:            make(map[string]*Peer),
+		autoEvictMinSize:     DefaultAutoEvictMinSize,
+		log:                  NewLog(),
+		electionTimer:        NewTimer(DefaultElectionTimeout, DefaultElectionTimeout*2),
+		heartbeatTimeout:     DefaultHeartbeatTimeout,
+		minProtocolVersion:   MinProtocolVersion,
+		maxProtocolVersion:   MaxProtocolVersion,
+		applyResults:         make(map[uint64]interface{}),
+		applyResultCacheSize: DefaultApplyResultCacheSize,
+		priority:             DefaultPriority,
+		weight:               DefaultWeight,
 	}
+	s.applied = sync.NewCond(&s.mutex)
+	s.applyReady = sync.NewCond(&s.mutex)
 
 	// Setup apply function.
-	s.log.ApplyFunc = func(c Command) {
-		// Apply Raft commands internally. External commands get delegated.
-		if _, ok := c.(InternalCommand); ok {
-			c.Apply(s)
+	s.log.applyEntryFunc = func(e *LogEntry) {
+		// Configuration changes and other Raft commands are applied
+		// internally. External commands get delegated. When applying
+		// asynchronously or through the commit channel every entry is
+		// queued so that the last applied index advances in order.
+		external := false
+		if e.entryType == EntryNoop {
+			// No-ops are committed but never applied.
+		} else if _, ok := e.command.(InternalCommand); ok || e.entryType == EntryConfiguration {
+			e.command.Apply(s)
 		} else {
-			if s.ApplyFunc == nil {
-				panic("raft.Server: Apply function not set")
-			}
-			s.ApplyFunc(s, c)
+			external = true
 		}
+		if s.applyWorker {
+			s.applyQueue = append(s.applyQueue, e)
+			s.applyReady.Broadcast()
+			return
+		}
+		if external {
+			s.cacheApplyResult(e.index, s.applyCommand(e))
+		}
+		s.setLastApplied(e.index)
+	}
+
+	return s, nil
+}
+
+// Creates a new server from a configuration. An error is returned if the
+// configuration is invalid.
+func NewServerFromConfig(cfg *Config) (*Server, error) {
+	if cfg == nil {
+		return nil, errors.New("raft.Server: Config required")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	s, err := NewServer(cfg.Name, cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	s.SetElectionTimeout(cfg.electionTimeout())
+	s.SetHeartbeatTimeout(cfg.heartbeatTimeout())
+	s.ApplyFunc = cfg.ApplyFunc
+	if cfg.Transport != nil {
+		s.SetTransport(cfg.Transport)
 	}
 
 	return s, nil
@@ -116,232 +337,2524 @@ func (s *Server) LogPath() string {
 // Retrieves the current state of the server.
 func (s *Server) State() string {
 	s.mutex.Lock()
-	s.mutex.Unlock()
+	defer s.mutex.Unlock()
 	return s.state
 }
 
-// Retrieves the name of the candidate this server voted for in this term.
-func (s *Server) VotedFor() string {
+// Retrieves the name of the leader this server currently recognizes. This is
+// the server itself while it is the leader and the sender of the last accepted
+// AppendEntries RPC while it is a follower. An empty string is returned if the
+// leader is unknown.
+func (s *Server) Leader() string {
 	s.mutex.Lock()
-	s.mutex.Unlock()
-	return s.votedFor
+	defer s.mutex.Unlock()
+	return s.leaderName()
 }
 
-// Retrieves whether the server's log has no entries.
-func (s *Server) IsLogEmpty() bool {
-	return s.log.IsEmpty()
+// Retrieves the name of the recognized leader without locking the server.
+func (s *Server) leaderName() string {
+	switch s.state {
+	case Leader:
+		return s.name
+	case Follower:
+		return s.leader
+	}
+	return ""
 }
 
-//--------------------------------------
-// Membership
-//--------------------------------------
+// Retrieves the votes this server received as a candidate in its last
+// election. Votes that arrived after the election ended are not included.
+func (s *Server) LastElection() []VoteResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	results := make([]VoteResult, len(s.lastElection))
+	copy(results, s.lastElection)
+	return results
+}
 
-// Retrieves the number of member servers in the consensus.
-func (s *Server) MemberCount() int {
-	count := 1
-	for _, _ = range s.peers {
-		count++
+// Retrieves the elections this server ran as a candidate, oldest first. Each
+// round of an election is recorded when it ends and only the most recent
+// ElectionHistorySize rounds are kept.
+func (s *Server) ElectionHistory() []ElectionRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records := make([]ElectionRecord, len(s.electionHistory))
+	copy(records, s.electionHistory)
+	return records
+}
+
+// Adds an election round to the history and drops the oldest round once the
+// history is full.
+func (s *Server) recordElection(record ElectionRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.electionHistory) >= ElectionHistorySize {
+		copy(s.electionHistory, s.electionHistory[1:])
+		s.electionHistory = s.electionHistory[:len(s.electionHistory)-1]
 	}
-	return count
+	s.electionHistory = append(s.electionHistory, record)
 }
 
-// Retrieves the number of servers required to make a quorum.
-func (s *Server) QuorumSize() int {
-	return (s.MemberCount() / 2) + 1
+// Retrieves the number of election rounds this server started as a
+// candidate within the last ElectionRateWindow.
+func (s *Server) ElectionsPerMinute() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pruneElectionTimes()
+	return len(s.electionTimes)
 }
 
-//--------------------------------------
-// Election timeout
-//--------------------------------------
+// Retrieves the maximum number of election rounds started within the
+// ElectionRateWindow. Zero means there is no limit.
+func (s *Server) ElectionRateLimit() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.electionRateLimit
+}
 
-// Retrieves the election timeout.
-func (s *Server) ElectionTimeout() time.Duration {
-	return s.electionTimer.MinDuration()
+// Sets the maximum number of election rounds the server starts within the
+// ElectionRateWindow. A server that reaches the limit stays a follower and
+// relies on its peers to elect a leader until older rounds leave the window.
+// This is a last resort for a server whose elections repeatedly disrupt the
+// cluster. Zero removes the limit.
+func (s *Server) SetElectionRateLimit(n int) error {
+	if n < 0 {
+		return fmt.Errorf("raft.Server: Invalid election rate limit: %v", n)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.electionRateLimit = n
+	return nil
 }
 
-// Sets the election timeout.
-func (s *Server) SetElectionTimeout(duration time.Duration) {
-	s.electionTimer.SetMinDuration(duration)
-	s.electionTimer.SetMaxDuration(duration * 2)
+// Drops election rounds that started before the ElectionRateWindow. This
+// function does not obtain a lock so one must be obtained before executing.
+func (s *Server) pruneElectionTimes() {
+	cutoff := time.Now().Add(-ElectionRateWindow)
+	i := 0
+	for i < len(s.electionTimes) && s.electionTimes[i].Before(cutoff) {
+		i++
+	}
+	s.electionTimes = s.electionTimes[i:]
 }
 
-//--------------------------------------
-// Heartbeat timeout
-//--------------------------------------
+// Records the start of an election round. Returns false without recording
+// the round if the election rate limit has been reached. This function does
+// not obtain a lock so one must be obtained before executing.
+func (s *Server) allowElection() bool {
+	s.pruneElectionTimes()
+	if s.electionRateLimit > 0 && len(s.electionTimes) >= s.electionRateLimit {
+		return false
+	}
+	s.electionTimes = append(s.electionTimes, time.Now())
+	return true
+}
 
-// Retrieves the heartbeat timeout.
-func (s *Server) HeartbeatTimeout() time.Duration {
-	return s.heartbeatTimeout
+// Retrieves the state, term, leader and indices of the server in a single
+// consistent read.
+func (s *Server) Stats() ServerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := ServerStats{
+		Name:        s.name,
+		State:       s.state,
+		Term:        s.currentTerm,
+		Leader:      s.leaderName(),
+		LastApplied: s.lastApplied,
+		LastContact: s.lastContact,
+	}
+	if s.Running() {
+		stats.CommitIndex = s.log.CommitIndex()
+		stats.Uptime = time.Since(s.startedAt)
+	}
+	return stats
 }
 
-// Sets the heartbeat timeout.
-func (s *Server) SetHeartbeatTimeout(duration time.Duration) {
+// Retrieves the name of the candidate this server voted for in this term.
+func (s *Server) VotedFor() string {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	return s.votedFor
+}
 
-	s.heartbeatTimeout = duration
-	for _, peer := range s.peers {
-		peer.SetHeartbeatTimeout(duration)
+// Retrieves the index of the last committed entry in the server's log.
+func (s *Server) CommitIndex() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return 0
 	}
+	return s.log.CommitIndex()
 }
 
-//------------------------------------------------------------------------------
-//
-// Methods
-//
-//------------------------------------------------------------------------------
+// Retrieves the index of the first entry in the server's log. Entries removed
+// by compaction are skipped. Zero is returned if the log has no entries or the
+// server is stopped.
+func (s *Server) FirstIndex() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-//--------------------------------------
-// State
-//--------------------------------------
+	if !s.Running() {
+		return 0
+	}
+	return s.log.FirstIndex()
+}
 
-// Starts the server with a log at the given path.
-func (s *Server) Start() error {
+// Retrieves the index of the last entry in the server's log whether or not it
+// has been committed. Zero is returned if the server is stopped.
+func (s *Server) LastIndex() uint64 {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Exit if the server is already running.
-	if s.Running() {
-		return errors.New("raft.Server: Server already running")
+	if !s.Running() {
+		return 0
 	}
+	return s.log.CurrentIndex()
+}
 
-	// Initialize the log and load it up.
-	if err := s.log.Open(s.LogPath()); err != nil {
-		s.unload()
-		return fmt.Errorf("raft.Server: %v", err)
+// Retrieves whether the log contains an entry at the index with the given
+// term. The last compacted entry at the start of the log also matches so two
+// servers can be compared at any point either of them still knows about.
+// False is returned if the server is stopped.
+func (s *Server) HasEntry(index uint64, term uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return false
 	}
+	return s.log.ContainsEntry(index, term)
+}
 
-	// Update the state.
-	s.state = Follower
-	for _, peer := range s.peers {
-		peer.pause()
+// Retrieves whether the server's log has no entries.
+func (s *Server) IsLogEmpty() bool {
+	return s.log.IsEmpty()
+}
+
+// Retrieves a copy of the log entries between the start and end index,
+// inclusive. This is intended for inspecting and debugging the log.
+func (s *Server) LogEntries(start uint64, end uint64) ([]*LogEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return nil, errors.New("raft.Server: Log not available")
 	}
+	return s.log.GetEntriesBetween(start, end)
+}
 
-	// Start the election timeout.
-	go s.electionTimeoutFunc()
+// Retrieves a channel that receives each committed entry in index order as an
+// alternative to setting ApplyFunc. Internal commands such as joins are not
+// sent since they are applied by the server itself. Entries are sent by a
+// separate goroutine without holding any lock so the receiver may call the
+// server while reading. The channel is unbuffered and Do returns once its
+// entry is received. It must be drained until it is closed when the server
+// stops. This function will panic if ApplyFunc is set since each entry can
+// only be applied once.
+func (s *Server) CommitChannel() <-chan *LogEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	return nil
+	if s.ApplyFunc != nil || s.ApplyResultFunc != nil || s.applyBatchFunc != nil {
+		panic("raft.Server: Apply function and commit channel cannot both be used")
+	}
+	if s.commitChannel == nil {
+		s.commitChannel = make(chan *LogEntry)
+		if s.Running() && !s.applyWorker {
+			s.startApplyWorker()
+		}
+	}
+	return s.commitChannel
 }
 
-// Shuts down the server.
-func (s *Server) Stop() {
+// Sets a function that receives the entries committed together in a single
+// call as an alternative to ApplyFunc. It returns a result for each entry in
+// order that is retained as with ApplyResultFunc. Internal commands and no-ops
+// are applied individually between batches so that index order is preserved.
+// This function panics if another apply function or the commit channel is
+// used.
+func (s *Server) SetApplyBatchFunc(fn func(entries []*LogEntry) []interface{}) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.unload()
+
+	if fn == nil {
+		s.applyBatchFunc, s.log.ApplyBatchFunc = nil, nil
+		return
+	}
+	s.checkApplyBatchFunc()
+	s.applyBatchFunc = fn
+	s.log.ApplyBatchFunc = s.applyBatch
 }
 
-// Unloads the server.
-func (s *Server) unload() {
-	s.electionTimer.Stop()
-	
-	if s.log != nil {
-		s.log.Close()
-		s.log = nil
+// Panics if the apply batch function is combined with another way of
+// applying entries.
+func (s *Server) checkApplyBatchFunc() {
+	if s.ApplyFunc != nil || s.ApplyResultFunc != nil || s.commitChannel != nil {
+		panic("raft.Server: Apply batch function cannot be combined with another apply function or commit channel")
+	} else if s.asyncApply {
+		panic("raft.Server: Apply batch function cannot be combined with asynchronous apply")
 	}
+}
 
-	s.state = Stopped
+// Sets whether committed entries are applied by a separate goroutine instead
+// of while they are committed. Commits then continue while a slow apply
+// function runs and the last applied index trails the commit index. Entries
+// are still applied one at a time in index order and Do returns once its
+// entry is applied. Reads wait until the committed entries are applied but
+// entries committed later may be applied while a read executes. The mode can
+// only be changed while the server is stopped and cannot be combined with an
+// apply batch function.
+func (s *Server) SetAsyncApply(enabled bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Running() {
+		return errors.New("raft.Server: Cannot change apply mode while running")
+	} else if enabled && s.applyBatchFunc != nil {
+		return errors.New("raft.Server: Asynchronous apply cannot be combined with an apply batch function")
+	}
+	s.asyncApply = enabled
+	return nil
 }
 
-// Checks if the server is currently running.
-func (s *Server) Running() bool {
-	return s.state != Stopped
+// Applies an external command through the commit channel or the apply
+// function and returns its result.
+func (s *Server) applyCommand(e *LogEntry) interface{} {
+	if s.commitChannel != nil {
+		if s.ApplyFunc != nil || s.ApplyResultFunc != nil {
+			panic("raft.Server: Apply function and commit channel cannot both be used")
+		}
+		s.commitChannel <- e
+	} else if s.ApplyResultFunc != nil {
+		if s.ApplyFunc != nil {
+			panic("raft.Server: Apply function and apply result function cannot both be used")
+		}
+		return s.ApplyResultFunc(s, e.command)
+	} else {
+		if s.ApplyFunc == nil {
+			panic("raft.Server: Apply function not set")
+		}
+		s.ApplyFunc(s, e.command)
+	}
+	return nil
 }
 
-//--------------------------------------
-// Commands
-//--------------------------------------
+// Starts the goroutine that applies queued entries. This function does not
+// obtain a lock so one must be obtained before executing.
+func (s *Server) startApplyWorker() {
+	s.applyWorker = true
+	s.applyStopped = false
+	go s.applyLoop()
+}
 
-// Adds a command type to the log. The instance passed in will be copied and
-// deserialized each time a new log entry is read. This function will panic
-// if a command type with the same name already exists.
-func (s *Server) AddCommandType(command Command) {
-	s.log.AddCommandType(command)
+// Applies queued entries in order without holding the server lock while the
+// command is applied. The queue is drained before the loop exits when the
+// server stops.
+func (s *Server) applyLoop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		for len(s.applyQueue) == 0 && !s.applyStopped {
+			s.applyReady.Wait()
+		}
+		if len(s.applyQueue) == 0 {
+			s.applyWorker = false
+			s.applyReady.Broadcast()
+			return
+		}
+		e := s.applyQueue[0]
+		s.applyQueue = s.applyQueue[1:]
+
+		if e.entryType == EntryCommand {
+			if _, ok := e.command.(InternalCommand); !ok {
+				s.mutex.Unlock()
+				result := s.applyCommand(e)
+				s.mutex.Lock()
+				s.cacheApplyResult(e.index, result)
+			}
+		}
+		s.setLastApplied(e.index)
+	}
 }
 
-// Attempts to execute a command and replicate it. The function will return
-// when the command has been successfully committed or an error has occurred.
-func (s *Server) Do(command Command) error {
+// Applies committed entries through the apply batch function. Consecutive
+// external commands are passed in a single batch while other entries are
+// applied individually.
+func (s *Server) applyBatch(entries []*LogEntry) {
+	s.checkApplyBatchFunc()
+
+	var batch []*LogEntry
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		results := s.applyBatchFunc(batch)
+		if len(results) != len(batch) {
+			panic(fmt.Sprintf("raft.Server: Apply batch function returned %d results for %d entries", len(results), len(batch)))
+		}
+		for i, e := range batch {
+			s.cacheApplyResult(e.index, results[i])
+		}
+		s.setLastApplied(batch[len(batch)-1].index)
+		batch = nil
+	}
+
+	for _, e := range entries {
+		if _, ok := e.command.(InternalCommand); ok || e.entryType != EntryCommand {
+			flush()
+			s.log.applyEntryFunc(e)
+		} else {
+			batch = append(batch, e)
+		}
+	}
+	flush()
+}
+
+// Retrieves whether the entry at the given index has been applied and the
+// result returned by ApplyResultFunc when it was applied. Results are only
+// available when ApplyResultFunc or an apply batch function is used and a nil
+// result is not retained.
+// The most recent DefaultApplyResultCacheSize results are retained until
+// they are acknowledged with AcknowledgeApplyResult after which a nil result
+// is returned for the index.
+func (s *Server) ApplyStatus(index uint64) (bool, interface{}, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return s.do(command)
+
+	if !s.Running() {
+		return false, nil, errors.New("raft.Server: Log not available")
+	}
+	if index == 0 || index > s.lastApplied {
+		return false, nil, nil
+	}
+	return true, s.applyResults[index], nil
 }
 
-// This function is the low-level interface to execute commands. This function
-// does not obtain a lock so one must be obtained before executing.
-func (s *Server) do(command Command) error {
-	// Capture the term that this command is executing within.
-	currentTerm := s.currentTerm
+// Retrieves whether the last applied index is persisted.
+func (s *Server) PersistAppliedIndex() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.persistApplied
+}
 
-	// Add a new entry to the log.
-	entry := s.log.CreateEntry(s.currentTerm, command)
-	if err := s.log.AppendEntry(entry); err != nil {
+// Sets whether the index of the last applied entry is written to durable
+// storage after each entry is applied. On startup the committed entries after
+// the persisted index are then applied again instead of being assumed to have
+// been applied before the server stopped. An entry whose apply was recorded
+// is never applied again but one that was applied without being recorded
+// before a crash is, so the state machine must tolerate applying the last
+// entry twice. Writing the index costs a sync for each entry. The setting can
+// only be changed while the server is stopped.
+func (s *Server) SetPersistAppliedIndex(enabled bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Running() {
+		return errors.New("raft.Server: Cannot change applied index persistence while running")
+	}
+	s.persistApplied = enabled
+	return nil
+}
+
+// Retrieves the path of the file holding the persisted last applied index.
+func (s *Server) appliedPath() string {
+	return fmt.Sprintf("%s/applied", s.path)
+}
+
+// Reads the persisted last applied index. The second value is false if the
+// index has never been persisted.
+func (s *Server) readAppliedIndex() (uint64, bool, error) {
+	b, err := ioutil.ReadFile(s.appliedPath())
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	var index uint64
+	if _, err := fmt.Sscanf(string(b), "%016x\n", &index); err != nil {
+		return 0, false, fmt.Errorf("Invalid applied index: %v", err)
+	}
+	return index, true, nil
+}
+
+// Writes the last applied index to a temporary file and moves it into place
+// so a crash leaves either the old or the new index.
+func (s *Server) writeAppliedIndex(index uint64) error {
+	path := s.appliedPath() + ".tmp"
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
 		return err
 	}
+	if _, err = fmt.Fprintf(file, "%016x\n", index); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path, s.appliedPath())
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Applies the committed entries after the persisted last applied index when
+// the server starts. Without a persisted index every committed entry is
+// assumed to have been applied. This function does not obtain a lock so one
+// must be obtained before executing.
+func (s *Server) replayUnapplied() error {
+	applied, ok, err := s.readAppliedIndex()
+	if err != nil {
+		return err
+	}
+	commitIndex := s.log.CommitIndex()
+	if !ok || applied >= commitIndex {
+		s.setLastApplied(commitIndex)
+		return nil
+	}
+	if applied < s.log.StartIndex() {
+		return fmt.Errorf("Applied index has been compacted (%v < %v)", applied, s.log.StartIndex())
+	}
+
+	entries, err := s.log.GetEntriesBetween(applied+1, commitIndex)
+	if err != nil {
+		return err
+	}
+	warn("raft.Server: Applying %d entries after the persisted applied index (%v)", len(entries), applied)
+	s.lastApplied = applied
+	if s.log.ApplyBatchFunc != nil {
+		s.applyBatch(entries)
+	} else {
+		for _, entry := range entries {
+			s.log.applyEntryFunc(entry)
+		}
+	}
+	return nil
+}
+
+// Retrieves the index of the last entry applied to the state machine.
+func (s *Server) LastApplied() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastApplied
+}
+
+// Updates the last applied index and wakes any reads waiting for it. This
+// function does not obtain a lock so one must be obtained before executing.
+func (s *Server) setLastApplied(index uint64) {
+	s.lastApplied = index
+	if s.persistApplied {
+		if err := s.writeAppliedIndex(index); err != nil {
+			warn("raft.Server: Unable to persist applied index: %v", err)
+		}
+	}
+	s.applied.Broadcast()
+}
+
+// Removes the apply result for an index from the cache once the client has
+// received it.
+func (s *Server) AcknowledgeApplyResult(index uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.applyResults, index)
+}
+
+// Stores an apply result and evicts the oldest results once the cache is
+// full. This function does not obtain a lock so one must be obtained before
+// executing.
+func (s *Server) cacheApplyResult(index uint64, result interface{}) {
+	if result == nil {
+		return
+	}
+	s.applyResults[index] = result
+	s.applyResultIndices = append(s.applyResultIndices, index)
+	for len(s.applyResultIndices) > s.applyResultCacheSize {
+		delete(s.applyResults, s.applyResultIndices[0])
+		s.applyResultIndices = s.applyResultIndices[1:]
+	}
+}
+
+// Sets a function that is called with the uncommitted entries that are
+// discarded when a leader overwrites a conflicting portion of the log. The
+// function is called before the leader's entries are appended so that a
+// state machine that applies entries speculatively can undo them.
+func (s *Server) SetRollbackFunc(fn func(entries []*LogEntry)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rollbackFunc = fn
+}
+
+// Retrieves the entries after the previous log index of a request that
+// conflict with the request's entries. Entries that match the request's
+// entries are rewritten unchanged and are not considered rolled back. This
+// function does not obtain a lock so one must be obtained before executing.
+func (s *Server) conflictingEntries(req *AppendEntriesRequest) []*LogEntry {
+	if req.PrevLogIndex < s.log.StartIndex() || req.PrevLogIndex > s.log.CurrentIndex() {
+		return nil
+	}
+	existing, _ := s.log.GetEntriesAfter(req.PrevLogIndex)
+	for i, entry := range existing {
+		if i >= len(req.Entries) || req.Entries[i].term != entry.term {
+			conflicts := make([]*LogEntry, len(existing)-i)
+			copy(conflicts, existing[i:])
+			return conflicts
+		}
+	}
+	return nil
+}
+
+//--------------------------------------
+// Pending commands
+//--------------------------------------
+
+// Retrieves the number of Do calls that are waiting for their commands to be
+// committed.
+func (s *Server) PendingCommandCount() int {
+	return int(atomic.LoadInt32(&s.pendingCommands))
+}
+
+// Sets the maximum number of Do calls that may wait for their commands to be
+// committed. Additional calls return ErrTooManyPending instead of queueing
+// while the leader is unable to commit. A value of zero removes the limit.
+func (s *Server) SetMaxPendingCommands(n int) {
+	atomic.StoreInt32(&s.maxPendingCommands, int32(n))
+}
+
+// Sets the maximum number of uncompacted entries the log may hold before new
+// commands are refused with ErrLogFull. If block is true then commands wait
+// up to the command timeout for the log to be compacted instead of failing
+// immediately. A value of zero removes the limit.
+func (s *Server) SetMaxLogEntries(n int, block bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxLogEntries, s.blockOnFullLog = n, block
+}
+
+// Retrieves whether the uncompacted log holds the maximum number of entries.
+func (s *Server) logFull() bool {
+	return s.maxLogEntries > 0 && s.log.CurrentIndex()-s.log.StartIndex() >= uint64(s.maxLogEntries)
+}
+
+// Waits for the log to be compacted below the maximum number of entries if
+// blocking is enabled. ErrLogFull is returned if the log is still full.
+func (s *Server) waitForLogSpace() error {
+	if !s.logFull() {
+		return nil
+	} else if !s.blockOnFullLog {
+		return ErrLogFull
+	}
+
+	// Compaction wakes up waiters so only the timeout needs a timer.
+	deadline := time.Now().Add(s.CommandTimeout())
+	timer := time.AfterFunc(s.CommandTimeout(), func() {
+		s.mutex.Lock()
+		s.applied.Broadcast()
+		s.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for s.logFull() {
+		if !s.Running() || !time.Now().Before(deadline) {
+			return ErrLogFull
+		}
+		s.applied.Wait()
+	}
+	return nil
+}
+
+//--------------------------------------
+// Replication
+//--------------------------------------
+
+// Sets the maximum number of entries sent to a peer beyond the last entry it
+// has acknowledged. A peer that is far behind receives the log in windows of
+// this size and the window slides forward as each one is acknowledged. A
+// value of zero removes the limit.
+func (s *Server) SetMaxInflightEntries(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxInflightEntries = n
+}
+
+// Stops sending AppendEntries RPCs to a peer without removing it from the
+// membership. The peer still counts towards the quorum size but cannot
+// acknowledge entries while paused so the remaining servers must form a
+// quorum for entries to commit. ErrUnknownPeer is returned if the peer is
+// not a member.
+func (s *Server) PauseReplication(name string) error {
+	return s.setReplicationPaused(name, true)
+}
+
+// Resumes sending AppendEntries RPCs to a peer that was paused. The peer is
+// caught up by its next heartbeat or replicated command.
+func (s *Server) ResumeReplication(name string) error {
+	return s.setReplicationPaused(name, false)
+}
+
+// Retrieves the replication state of a peer. ErrUnknownPeer is returned if
+// the peer is not a member.
+func (s *Server) PeerStatus(name string) (PeerStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	peer := s.peers[name]
+	if peer == nil {
+		return PeerStatus{}, ErrUnknownPeer
+	}
+	return peer.Status(), nil
+}
+
+// Pauses or resumes replication to a peer.
+func (s *Server) setReplicationPaused(name string, paused bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	peer := s.peers[name]
+	if peer == nil {
+		return ErrUnknownPeer
+	}
+	peer.setReplicationPaused(paused)
+	return nil
+}
+
+// Sets the maximum number of entries sent in a single AppendEntries RPC so
+// that each request stays within the size limits of a transport. A peer
+// that is far behind is caught up with a series of requests and its match
+// index advances after each one. A value of zero removes the limit.
+func (s *Server) SetMaxEntriesPerRequest(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxEntriesPerRequest = n
+}
+
+// Sets the encoded size in bytes above which the entries of an AppendEntries
+// request are gzipped. Entries are only compressed for peers that negotiated
+// a protocol version supporting compression and heartbeats are never
+// compressed. A value of zero disables compression.
+func (s *Server) SetCompressionThreshold(bytes int) {
+	atomic.StoreInt32(&s.compressionThreshold, int32(bytes))
+}
+
+// Retrieves the limit on the bytes of entries sent to all peers each second.
+func (s *Server) ReplicationBytesPerSecond() int {
+	return s.replicationLimit.Rate()
+}
+
+// Limits the encoded bytes of entries sent in AppendEntries RPCs across all
+// peers each second so that catching up a far behind peer does not saturate
+// the network. Entries over the limit are withheld until a later request and
+// the request is still sent so heartbeats are never delayed. Sizes are counted
+// before compression. A value of zero removes the limit.
+func (s *Server) SetReplicationBytesPerSecond(n int) error {
+	if n < 0 {
+		return fmt.Errorf("raft.Server: Invalid replication rate: %v", n)
+	}
+	s.replicationLimit.SetRate(n)
+	return nil
+}
+
+//--------------------------------------
+// Membership
+//--------------------------------------
+
+// Retrieves the number of member servers in the consensus.
+func (s *Server) MemberCount() int {
+	count := 1
+	for _, _ = range s.peers {
+		count++
+	}
+	return count
+}
+
+// Retrieves the membership of the cluster as of a committed log index by
+// replaying the membership commands up to and including that index. The
+// returned peers only describe the members and are not connected.
+func (s *Server) ConfigurationAt(index uint64) ([]*Peer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return nil, errors.New("raft.Server: Log not available")
+	}
+	if index > s.log.CommitIndex() {
+		return nil, fmt.Errorf("raft.Server: Index is not committed (%v): (IDX=%v)", s.log.CommitIndex(), index)
+	}
+
+	members, err := s.membershipAt(index)
+	if err != nil {
+		return nil, err
+	}
+	peers := []*Peer{}
+	for _, member := range members {
+		peers = append(peers, &Peer{name: member.Name, priority: member.Priority, weight: member.Weight})
+	}
+	return peers, nil
+}
+
+// Serializes the committed membership of the cluster so that it can be used
+// to bootstrap a replacement cluster with RestoreConfiguration. Only the
+// cluster topology is included and not the state machine.
+func (s *Server) ConfigurationSnapshot() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return nil, errors.New("raft.Server: Log not available")
+	}
+	members, err := s.membershipAt(s.log.CommitIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	// Default weights are left out so the configuration reads the same as
+	// one written before weights were recorded.
+	for i := range members {
+		if members[i].Weight == DefaultWeight {
+			members[i].Weight = 0
+		}
+	}
+	return json.Marshal(members)
+}
+
+// Bootstraps the server with a membership serialized by ConfigurationSnapshot.
+// A committed join entry is written for each member in term zero so that
+// every server restored from the same configuration has an identical log.
+// An error is returned if the server already has a membership or log entries
+// or if it is not a member of the configuration.
+func (s *Server) RestoreConfiguration(b []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return errors.New("raft.Server: Cannot restore configuration while stopped")
+	} else if s.bootstrapped() {
+		return errors.New("raft.Server: Cannot restore configuration; already in membership")
+	}
+
+	var members []configurationMember
+	if err := json.Unmarshal(b, &members); err != nil {
+		return fmt.Errorf("raft.Server: Invalid configuration: %v", err)
+	}
+	found := false
+	for _, member := range members {
+		found = found || member.Name == s.name
+	}
+	if !found {
+		return fmt.Errorf("raft.Server: Server is not a member of the configuration: %s", s.name)
+	}
+
+	for _, member := range members {
+		command := &JoinCommand{Name: member.Name}
+		if member.Priority != DefaultPriority {
+			priority := member.Priority
+			command.Priority = &priority
+		}
+		if member.Weight != 0 && member.Weight != DefaultWeight {
+			weight := member.Weight
+			command.Weight = &weight
+		}
+		if err := s.log.AppendEntry(s.log.CreateEntry(0, command)); err != nil {
+			return fmt.Errorf("raft.Server: %v", err)
+		}
+	}
+	return s.log.SetCommitIndex(s.log.CurrentIndex())
+}
+
+// Retrieves the members as of a committed log index along with their election
+// priorities and voting weights, starting from the membership recorded when
+// the log was compacted. A member that rejoins after leaving takes the
+// settings of its latest join. This function does not obtain a lock so one
+// must be obtained before executing.
+func (s *Server) membershipAt(index uint64) ([]configurationMember, error) {
+	names, members, joins := []string{}, map[string]bool{}, map[string]*JoinCommand{}
+	join := func(c *JoinCommand) {
+		if _, ok := members[c.Name]; !ok {
+			names = append(names, c.Name)
+		}
+		if !members[c.Name] {
+			joins[c.Name] = c
+		}
+		members[c.Name] = true
+	}
+
+	from := uint64(1)
+	if start := s.log.startEntry(); start != nil {
+		if index < start.index {
+			return nil, fmt.Errorf("raft.Server: Index has been compacted (%v): (IDX=%v)", start.index, index)
+		}
+		if c, ok := start.command.(*CompactCommand); ok {
+			for _, name := range c.Peers {
+				command := &JoinCommand{Name: name}
+				if priority, ok := c.Priorities[name]; ok {
+					command.Priority = &priority
+				}
+				if weight, ok := c.Weights[name]; ok {
+					command.Weight = &weight
+				}
+				join(command)
+			}
+		}
+		from = start.index + 1
+	}
+
+	if index >= from {
+		entries, err := s.log.GetEntriesBetween(from, index)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch c := entry.command.(type) {
+			case *JoinCommand:
+				join(c)
+			case *LeaveCommand:
+				members[c.Name] = false
+			}
+		}
+	}
+
+	current := []configurationMember{}
+	for _, name := range names {
+		if !members[name] {
+			continue
+		}
+		member := configurationMember{Name: name, Priority: DefaultPriority, Weight: DefaultWeight}
+		if c := joins[name]; c.Priority != nil {
+			member.Priority = *c.Priority
+		}
+		if c := joins[name]; c.Weight != nil {
+			member.Weight = *c.Weight
+		}
+		current = append(current, member)
+	}
+	return current, nil
+}
+
+// Retrieves the number of servers required to make a quorum.
+func (s *Server) QuorumSize() int {
+	return (s.MemberCount() / 2) + 1
+}
+
+// Retrieves the number of servers that must store an entry before it is
+// committed. This defaults to a majority of the members.
+func (s *Server) WriteQuorumSize() int {
+	if s.writeQuorum > 0 {
+		return s.writeQuorum
+	}
+	return s.QuorumSize()
+}
+
+// Retrieves the number of servers that must be consulted to perform a read.
+// This defaults to a majority of the members.
+func (s *Server) ReadQuorumSize() int {
+	if s.readQuorum > 0 {
+		return s.readQuorum
+	}
+	return s.QuorumSize()
+}
+
+// Sets the write and read quorum sizes independently of a simple majority.
+// Every read quorum must overlap every write quorum and every write quorum
+// must overlap the majority used to elect a leader so that a new leader
+// always holds the committed entries. The policy is validated against the
+// current membership so it should be set again if the membership changes.
+// Passing zero for both sizes restores the majority defaults.
+func (s *Server) SetQuorumPolicy(writeQuorum int, readQuorum int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if writeQuorum == 0 && readQuorum == 0 {
+		s.writeQuorum, s.readQuorum = 0, 0
+		return nil
+	}
+
+	memberCount := s.MemberCount()
+	if writeQuorum < 1 || writeQuorum > memberCount || readQuorum < 1 || readQuorum > memberCount {
+		return fmt.Errorf("raft.Server: Quorum sizes out of range (MEMBERS=%v): (WRITE=%v, READ=%v)", memberCount, writeQuorum, readQuorum)
+	}
+	if writeQuorum+readQuorum <= memberCount {
+		return fmt.Errorf("raft.Server: Read and write quorums do not overlap (MEMBERS=%v): (WRITE=%v, READ=%v)", memberCount, writeQuorum, readQuorum)
+	}
+	if writeQuorum+s.QuorumSize() <= memberCount {
+		return fmt.Errorf("raft.Server: Write quorum does not overlap election quorum (MEMBERS=%v): (WRITE=%v, ELECTION=%v)", memberCount, writeQuorum, s.QuorumSize())
+	}
+
+	s.writeQuorum, s.readQuorum = writeQuorum, readQuorum
+	return nil
+}
+
+//--------------------------------------
+// Transport
+//--------------------------------------
+
+// Sets the Do, RequestVote and AppendEntries handlers to send RPCs through a
+// transport.
+func (s *Server) SetTransport(t Transport) {
+	s.DoHandler = func(server *Server, peer *Peer, command Command) error {
+		return t.SendDo(server, peer, command)
+	}
+	s.RequestVoteHandler = func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		return t.SendRequestVote(server, peer, req)
+	}
+	s.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		return t.SendAppendEntries(server, peer, req)
+	}
+}
+
+//--------------------------------------
+// Election timeout
+//--------------------------------------
+
+// Retrieves the election timeout.
+func (s *Server) ElectionTimeout() time.Duration {
+	return s.electionTimer.MinDuration()
+}
+
+// Sets the election timeout.
+func (s *Server) SetElectionTimeout(duration time.Duration) {
+	s.electionTimer.SetMinDuration(duration)
+	s.electionTimer.SetMaxDuration(duration * 2)
+}
+
+// Retrieves the base duration a candidate waits before retrying an election
+// that ended without a quorum. This defaults to a quarter of the election
+// timeout.
+func (s *Server) ElectionBackoff() time.Duration {
+	if s.electionBackoff > 0 {
+		return s.electionBackoff
+	}
+	return s.ElectionTimeout() / 4
+}
+
+// Sets the base duration a candidate waits before retrying an election that
+// ended without a quorum. The wait doubles with each retry, is randomized up
+// to twice its length so that competing candidates separate and is capped at
+// the election timeout. A zero duration uses a quarter of the election
+// timeout.
+func (s *Server) SetElectionBackoff(duration time.Duration) {
+	s.electionBackoff = duration
+}
+
+// Chooses how long to wait before the given election round.
+func (s *Server) electionBackoffDuration(round int) time.Duration {
+	d := s.ElectionBackoff()
+	for i := 1; i < round && d < s.ElectionTimeout(); i++ {
+		d *= 2
+	}
+	if d > s.ElectionTimeout() {
+		d = s.ElectionTimeout()
+	}
+	return d + s.electionTimer.random(d)
+}
+
+// Sets the random source used to choose election timeouts. Each server uses
+// its own seeded source by default so that servers do not contend on the
+// global source. Passing a source with a fixed seed makes the sequence of
+// election timeouts reproducible.
+func (s *Server) SetRand(r *rand.Rand) {
+	s.electionTimer.SetRand(r)
+}
+
+// Retrieves whether the server refuses votes while it has a healthy leader.
+func (s *Server) LeaderStickiness() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.leaderStickiness
+}
+
+// Sets whether a follower that has heard from its leader within the election
+// timeout refuses to vote for other candidates. This prevents a server that
+// is partitioned away and returns with a higher term from disrupting a
+// healthy leader.
+func (s *Server) SetLeaderStickiness(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.leaderStickiness = enabled
+}
+
+// Retrieves whether the leader steps down when it loses contact with a quorum.
+func (s *Server) CheckQuorum() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.checkQuorum
+}
+
+// Sets whether a leader that has not heard from a quorum within the election
+// timeout steps down to a follower. A leader partitioned from the majority
+// then stops reporting itself as the leader and Propose and reads fail with a
+// NotLeaderError instead of waiting on commands that can never be committed.
+func (s *Server) SetCheckQuorum(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkQuorum = enabled
+}
+
+// Retrieves whether Do fails immediately when the leader lacks a quorum.
+func (s *Server) FailWithoutQuorum() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failWithoutQuorum
+}
+
+// Sets whether Do on a leader that has not heard from a quorum within the
+// election timeout returns ErrNoQuorum at once instead of appending a command
+// that cannot be committed until the quorum returns. The leader does not step
+// down unless quorum checking is enabled as well.
+func (s *Server) SetFailWithoutQuorum(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failWithoutQuorum = enabled
+}
+
+// Steps down to a follower if quorum checking is enabled and fewer than a
+// quorum of servers, including this one, have responded to the leader within
+// the election timeout. A new leader is given one election timeout to hear
+// from its peers.
+func (s *Server) stepDownWithoutQuorum() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.checkQuorum || s.state != Leader || time.Since(s.leaderSince) < s.ElectionTimeout() {
+		return
+	}
+	count, ok := s.quorumReachable()
+	if ok {
+		return
+	}
+
+	warn("raft.Server: Lost contact with quorum, stepping down: %v of %v servers", count, s.MemberCount())
+	s.state = Follower
+	s.leader = ""
+	for _, peer := range s.peers {
+		peer.pause()
+	}
+	s.electionTimer.Reset()
+}
+
+// Counts the servers, including this one, that have responded to the leader
+// within the election timeout and checks whether they form a quorum. A peer
+// that misses a few heartbeats is still counted. This function does not
+// obtain a lock so one must be obtained before executing.
+func (s *Server) quorumReachable() (int, bool) {
+	timeout := s.ElectionTimeout()
+	count, weight := 1, s.weight
+	for _, peer := range s.peers {
+		if time.Since(peer.Status().LastAck) < timeout {
+			count, weight = count+1, weight+peer.weight
+		}
+	}
+	return count, s.isMajority(weight)
+}
+
+// Checks whether a command submitted now could be committed when failing
+// without a quorum is enabled. A new leader is given one election timeout to
+// hear from its peers before it fails commands. This function does not obtain
+// a lock so one must be obtained before executing.
+func (s *Server) canCommit() bool {
+	if !s.failWithoutQuorum || s.state != Leader || time.Since(s.leaderSince) < s.ElectionTimeout() {
+		return true
+	}
+	_, ok := s.quorumReachable()
+	return ok
+}
+
+// Retrieves how long a peer must be unreachable before the leader removes it
+// from the cluster. Zero disables automatic eviction.
+func (s *Server) AutoEvictTimeout() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.autoEvictTimeout
+}
+
+// Sets how long a peer must go without answering the leader before the leader
+// commits its removal so that a permanently lost server no longer counts
+// toward the quorum. This is disabled by default since a peer that is only
+// partitioned is removed as well and must join again to rejoin the cluster.
+func (s *Server) SetAutoEvictTimeout(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.autoEvictTimeout = d
+}
+
+// Retrieves the smallest cluster size that automatic eviction may leave.
+func (s *Server) AutoEvictMinSize() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.autoEvictMinSize
+}
+
+// Sets the smallest number of members, including the leader, that automatic
+// eviction may leave in the cluster.
+func (s *Server) SetAutoEvictMinSize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("raft.Server: Invalid minimum cluster size: %v", size)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.autoEvictMinSize = size
+	return nil
+}
+
+// Removes a peer that has not answered this leader within the auto-eviction
+// timeout unless the cluster would shrink below its minimum size. Only one
+// peer is removed at a time.
+func (s *Server) evictUnreachable(peer *Peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.autoEvictTimeout == 0 || s.state != Leader || s.evicting || s.peers[peer.name] != peer {
+		return
+	}
+	since := peer.Status().LastAck
+	if since.Before(s.leaderSince) {
+		since = s.leaderSince
+	}
+	if time.Since(since) < s.autoEvictTimeout || s.MemberCount()-1 < s.autoEvictMinSize {
+		return
+	}
+
+	warn("raft.Server: Evicting peer unreachable for %v: %s", time.Since(since), peer.name)
+	s.evicting = true
+	go func() {
+		err := s.RemovePeer(peer.name)
+		s.mutex.Lock()
+		s.evicting = false
+		s.mutex.Unlock()
+		if err != nil {
+			warn("raft.Server: Unable to evict peer %s: %v", peer.name, err)
+		}
+	}()
+}
+
+// Retrieves the election priority of the server.
+func (s *Server) Priority() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.priority
+}
+
+// Sets the election priority that the server records in the membership when
+// it joins a cluster. When an election timeout expires a server defers its
+// election by one election timeout for each level its priority is below the
+// highest priority member so that higher priority servers tend to be elected.
+// A server with a priority of zero never starts an election but still votes.
+// This must be set before joining.
+func (s *Server) SetPriority(priority int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.priority = priority
+}
+
+// Retrieves how long the server defers an election for higher priority
+// members to start theirs. This function does not obtain a lock so one must
+// be obtained before executing.
+func (s *Server) electionDelay() time.Duration {
+	highest := s.priority
+	for _, peer := range s.peers {
+		if peer.priority > highest {
+			highest = peer.priority
+		}
+	}
+	return time.Duration(highest-s.priority) * s.ElectionTimeout()
+}
+
+// Retrieves the voting weight of the server.
+func (s *Server) Weight() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.weight
+}
+
+// Sets the voting weight that the server records in the membership when it
+// joins a cluster. A leader is elected and entries are committed once the
+// servers that voted or stored them carry more than half of the total weight
+// of the members. Quorum sizes set with SetQuorumPolicy count servers and do
+// not consider weights. This must be set before joining.
+func (s *Server) SetWeight(weight int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if weight < 1 {
+		return fmt.Errorf("raft.Server: Invalid weight: %v", weight)
+	}
+	s.weight = weight
+	return nil
+}
+
+// Checks whether servers carrying the given weight hold more than half of
+// the total weight of the members. Exactly half is not a majority so with
+// four servers of equal weight three are required. This function does not
+// obtain a lock so one must be obtained before executing.
+func (s *Server) isMajority(weight int) bool {
+	total := s.weight
+	for _, peer := range s.peers {
+		total += peer.weight
+	}
+	return 2*weight > total
+}
+
+//--------------------------------------
+// Leader lease
+//--------------------------------------
+
+// Retrieves the leader lease duration.
+func (s *Server) LeaderLease() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.leaderLease
+}
+
+// Sets the duration that a leader may serve reads locally after a quorum has
+// acknowledged it. A zero duration disables the lease so every read confirms
+// leadership. The lease relies on followers not electing a new leader before
+// their election timeout expires so it must be shorter than the election
+// timeout reduced by LeaderLeaseClockDrift.
+func (s *Server) SetLeaderLease(d time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	max := s.ElectionTimeout() - time.Duration(float64(s.ElectionTimeout())*LeaderLeaseClockDrift)
+	if d < 0 || d >= max {
+		return fmt.Errorf("raft.Server: Leader lease must be less than %v: %v", max, d)
+	}
+	s.leaderLease = d
+	s.leaseExpiration = time.Time{}
+	return nil
+}
+
+//--------------------------------------
+// Heartbeat timeout
+//--------------------------------------
+
+// Retrieves the heartbeat timeout.
+func (s *Server) HeartbeatTimeout() time.Duration {
+	return s.heartbeatTimeout
+}
+
+// Sets the heartbeat timeout. Replicating entries to a peer counts as a
+// heartbeat so an idle heartbeat is only sent once a peer has not received an
+// AppendEntries RPC within the timeout.
+func (s *Server) SetHeartbeatTimeout(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.heartbeatTimeout = duration
+	for _, peer := range s.peers {
+		peer.SetHeartbeatTimeout(duration)
+	}
+}
+
+// Retrieves how long the leader must go without appending an entry before it
+// slows its heartbeats and the interval of the slower heartbeats.
+func (s *Server) QuiescentHeartbeat() (time.Duration, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.quiescentIdleAfter, s.quiescentInterval
+}
+
+// Sets the leader to send heartbeats only once every slow interval after no
+// entry has been appended for the idle duration. Heartbeats return to the
+// heartbeat timeout as soon as the next entry is appended. The slow interval
+// must be at most half the election timeout so that followers keep hearing
+// from the leader well before they time out. A zero idle duration or interval
+// disables quiescence.
+func (s *Server) SetQuiescentHeartbeat(idleAfter time.Duration, slowInterval time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if idleAfter < 0 || slowInterval < 0 {
+		return fmt.Errorf("raft.Server: Invalid quiescent heartbeat: %v, %v", idleAfter, slowInterval)
+	} else if max := s.ElectionTimeout() / 2; slowInterval > max {
+		return fmt.Errorf("raft.Server: Quiescent heartbeat interval exceeds half the election timeout: %v > %v", slowInterval, max)
+	}
+	s.quiescentIdleAfter, s.quiescentInterval = idleAfter, slowInterval
+	return nil
+}
+
+// Retrieves the interval between heartbeats to peers while the leader is
+// idle or zero if the leader is not idle.
+func (s *Server) idleHeartbeatInterval() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.quiescentIdleAfter == 0 || s.quiescentInterval == 0 || time.Since(s.lastWrite) < s.quiescentIdleAfter {
+		return 0
+	}
+	return s.quiescentInterval
+}
+
+//--------------------------------------
+// RPC & command timeouts
+//--------------------------------------
+
+// Retrieves how long the server waits for a response to a single RPC sent
+// to a peer. This defaults to the election timeout. The timeout is read
+// without the server lock since flushes sent on behalf of a server that
+// holds the lock also read it.
+func (s *Server) RPCTimeout() time.Duration {
+	if d := time.Duration(atomic.LoadInt64(&s.rpcTimeout)); d > 0 {
+		return d
+	}
+	return s.ElectionTimeout()
+}
+
+// Sets how long the server waits for a response to a single RPC sent to a
+// peer. An RPC that times out counts as a failed flush and the peer is tried
+// again after its next heartbeat timeout. A zero duration uses the election
+// timeout.
+func (s *Server) SetRPCTimeout(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.rpcTimeout, int64(duration))
+}
+
+// Retrieves how long the leader waits for a quorum to store a command before
+// Do returns. This defaults to the election timeout.
+func (s *Server) CommandTimeout() time.Duration {
+	if d := time.Duration(atomic.LoadInt64(&s.commandTimeout)); d > 0 {
+		return d
+	}
+	return s.ElectionTimeout()
+}
+
+// Sets how long the leader waits for a quorum to store a command before Do
+// returns. Replication to peers continues after Do has returned. A zero
+// duration uses the election timeout.
+func (s *Server) SetCommandTimeout(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.commandTimeout, int64(duration))
+}
+
+//--------------------------------------
+// Metrics
+//--------------------------------------
+
+// Sets the sink that receives the commit latency of commands executed with
+// Do and the round trip time of each successful AppendEntries RPC to a peer.
+// No timings are recorded when the sink is nil. The sink should be set before
+// the server is started.
+func (s *Server) SetMetricsSink(sink MetricsSink) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metrics = sink
+}
+
+// Reports a timing to the metrics sink if one is set.
+func (s *Server) observeDuration(name string, d time.Duration) {
+	if s.metrics != nil {
+		s.metrics.ObserveDuration(name, d)
+	}
+}
+
+//--------------------------------------
+// Tracing
+//--------------------------------------
+
+// Sets a function that receives an event when a command is appended or
+// committed by the leader and when an RPC is sent or received. Each RPC sent
+// carries a trace ID so that the events on both servers can be correlated.
+// The tracer may be called while the server lock is held so it must return
+// quickly and must not call back into the server. No events are reported
+// when the tracer is nil. The tracer should be set before the server is
+// started.
+func (s *Server) SetTracer(fn func(TraceEvent)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tracer = fn
+}
+
+// Generates a trace ID for an outgoing RPC. IDs are unique to the server and
+// are only generated when a tracer is set.
+func (s *Server) newTraceID() string {
+	if s.tracer == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%x", s.name, atomic.AddUint64(&s.traceSequence, 1))
+}
+
+// Reports an event to the tracer if one is set.
+func (s *Server) trace(event TraceEvent) {
+	if s.tracer != nil {
+		event.Server = s.name
+		s.tracer(event)
+	}
+}
+
+// Sets a function that is called with a peer's name and PeerUnreachable
+// when the peer has not answered any AppendEntries RPC for
+// UnreachableElectionTimeouts election timeouts, and with PeerReachable when
+// it answers again. A few missed heartbeats do not report the peer as
+// unreachable so the events do not flap. The function may be called while the
+// server lock is held so it must return quickly and must not call back into
+// the server. It should be set before the server is started.
+func (s *Server) SetReachabilityFunc(fn func(name string, event string)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reachabilityFunc = fn
+}
+
+// Reports a change in a peer's reachability if a function is set.
+func (s *Server) reportReachability(name string, event string) {
+	if s.reachabilityFunc != nil {
+		s.reachabilityFunc(name, event)
+	}
+}
+
+//--------------------------------------
+// Protocol version
+//--------------------------------------
+
+// Retrieves the minimum and maximum protocol versions the server will accept.
+func (s *Server) ProtocolVersion() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.minProtocolVersion, s.maxProtocolVersion
+}
+
+// Sets the range of protocol versions the server will accept. Requests from
+// peers outside of this range are refused and requests sent to peers are
+// downgraded to the highest version both sides understand. This function will
+// panic if the range is invalid or outside what this implementation supports.
+func (s *Server) SetProtocolVersion(min int, max int) {
+	if min < MinProtocolVersion || max > MaxProtocolVersion {
+		panic(fmt.Sprintf("raft.Server: Unsupported protocol version range: %v-%v", min, max))
+	}
+	if min > max {
+		panic("raft.Server: Minimum protocol version cannot be greater than maximum protocol version")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.minProtocolVersion = min
+	s.maxProtocolVersion = max
+	for _, peer := range s.peers {
+		peer.setProtocolVersion(max)
+	}
+}
+
+// Verifies that a request's protocol version is accepted by the server.
+func (s *Server) checkProtocolVersion(version int) error {
+	version = requestProtocolVersion(version)
+	if version < s.minProtocolVersion || version > s.maxProtocolVersion {
+		return fmt.Errorf("raft.Server: Unsupported protocol version: %v (MIN=%v, MAX=%v)", version, s.minProtocolVersion, s.maxProtocolVersion)
+	}
+	return nil
+}
+
+// Retrieves the protocol version a request was sent with. A request without
+// a version was sent by a server that predates version negotiation.
+func requestProtocolVersion(version int) int {
+	if version == 0 {
+		return MinProtocolVersion
+	}
+	return version
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Errors
+//--------------------------------------
+
+// The error message for a NotLeaderError.
+func (e *NotLeaderError) Error() string {
+	return fmt.Sprintf("raft.Server: Not leader (%s)", e.State)
+}
+
+//--------------------------------------
+// Sorting
+//--------------------------------------
+
+func (p uint64Slice) Len() int           { return len(p) }
+func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+//--------------------------------------
+// State
+//--------------------------------------
+
+// Starts the server with a log at the given path.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Exit if the server is already running.
+	if s.Running() {
+		return errors.New("raft.Server: Server already running")
+	}
+
+	// Replace the election timer if it was stopped by a previous shutdown.
+	if s.electionTimer.C() == nil {
+		timer := NewTimer(s.electionTimer.MinDuration(), s.electionTimer.MaxDuration())
+		timer.SetRand(s.electionTimer.rand)
+		s.electionTimer = timer
+		s.electionTimer.Reset()
+	}
+
+	// Initialize the log and load it up.
+	if err := s.log.Open(s.LogPath()); err != nil {
+		s.unload()
+		return fmt.Errorf("raft.Server: %v", err)
+	}
+
+	// Entries loaded from disk were applied before the server was stopped. A
+	// persisted applied index is not overwritten until the entries after it
+	// have been replayed.
+	s.lastApplied = s.log.CommitIndex()
+	if s.asyncApply || s.commitChannel != nil {
+		s.startApplyWorker()
+	}
+
+	// Rebuild the membership by replaying committed membership commands.
+	// Uncommitted membership changes are applied once they are committed.
+	if err := s.loadMembership(); err != nil {
+		s.unload()
+		return fmt.Errorf("raft.Server: %v", err)
+	}
+
+	// Update the state. A server that committed its own removal does not
+	// stand for election until it is added back.
+	s.state = s.followerState()
+	if s.removed {
+		s.electionTimer.Pause()
+	}
+	s.leader = ""
+	s.startedAt = time.Now()
+	for _, peer := range s.peers {
+		peer.pause()
+	}
+
+	// Apply the entries that were committed but not recorded as applied.
+	if s.persistApplied {
+		if err := s.replayUnapplied(); err != nil {
+			s.unload()
+			return fmt.Errorf("raft.Server: %v", err)
+		}
+	}
+
+	// Start the election timeout.
+	go s.electionTimeoutFunc()
+
+	return nil
+}
+
+// Shuts down the server.
+func (s *Server) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unload()
+}
+
+// Clears the state of a stopped server so that it can be started again as a
+// brand new server. The log and persisted applied index are removed along
+// with the current term, vote, membership and election history. Settings
+// such as timeouts, handlers and command types are kept.
+func (s *Server) Reset() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Running() {
+		return errors.New("raft.Server: Cannot reset while running")
+	}
+	if err := os.Remove(s.LogPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("raft.Server: Unable to remove log: %v", err)
+	}
+	if err := os.Remove(s.appliedPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("raft.Server: Unable to remove applied index: %v", err)
+	}
+
+	s.currentTerm = 0
+	s.votedFor = ""
+	s.leader = ""
+	s.removed = false
+	for _, peer := range s.peers {
+		peer.stop()
+	}
+	s.peers = make(map[string]*Peer)
+	for _, observer := range s.observers {
+		observer.stop()
+	}
+	s.observers = make(map[string]*Peer)
+	s.lastContact = time.Time{}
+	s.leaseExpiration = time.Time{}
+	s.lastApplied = 0
+	s.applyResults = make(map[uint64]interface{})
+	s.applyResultIndices = nil
+	s.electionTimes = nil
+	s.lastElection = nil
+	s.electionHistory = nil
+
+	return nil
+}
+
+// Unloads the server. Entries queued for asynchronous apply are applied
+// while the log is still open so that their applied index is persisted.
+func (s *Server) unload() {
+	s.electionTimer.Stop()
+	for _, peer := range s.peers {
+		peer.pause()
+	}
+
+	s.applyStopped = true
+	s.applyReady.Broadcast()
+	for s.applyWorker {
+		s.applyReady.Wait()
+	}
+
+	s.state = Stopped
+	s.log.Close()
+
+	if s.commitChannel != nil {
+		close(s.commitChannel)
+		s.commitChannel = nil
+	}
+}
+
+// Replays the membership recorded at the start of a compacted log and the
+// committed join and leave commands in the log to rebuild the peers. This
+// function does not obtain a lock so one must be obtained before executing.
+func (s *Server) loadMembership() error {
+	from := uint64(1)
+	if start := s.log.startEntry(); start != nil {
+		start.command.Apply(s)
+		from = start.index + 1
+	}
+	if s.log.CommitIndex() < from {
+		return nil
+	}
+	entries, err := s.log.GetEntriesBetween(from, s.log.CommitIndex())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch c := entry.command.(type) {
+		case *JoinCommand, *LeaveCommand:
+			c.Apply(s)
+		}
+	}
+	return nil
+}
+
+// Checks if the server is currently running.
+func (s *Server) Running() bool {
+	return s.state != Stopped
+}
+
+//--------------------------------------
+// Backup
+//--------------------------------------
+
+// Writes the committed log, starting with the membership recorded by the last
+// compaction, to a writer in the log file format. The output can be loaded
+// into a new server with ImportLog for disaster recovery or inspection.
+func (s *Server) ExportLog(w io.Writer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return errors.New("raft.Server: Log not available")
+	}
+	if err := s.log.Export(w); err != nil {
+		return fmt.Errorf("raft.Server: %v", err)
+	}
+	return nil
+}
+
+// Loads a log written by ExportLog into a stopped server with an empty log.
+// The entries are verified before the log file is written and they are
+// treated as committed when the server starts.
+func (s *Server) ImportLog(r io.Reader) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Running() {
+		return errors.New("raft.Server: Cannot import log while running")
+	}
+	if err := s.log.Import(s.LogPath(), r); err != nil {
+		return fmt.Errorf("raft.Server: %v", err)
+	}
+	return nil
+}
+
+// Passes each committed command in a stopped server's log to a function in
+// index order so that state can be rebuilt apart from the server, such as
+// when migrating to a new state machine or auditing the live one. Internal
+// commands and no-ops are skipped and nothing is applied to the server. A
+// compacted log only replays the entries after the compaction so the function
+// should start from the application's checkpoint at that index.
+func (s *Server) ReplayInto(fn func(entry *LogEntry)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Running() {
+		return errors.New("raft.Server: Cannot replay log while running")
+	}
+	file, err := os.Open(s.LogPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("raft.Server: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+		entry := NewLogEntry(s.log, 0, 0, nil)
+		if _, err := entry.Decode(reader); err != nil {
+			return fmt.Errorf("raft.Server: %v", err)
+		}
+		if err := s.log.checkUnknownCommand(entry); err != nil {
+			return fmt.Errorf("raft.Server: %v", err)
+		}
+		if _, ok := entry.command.(InternalCommand); ok || entry.entryType != EntryCommand {
+			continue
+		}
+		fn(entry)
+	}
+	return nil
+}
+
+//--------------------------------------
+// Compaction
+//--------------------------------------
+
+// Removes committed entries up to and including the given index from the
+// front of the log for state machines that checkpoint their own state. The
+// membership as of the index is kept at the start of the log so that it can
+// be rebuilt on startup. Peers that have not received the removed entries can
+// no longer be caught up. An error is returned if the index is not committed.
+func (s *Server) CompactLogTo(index uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.Running() {
+		return errors.New("raft.Server: Cannot compact while stopped")
+	}
+	if index > s.log.CommitIndex() {
+		return fmt.Errorf("raft.Server: Index is not committed (%v): (IDX=%v)", s.log.CommitIndex(), index)
+	}
+	if index <= s.log.StartIndex() {
+		return nil
+	}
+
+	members, err := s.membershipAt(index)
+	if err != nil {
+		return err
+	}
+	command := &CompactCommand{Peers: []string{}}
+	for _, member := range members {
+		command.Peers = append(command.Peers, member.Name)
+		if member.Priority != DefaultPriority {
+			if command.Priorities == nil {
+				command.Priorities = map[string]int{}
+			}
+			command.Priorities[member.Name] = member.Priority
+		}
+		if member.Weight != DefaultWeight {
+			if command.Weights == nil {
+				command.Weights = map[string]int{}
+			}
+			command.Weights[member.Name] = member.Weight
+		}
+	}
+	if err := s.log.Compact(index, command); err != nil {
+		return fmt.Errorf("raft.Server: %v", err)
+	}
+
+	// Wake up commands waiting for the log to shrink.
+	s.applied.Broadcast()
+	return nil
+}
+
+//--------------------------------------
+// Commands
+//--------------------------------------
+
+// Adds a command type to the log. The instance passed in will be copied and
+// deserialized each time a new log entry is read. This function will panic
+// if a command type with the same name already exists.
+func (s *Server) AddCommandType(command Command) {
+	s.log.AddCommandType(command)
+}
+
+// Sets how a committed command whose type has not been registered is handled.
+// By default applying stops at the command and the commit returns an error so
+// that entries are not silently dropped. Skipped commands are kept in the log
+// but never applied.
+func (s *Server) SetUnknownCommandPolicy(policy UnknownCommandPolicy) error {
+	if err := s.log.SetUnknownCommandPolicy(policy); err != nil {
+		return fmt.Errorf("raft.Server: %v", err)
+	}
+	return nil
+}
+
+// Attempts to execute a command and replicate it. The function will return
+// when the command has been successfully committed or an error has occurred.
+// ErrTooManyPending is returned if the maximum number of pending commands are
+// already waiting and ErrLogFull is returned if the log cannot hold another
+// entry. If enabled, ErrNoQuorum is returned immediately when the leader has
+// not heard from a quorum within the election timeout. ErrLeadershipLost is
+// returned as soon as the leader steps down while the command is uncommitted
+// and ErrCommandTimeout is returned if a quorum does not store the command
+// within the command timeout.
+func (s *Server) Do(command Command) error {
+	_, err := s.DoWithIndex(command)
+	return err
+}
+
+// Executes a command like Do and returns the index of the command's entry.
+// The index can be passed to FollowerRead so that a later read observes the
+// command.
+func (s *Server) DoWithIndex(command Command) (uint64, error) {
+	pending := atomic.AddInt32(&s.pendingCommands, 1)
+	defer atomic.AddInt32(&s.pendingCommands, -1)
+	if max := atomic.LoadInt32(&s.maxPendingCommands); max > 0 && pending > max {
+		return 0, ErrTooManyPending
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.bootstrapped() {
+		return 0, ErrNotBootstrapped
+	}
+
+	// A server cannot join a cluster under the name of this server.
+	if c, ok := command.(*JoinCommand); ok && c.Name == s.name {
+		return 0, ErrDuplicateName
+	}
+	if !s.canCommit() {
+		return 0, ErrNoQuorum
+	}
+	if err := s.filterProposal(command); err != nil {
+		return 0, err
+	}
+	return s.doWithIndex(command)
+}
+
+// Executes several commands as consecutive entries in the log so that no
+// other command is applied between them. Every command is checked before any
+// is appended and the results returned by ApplyResultFunc or the apply batch
+// function are returned in order once the last entry has been applied. A
+// NotLeaderError is returned if the server is not the leader. If the leader
+// steps down before the last entry is committed then ErrLeadershipLost is
+// returned and no results are reported although the entries may still be
+// committed by the next leader.
+func (s *Server) DoBatch(commands []Command) ([]interface{}, error) {
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	n := int32(len(commands))
+	pending := atomic.AddInt32(&s.pendingCommands, n)
+	defer atomic.AddInt32(&s.pendingCommands, -n)
+	if max := atomic.LoadInt32(&s.maxPendingCommands); max > 0 && pending > max {
+		return nil, ErrTooManyPending
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != Leader {
+		return nil, &NotLeaderError{State: s.state}
+	}
+	if !s.canCommit() {
+		return nil, ErrNoQuorum
+	}
+	for _, command := range commands {
+		if c, ok := command.(*JoinCommand); ok && c.Name == s.name {
+			return nil, ErrDuplicateName
+		}
+		if err := s.filterProposal(command); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.waitForLogSpace(); err != nil {
+		return nil, err
+	}
+	if s.maxLogEntries > 0 && s.log.CurrentIndex()-s.log.StartIndex()+uint64(len(commands)) > uint64(s.maxLogEntries) {
+		return nil, ErrLogFull
+	}
+	if s.state != Leader {
+		return nil, &NotLeaderError{State: s.state}
+	}
+
+	// Append every entry before the lock is released by replication.
+	var first, last *LogEntry
+	for _, command := range commands {
+		entry, err := s.appendCommand(command)
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			first = entry
+		}
+		last = entry
+	}
+	if err := s.replicate(last); err != nil {
+		return nil, err
+	}
+
+	// Wake up once the timeout expires in case the entries are never applied.
+	deadline := time.Now().Add(s.CommandTimeout())
+	timer := time.AfterFunc(s.CommandTimeout(), func() {
+		s.mutex.Lock()
+		s.applied.Broadcast()
+		s.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for s.lastApplied < last.index {
+		if last.index > s.log.CommitIndex() && (s.state != Leader || s.currentTerm != last.term) {
+			return nil, ErrLeadershipLost
+		} else if !s.Running() {
+			return nil, errors.New("raft.Server: Server stopped")
+		} else if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("raft.Server: Timed out waiting for batch to be applied (%v < %v)", s.lastApplied, last.index)
+		}
+		s.applied.Wait()
+	}
+
+	results := make([]interface{}, 0, len(commands))
+	for index := first.index; index <= last.index; index++ {
+		results = append(results, s.applyResults[index])
+	}
+	return results, nil
+}
+
+// Sets a function that validates commands submitted to the leader before
+// they are appended to the log. A command is rejected with the returned error
+// without using a log index. The function should only consult committed state
+// and is not called on followers. Passing nil removes the filter.
+func (s *Server) SetProposalFilter(fn func(command Command) error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.proposalFilter = fn
+}
+
+// Runs the proposal filter for a command submitted to the leader. This
+// function does not obtain a lock so one must be obtained before executing.
+func (s *Server) filterProposal(command Command) error {
+	if s.proposalFilter == nil || s.state != Leader {
+		return nil
+	}
+	return s.proposalFilter(command)
+}
+
+// This function is the low-level interface to execute commands. This function
+// does not obtain a lock so one must be obtained before executing.
+func (s *Server) do(command Command) error {
+	_, err := s.doWithIndex(command)
+	return err
+}
+
+// Executes a command and returns the index of its entry. ErrLeadershipLost is
+// returned if the leader steps down before the entry is committed. This
+// function does not obtain a lock so one must be obtained before executing.
+func (s *Server) doWithIndex(command Command) (uint64, error) {
+	t0 := time.Now()
+	if err := s.waitForLogSpace(); err != nil {
+		return 0, err
+	}
+	leader := s.state == Leader
+	entry, err := s.appendCommand(command)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.replicate(entry); err != nil {
+		return 0, err
+	}
+	if entry.index <= s.log.CommitIndex() {
+		s.observeDuration(MetricCommitLatency, time.Since(t0))
+		for s.lastApplied < entry.index && s.applyWorker {
+			s.applied.Wait()
+		}
+	} else if leader && (s.state != Leader || s.currentTerm != entry.term) {
+		return 0, ErrLeadershipLost
+	}
+	return entry.index, nil
+}
+
+// Proposes a command to the cluster. The command is appended to the leader's
+// log and the assigned index and term are returned without waiting for the
+// entry to be committed. Replication continues in the background and the
+// commit index can be checked to determine when the entry is committed. A
+// NotLeaderError is returned if this server is not the leader.
+func (s *Server) Propose(command Command) (uint64, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != Leader {
+		return 0, 0, &NotLeaderError{State: s.state}
+	}
+	if err := s.filterProposal(command); err != nil {
+		return 0, 0, err
+	}
+	if err := s.waitForLogSpace(); err != nil {
+		return 0, 0, err
+	}
+	if s.state != Leader {
+		return 0, 0, &NotLeaderError{State: s.state}
+	}
+
+	entry, err := s.appendCommand(command)
+	if err != nil {
+		return 0, 0, err
+	}
+	go s.replicateInBackground(entry)
+
+	return entry.index, entry.term, nil
+}
+
+// Appends a command to the log in the current term. This function does not
+// obtain a lock so one must be obtained before executing.
+func (s *Server) appendCommand(command Command) (*LogEntry, error) {
+	entry := s.log.CreateEntry(s.currentTerm, command)
+	if err := s.log.AppendEntry(entry); err != nil {
+		return nil, err
+	}
+	s.trace(TraceEvent{Kind: TraceAppend, Index: entry.index})
+	s.lastWrite = time.Now()
+	return entry, nil
+}
+
+// Replicates an entry while holding the server lock. The entry is not
+// replicated if leadership has been lost since it was appended. Nobody waits
+// on the entry so a command timeout is not reported.
+func (s *Server) replicateInBackground(entry *LogEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state == Leader && s.currentTerm == entry.term {
+		if err := s.replicate(entry); err != nil && err != ErrCommandTimeout {
+			warn("raft.Server: %v", err)
+		}
+	}
+}
+
+// Replicates the log to the peers and then advances the commit index to the
+// highest entry stored on a quorum. ErrCommandTimeout is returned if a quorum
+// does not store the log within the command timeout. This function does not
+// obtain a lock so one must be obtained before executing.
+func (s *Server) replicate(entry *LogEntry) error {
+	if ok, err := s.flushToQuorum(s.writeQuorum, entry.term); err != nil {
+		return err
+	} else if !ok {
+		return ErrCommandTimeout
+	}
+
+	// Commit to log and flush to peers again so they learn the commit index.
+	if s.advanceCommitIndex() {
+		for _, _peer := range s.peers {
+			peer := _peer
+			go func() {
+				peer.flush()
+			}()
+		}
+	}
+
+	return nil
+}
+
+// Advances the commit index to the highest index that has been stored on a
+// write quorum of servers. Each peer has stored the log up to its match index
+// and the leader has stored its entire log. Only an entry from the current
+// term is committed this way since an entry from an earlier term can still be
+// overwritten by another leader even after a quorum has stored it. Earlier
+// entries are committed along with the first entry of the current term.
+// Returns true if the commit index changed. This function does not obtain a
+// lock so one must be obtained before executing.
+func (s *Server) advanceCommitIndex() bool {
+	if s.state != Leader {
+		return false
+	}
+
+	index := s.quorumMatchIndex()
+	if index <= s.log.CommitIndex() || !s.log.ContainsEntry(index, s.currentTerm) {
+		return false
+	}
+	if err := s.log.SetCommitIndex(index); err != nil {
+		warn("raft.Server: %v", err)
+		return false
+	}
+	s.trace(TraceEvent{Kind: TraceCommit, Index: index})
+	return true
+}
+
+// Retrieves the highest index stored on a write quorum of servers. The match
+// indices are sorted from highest to lowest so the index at the position of
+// the quorum size is stored on at least that many servers. Without a write
+// quorum size the highest index stored by servers that carry a majority of
+// the weight is used instead. This function does not obtain a lock so one
+// must be obtained before executing.
+func (s *Server) quorumMatchIndex() uint64 {
+	indices := uint64Slice{s.log.CurrentIndex()}
+	for _, peer := range s.peers {
+		indices = append(indices, peer.MatchIndex())
+	}
+	sort.Sort(sort.Reverse(indices))
+	if s.writeQuorum > 0 {
+		if s.writeQuorum > len(indices) {
+			return 0
+		}
+		return indices[s.writeQuorum-1]
+	}
+	for _, candidate := range indices {
+		weight := s.weight
+		for _, peer := range s.peers {
+			if peer.MatchIndex() >= candidate {
+				weight += peer.weight
+			}
+		}
+		if s.isMajority(weight) {
+			return candidate
+		}
+	}
+	return 0
+}
+
+// Explains why the commit index is not advancing on the leader. The reason
+// is read from the match indices of the peers and does not contact them. An
+// empty string is returned if every entry is committed.
+func (s *Server) CommitBlockReason() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != Leader {
+		return fmt.Sprintf("not leader (%s)", s.state)
+	}
+	commitIndex, currentIndex := s.log.CommitIndex(), s.log.CurrentIndex()
+	if commitIndex >= currentIndex {
+		return ""
+	}
+
+	// A quorum has stored entries that only wait for one from this term.
+	if index := s.quorumMatchIndex(); index > commitIndex {
+		if term, _ := s.log.termAt(index); term != s.currentTerm {
+			return fmt.Sprintf("top-term requirement: index %d stored on a quorum is from term %d, leader has no term %d entry on a quorum yet", index, term, s.currentTerm)
+		}
+	}
+
+	// Report the peers that have not stored the next entry.
+	next := commitIndex + 1
+	count := 1
+	var missing []string
+	for _, peer := range s.peers {
+		if peer.MatchIndex() >= next {
+			count++
+		} else {
+			missing = append(missing, peer.name)
+		}
+	}
+	sort.Strings(missing)
+	reason := fmt.Sprintf("waiting for quorum: %d/%d servers stored index %d", count, s.MemberCount(), next)
+	if s.writeQuorum > 0 {
+		reason += fmt.Sprintf(" (write quorum %d)", s.writeQuorum)
+	}
+	if len(missing) > 0 {
+		reason += ", missing " + strings.Join(missing, ", ")
+	}
+	return reason
+}
 
-	// Flush the entries to the peers.
-	c := make(chan bool, len(s.peers))
+// Flushes the log to each peer and waits until the given number of servers,
+// including this one, have acknowledged it. A quorum of zero waits for servers
+// carrying a majority of the weight instead. Returns false if the quorum was
+// not reached within the command timeout. A successful flush also renews
+// the leader lease since it confirms that no other leader has been elected.
+// This function does not obtain a lock so one must be obtained before
+// executing.
+func (s *Server) flushToQuorum(quorum int, currentTerm uint64) (bool, error) {
+	startTime := time.Now()
+
+	// Flush the entries to the peers. Peers that are sent a limited window
+	// of entries are flushed until they have caught up to the current index.
+	// Once this function returns the server lock is no longer held on behalf
+	// of the remaining flushes so they obtain it themselves.
+	//
+	// Requests are generated on behalf of this function and a peer that
+	// reports a higher term is handed to it while it is waiting so that the
+	// server is only read and changed under its lock. The handoff lock keeps
+	// the term from changing while a request is generated. Once this
+	// function has returned the flushes obtain the server lock themselves.
+	type response struct {
+		term   uint64
+		weight int
+	}
+	c := make(chan response, len(s.peers))
+	var handoff sync.Mutex
+	returned := false
+	defer func() {
+		handoff.Lock()
+		returned = true
+		handoff.Unlock()
+		for len(c) > 0 {
+			if r := <-c; r.term > currentTerm {
+				s.stepDownToTerm(r.term)
+			}
+		}
+	}()
+	create := func(prevLogIndex uint64) (*AppendEntriesRequest, func(*Server, *Peer, *AppendEntriesRequest) (*AppendEntriesResponse, error), bool) {
+		handoff.Lock()
+		defer handoff.Unlock()
+		if returned {
+			return nil, nil, false
+		}
+		req, handler := s.createInternalAppendEntriesRequest(prevLogIndex)
+		return req, handler, true
+	}
+	currentIndex := s.log.CurrentIndex()
 	for _, _peer := range s.peers {
 		peer := _peer
 		go func() {
-			term, success, err := peer.internalFlush()
+			flush := func() (uint64, bool, error) {
+				term, success, err := peer.internalFlush(create)
+				if err == errFlushReleased {
+					return peer.flush()
+				}
+				return term, success, err
+			}
+			term, success, err := flush()
+			for err == nil && success && term <= currentTerm && peer.PrevLogIndex() < currentIndex {
+				term, success, err = flush()
+			}
 
-			// Demote if we encounter a higher term.
-			if err != nil {
+			// Demote if we encounter a higher term and stop waiting for the
+			// quorum. The peer rejects the request with an error in that case
+			// so the term is checked first.
+			if term > currentTerm {
+				handoff.Lock()
+				released := returned
+				if !released {
+					c <- response{term: term}
+				}
+				handoff.Unlock()
+				if released {
+					s.mutex.Lock()
+					s.stepDownToTerm(term)
+					s.mutex.Unlock()
+				}
 				return
-			} else if term > currentTerm {
-				s.setCurrentTerm(term)
-				s.electionTimer.Reset()
+			} else if err != nil {
 				return
 			}
 
-			// If we successfully replicated the log then send a success to the channel.
+			// If we successfully replicated the log then send the peer's
+			// weight to the channel.
 			if success {
-				c <- true
+				c <- response{weight: peer.weight}
 			}
 		}()
 	}
 
-	// Wait for a quorum to confirm and commit entry.
-	responseCount := 1
-	committed := false
-loop:
+	// Wait for a quorum to confirm.
+	responseCount, responseWeight := 1, s.weight
 	for {
-		// If we received enough votes then stop waiting for more votes.
-		if responseCount >= s.QuorumSize() {
-			committed = true
-			break
+		// If enough servers stored the entry then stop waiting for more responses.
+		if (quorum > 0 && responseCount >= quorum) || (quorum == 0 && s.isMajority(responseWeight)) {
+			if quorum == 0 || quorum >= s.QuorumSize() {
+				s.leaseExpiration = startTime.Add(s.leaderLease)
+			}
+			return true, nil
 		}
 
-		// Collect votes from peers.
+		// Collect responses from peers.
 		select {
-		case <-c:
+		case r := <-c:
 			// Exit if our term has changed.
+			if r.term > currentTerm {
+				handoff.Lock()
+				s.stepDownToTerm(r.term)
+				handoff.Unlock()
+			}
 			if s.currentTerm > currentTerm {
-				return fmt.Errorf("raft.Server: Higher term discovered, stepping down: (%v > %v)", s.currentTerm, currentTerm)
+				return false, ErrLeadershipLost
 			}
-			responseCount++
-		case <-time.After(s.ElectionTimeout()):
-			break loop
+			if r.weight > 0 {
+				responseCount, responseWeight = responseCount+1, responseWeight+r.weight
+			}
+		case <-time.After(s.CommandTimeout()):
+			return false, nil
 		}
 	}
+}
 
-	// Commit to log and flush to peers again.
-	if committed {
-		if err := s.log.SetCommitIndex(entry.index); err != nil {
-			warn("raft.Server: %v", err)
-		} else {
-			for _, _peer := range s.peers {
-				peer := _peer
-				go func() {
-					peer.flush()
-				}()
+// Adopts a higher term reported by a peer, which steps the server down, and
+// restarts its election timeout. This function does not obtain a lock so one
+// must be obtained before executing.
+func (s *Server) stepDownToTerm(term uint64) {
+	s.setCurrentTerm(term)
+	s.electionTimer.Reset()
+}
+
+//--------------------------------------
+// Reads
+//--------------------------------------
+
+// Performs a linearizable read on the leader. Leadership is confirmed by
+// flushing to a read quorum unless the leader lease is still valid and then
+// the read function is executed. All committed entries have been applied when
+// the function executes and no entries will be applied until it returns so
+// it must not call back into the server. A NotLeaderError is returned if the
+// server is not the leader. Leadership is confirmed again if the term changed
+// while waiting for entries to be applied since the confirmation only holds
+// for the term in which it was made.
+//
+// Concurrent reads share confirmation rounds. A read that was submitted
+// before a round started is served by that round once it succeeds instead of
+// flushing again. A round that started before the read was submitted is never
+// used since leadership may have been lost in between.
+func (s *Server) LeaderRead(fn func() error) error {
+	submitted := atomic.LoadUint64(&s.readRound)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		if s.state != Leader {
+			return &NotLeaderError{State: s.state}
+		}
+		term := s.currentTerm
+
+		// Confirm leadership with a read quorum if the lease has expired and
+		// no round started since the read was submitted has confirmed it.
+		if s.leaderLease == 0 || !time.Now().Before(s.leaseExpiration) {
+			if s.readConfirmedTerm != term || s.readConfirmedRound <= submitted {
+				round := atomic.AddUint64(&s.readRound, 1)
+				confirmed, err := s.flushToQuorum(s.readQuorum, term)
+				if err != nil {
+					return err
+				} else if !confirmed {
+					return errors.New("raft.Server: Unable to confirm leadership")
+				}
+				s.readConfirmedRound, s.readConfirmedTerm = round, term
 			}
 		}
+
+		// Entries applied asynchronously may still be queued. The lock is
+		// released while waiting so leadership may be lost and regained.
+		for s.lastApplied < s.log.CommitIndex() && s.applyWorker {
+			s.applied.Wait()
+		}
+		if s.state == Leader && s.currentTerm == term {
+			return fn()
+		}
+	}
+}
+
+// Performs a read on any server once it has applied the entry at the given
+// index. A client that passes the index returned by DoWithIndex or Propose
+// observes its own write even when reading from a follower. The read is not
+// linearizable since newer entries may already be committed elsewhere. The
+// function executes under the same conditions as in LeaderRead. An error is
+// returned if the index is not applied within the timeout so that the client
+// can fall back to the leader.
+func (s *Server) FollowerRead(minIndex uint64, timeout time.Duration, fn func() error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Wake up once the timeout expires in case nothing else is applied.
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		s.mutex.Lock()
+		s.applied.Broadcast()
+		s.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for s.lastApplied < minIndex {
+		if !s.Running() {
+			return errors.New("raft.Server: Server stopped")
+		} else if !time.Now().Before(deadline) {
+			return fmt.Errorf("raft.Server: Timed out waiting for index to be applied (%v < %v)", s.lastApplied, minIndex)
+		}
+		s.applied.Wait()
+	}
+
+	return fn()
+}
+
+// Appends a no-op entry on the leader and waits until it has been applied
+// locally. All commands submitted before the barrier have then been committed
+// and applied. A NotLeaderError is returned if the server is not the leader
+// and an error is returned if the entry is not applied within the timeout.
+func (s *Server) Barrier(timeout time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != Leader {
+		return &NotLeaderError{State: s.state}
+	}
+
+	// Wake up once the timeout expires in case the entry is never applied.
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		s.mutex.Lock()
+		s.applied.Broadcast()
+		s.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	entry, err := s.appendCommand(&NoopCommand{})
+	if err != nil {
+		return err
+	}
+	if err := s.replicate(entry); err != nil {
+		return err
 	}
 
+	for s.lastApplied < entry.index {
+		if !s.Running() {
+			return errors.New("raft.Server: Server stopped")
+		} else if !time.Now().Before(deadline) {
+			return fmt.Errorf("raft.Server: Timed out waiting for barrier to be applied (%v < %v)", s.lastApplied, entry.index)
+		}
+		s.applied.Wait()
+	}
 	return nil
 }
 
+// Waits until every member has applied the last committed configuration entry
+// so that servers that were removed can be shut down safely. The applied
+// index reported by each member, including the leader, is returned along with
+// whether all of them had caught up before the timeout. Followers report their
+// applied index in AppendEntries responses so the result may lag by a
+// heartbeat. A NotLeaderError is returned if the server is not the leader.
+func (s *Server) ConfigurationAppliedOnAll(timeout time.Duration) (bool, map[string]uint64, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mutex.Lock()
+		if s.state != Leader {
+			s.mutex.Unlock()
+			return false, nil, &NotLeaderError{State: s.state}
+		}
+		index, heartbeatTimeout := s.log.configurationIndex(), s.heartbeatTimeout
+		applied := map[string]uint64{s.name: s.lastApplied}
+		for name, peer := range s.peers {
+			applied[name] = peer.AppliedIndex()
+		}
+		s.mutex.Unlock()
+
+		caughtUp := true
+		for _, i := range applied {
+			if i < index {
+				caughtUp = false
+			}
+		}
+		if caughtUp || !time.Now().Before(deadline) {
+			return caughtUp, applied, nil
+		}
+		time.Sleep(heartbeatTimeout)
+	}
+}
+
 // Executes the handler for doing a command on a particular peer.
 func (s *Server) executeDoHandler(peer *Peer, command Command) error {
 	if s.DoHandler == nil {
@@ -354,38 +2867,103 @@ func (s *Server) executeDoHandler(peer *Peer, command Command) error {
 func (s *Server) AppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.trace(TraceEvent{ID: req.TraceID, Kind: TraceReceive, RPC: TraceAppendEntries, Peer: req.LeaderName, Index: req.PrevLogIndex, Count: len(req.Entries)})
+	resp, err := s.processAppendEntriesRequest(req)
+	resp.ProtocolVersion = s.maxProtocolVersion
+	resp.AppliedIndex = s.lastApplied
+	return resp, err
+}
 
+// Processes an AppendEntries request without a lock.
+func (s *Server) processAppendEntriesRequest(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
 	// If the server is stopped then reject it.
 	if !s.Running() {
 		return NewAppendEntriesResponse(s.currentTerm, false), fmt.Errorf("raft.Server: Server stopped")
 	}
 
+	// Refuse requests from peers speaking an incompatible protocol.
+	if err := s.checkProtocolVersion(req.ProtocolVersion); err != nil {
+		return NewAppendEntriesResponse(s.currentTerm, false), err
+	}
+
+	// A leader using our name is a misconfigured server.
+	if req.LeaderName == s.name {
+		return NewAppendEntriesResponse(s.currentTerm, false), ErrDuplicateName
+	}
+
+	// Restore entries that the leader compressed or that were serialized.
+	// Compressed entries are ignored if the request's version predates them.
+	if requestProtocolVersion(req.ProtocolVersion) < CompressionProtocolVersion {
+		req.Compressed = nil
+	}
+	if err := req.decompress(s.log); err != nil {
+		return NewAppendEntriesResponse(s.currentTerm, false), err
+	}
+
 	// If the request is coming from an old term then reject it.
 	if req.Term < s.currentTerm {
 		return NewAppendEntriesResponse(s.currentTerm, false), fmt.Errorf("raft.Server: Stale request term")
 	}
+
+	// Adopt the leader's term if it is newer which also clears our vote. A
+	// leader exists for this term so step down to a follower in either case.
 	s.setCurrentTerm(req.Term)
-	s.state = Follower
+	s.state = s.followerState()
+	s.leader = req.LeaderName
 	for _, peer := range s.peers {
 		peer.pause()
 	}
 
 	// Reset election timeout.
-	s.electionTimer.Reset()
-
-	// Reject if log doesn't contain a matching previous entry.
-	if err := s.log.Truncate(req.PrevLogIndex, req.PrevLogTerm); err != nil {
-		return NewAppendEntriesResponse(s.currentTerm, false), err
+	if !s.removed {
+		s.electionTimer.Reset()
+	}
+	s.lastContact = time.Now()
+
+	// Skip entries that are already stored with a matching term. A request
+	// that was delivered twice is then acknowledged without truncating the
+	// log and appending its entries again.
+	prevLogIndex, prevLogTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	for len(entries) > 0 && entries[0].index == prevLogIndex+1 && s.log.ContainsEntry(entries[0].index, entries[0].term) {
+		prevLogIndex, prevLogTerm, entries = entries[0].index, entries[0].term, entries[1:]
 	}
 
-	// Append entries to the log.
-	if err := s.log.AppendEntries(req.Entries); err != nil {
-		return NewAppendEntriesResponse(s.currentTerm, false), err
+	// A request without entries whose previous entry is stored is also
+	// acknowledged without truncating so that a delayed heartbeat does not
+	// discard entries appended after it was sent.
+	matched := len(req.Entries) == 0 && (prevLogIndex == 0 || s.log.ContainsEntry(prevLogIndex, prevLogTerm))
+
+	if !matched && (len(entries) > 0 || len(req.Entries) == 0) {
+		// Reject if log doesn't contain a matching previous entry. Notify
+		// the rollback function of any conflicting entries that were
+		// discarded.
+		var conflicts []*LogEntry
+		if s.rollbackFunc != nil {
+			conflicts = s.conflictingEntries(req)
+		}
+		if err := s.log.Truncate(prevLogIndex, prevLogTerm); err != nil {
+			return NewAppendEntriesResponse(s.currentTerm, false), err
+		}
+		if len(conflicts) > 0 {
+			s.rollbackFunc(conflicts)
+		}
+
+		// Append entries to the log.
+		if err := s.log.AppendEntries(entries); err != nil {
+			return NewAppendEntriesResponse(s.currentTerm, false), err
+		}
 	}
 
-	// Commit up to the commit index.
-	if err := s.log.SetCommitIndex(req.CommitIndex); err != nil {
-		return NewAppendEntriesResponse(s.currentTerm, false), err
+	// Commit up to the commit index. Entries after the request's entries may
+	// not match the leader's log so they are not committed by this request.
+	commitIndex := req.CommitIndex
+	if lastIndex := req.PrevLogIndex + uint64(len(req.Entries)); commitIndex > lastIndex {
+		commitIndex = lastIndex
+	}
+	if commitIndex > s.log.CommitIndex() {
+		if err := s.log.SetCommitIndex(commitIndex); err != nil {
+			return NewAppendEntriesResponse(s.currentTerm, false), err
+		}
 	}
 
 	return NewAppendEntriesResponse(s.currentTerm, true), nil
@@ -400,10 +2978,16 @@ func (s *Server) createAppendEntriesRequest(prevLogIndex uint64) (*AppendEntries
 
 // Creates an AppendEntries request without a lock.
 func (s *Server) createInternalAppendEntriesRequest(prevLogIndex uint64) (*AppendEntriesRequest, func(*Server, *Peer, *AppendEntriesRequest) (*AppendEntriesResponse, error)) {
-	if s.log == nil {
+	if !s.Running() || prevLogIndex < s.log.StartIndex() || prevLogIndex > s.log.CurrentIndex() {
 		return nil, nil
 	}
 	entries, prevLogTerm := s.log.GetEntriesAfter(prevLogIndex)
+	if s.maxInflightEntries > 0 && len(entries) > s.maxInflightEntries {
+		entries = entries[:s.maxInflightEntries]
+	}
+	if s.maxEntriesPerRequest > 0 && len(entries) > s.maxEntriesPerRequest {
+		entries = entries[:s.maxEntriesPerRequest]
+	}
 	req := NewAppendEntriesRequest(s.currentTerm, s.name, prevLogIndex, prevLogTerm, entries, s.log.CommitIndex())
 	return req, s.AppendEntriesHandler
 }
@@ -415,55 +2999,117 @@ func (s *Server) createInternalAppendEntriesRequest(prevLogIndex uint64) (*Appen
 // Promotes the server to a candidate and then requests votes from peers. If
 // enough votes are received then the server becomes the leader. If this
 // server is elected then true is returned. If another server is elected then
-// false is returned.
+// false is returned. A round that ends without a quorum, either because the
+// votes were denied or because the election timeout expired, is followed by
+// another round in the next term after the election backoff.
 func (s *Server) promote() (bool, error) {
-	for {
+	// Keep the votes received in the last round of the election.
+	var results []VoteResult
+	defer func() {
+		s.mutex.Lock()
+		s.lastElection = results
+		s.mutex.Unlock()
+	}()
+
+	var term, lastLogIndex, lastLogTerm uint64
+	for round := 0; ; round++ {
+		// Wait before retrying and give up if another server was elected or
+		// the server stopped in the meantime.
+		if round > 0 {
+			time.Sleep(s.electionBackoffDuration(round))
+			s.mutex.Lock()
+			if s.state != Candidate || s.currentTerm != term {
+				s.mutex.Unlock()
+				return false, fmt.Errorf("raft.Server: No longer a candidate, stopping election: %v (%v > %v)", s.state, s.currentTerm, term)
+			}
+			s.mutex.Unlock()
+		}
+
+		// Stay a follower once the election rate limit has been reached.
+		s.mutex.Lock()
+		if !s.allowElection() {
+			warn("raft.Server: Election rate limit reached, remaining a follower: %v elections in %v", len(s.electionTimes), ElectionRateWindow)
+			if s.state == Candidate {
+				s.state = Follower
+			}
+			s.electionTimer.Reset()
+			s.mutex.Unlock()
+			return false, errors.New("raft.Server: Election rate limit reached")
+		}
+		s.mutex.Unlock()
+
 		// Start a new election.
-		term, lastLogIndex, lastLogTerm := s.promoteToCandidate()
+		startTime := time.Now()
+		term, lastLogIndex, lastLogTerm = s.promoteToCandidate()
 
 		// Request votes from each of our peers.
-		c := make(chan *RequestVoteResponse, len(s.peers))
+		c := make(chan VoteResult, len(s.peers))
+		weights := map[string]int{}
 		for _, _peer := range s.peers {
 			peer := _peer
+			weights[peer.name] = peer.weight
+			req := NewRequestVoteRequest(term, s.name, lastLogIndex, lastLogTerm)
 			go func() {
-				req := NewRequestVoteRequest(term, s.name, lastLogIndex, lastLogTerm)
 				req.peer = peer
-				resp, _ := s.executeRequestVoteHandler(peer, req)
-				resp.peer = peer
-				c <- resp
+				req.ProtocolVersion = peer.ProtocolVersion()
+				resp, err := s.executeRequestVoteHandler(peer, req)
+				result := VoteResult{Peer: peer.Name(), Err: err}
+				if resp != nil {
+					result.Granted, result.Term = resp.VoteGranted, resp.Term
+					peer.setProtocolVersion(resp.ProtocolVersion)
+				}
+				c <- result
 			}()
 		}
 
 		// Collect votes until we have a quorum.
 		votes := map[string]bool{}
+		results = nil
 		elected := false
+		record := func(elected bool) {
+			r := ElectionRecord{Term: term, Elected: elected, Duration: time.Since(startTime), VotesFor: 1}
+			for _, value := range votes {
+				if value {
+					r.VotesFor++
+				} else {
+					r.VotesAgainst++
+				}
+			}
+			s.recordElection(r)
+		}
 	loop:
 		for {
-			// Add up all our votes.
-			votesGranted := 1
-			for _, value := range votes {
+			// Add up the weight of all our votes.
+			votesGranted := s.weight
+			for name, value := range votes {
 				if value {
-					votesGranted++
+					votesGranted += weights[name]
 				}
 			}
 			// If we received enough votes then stop waiting for more votes.
-			if votesGranted >= s.QuorumSize() {
+			if s.isMajority(votesGranted) {
 				elected = true
 				break
+			} else if len(results) == len(s.peers) {
+				break
 			}
 
 			// Collect votes from peers.
 			select {
-			case resp := <-c:
-				if resp != nil {
-					// Step down if we discover a higher term.
-					if resp.Term > term {
-						s.setCurrentTerm(term)
-						s.electionTimer.Reset()
-						return false, fmt.Errorf("raft.Server: Higher term discovered, stepping down: (%v > %v)", resp.Term, term)
-					}
-					votes[resp.peer.Name()] = resp.VoteGranted
+			case result := <-c:
+				results = append(results, result)
+
+				// Adopt the higher term and step down without waiting for
+				// the remaining votes.
+				if result.Term > term {
+					record(false)
+					s.mutex.Lock()
+					s.setCurrentTerm(result.Term)
+					s.mutex.Unlock()
+					s.electionTimer.Reset()
+					return false, fmt.Errorf("raft.Server: Higher term discovered, stepping down: (%v > %v)", result.Term, term)
 				}
+				votes[result.Peer] = result.Granted
 			case <-time.After(s.ElectionTimeout()):
 				break loop
 			}
@@ -471,8 +3117,10 @@ func (s *Server) promote() (bool, error) {
 
 		// If we received enough votes then promote to leader and stop this election.
 		if elected && s.promoteToLeader(term, lastLogIndex, lastLogTerm) {
+			record(true)
 			break
 		}
+		record(false)
 
 		// If we are no longer in the same term then another server must have been elected.
 		s.mutex.Lock()
@@ -486,6 +3134,88 @@ func (s *Server) promote() (bool, error) {
 	return true, nil
 }
 
+// Starts an election immediately instead of waiting for the election timeout.
+// This function blocks until the server is elected or steps down after
+// discovering another leader. An error is returned if the server is stopped
+// or is not a follower.
+func (s *Server) StartElection() error {
+	s.mutex.Lock()
+	if !s.Running() {
+		s.mutex.Unlock()
+		return errors.New("raft.Server: Cannot start election while stopped")
+	} else if s.state != Follower {
+		s.mutex.Unlock()
+		return fmt.Errorf("raft.Server: Cannot start election as %s", s.state)
+	} else if !s.bootstrapped() {
+		s.mutex.Unlock()
+		return ErrNotBootstrapped
+	}
+	s.electionTimer.Pause()
+	s.mutex.Unlock()
+
+	_, err := s.promote()
+	return err
+}
+
+// Reports whether the remaining servers could elect a new leader if this
+// leader stopped. Each peer is sent a pre-vote for the next term carrying
+// this server's log and the peers that would grant it are counted against the
+// quorum without this server. Pre-votes do not change any state on the peers
+// so the current leadership is not disturbed. Peers that predate pre-votes
+// are counted if they are reachable for replication. False is returned if the
+// server is not the leader.
+func (s *Server) CanFormQuorum() bool {
+	s.mutex.Lock()
+	if s.state != Leader {
+		s.mutex.Unlock()
+		return false
+	}
+	term := s.currentTerm + 1
+	lastLogIndex, lastLogTerm := s.log.CommitInfo()
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	s.mutex.Unlock()
+
+	c := make(chan int, len(peers))
+	for _, _peer := range peers {
+		peer := _peer
+		go func() {
+			granted := false
+			if peer.ProtocolVersion() < PreVoteProtocolVersion {
+				granted = peer.Status().Reachable
+			} else {
+				req := NewRequestVoteRequest(term, s.name, lastLogIndex, lastLogTerm)
+				req.peer = peer
+				req.ProtocolVersion = peer.ProtocolVersion()
+				req.PreVote = true
+				resp, err := s.executeRequestVoteHandler(peer, req)
+				granted = err == nil && resp != nil && resp.VoteGranted
+			}
+			if granted {
+				c <- peer.weight
+			} else {
+				c <- 0
+			}
+		}()
+	}
+
+	// Add up the weight of the grants until a quorum is reached or every
+	// peer answered.
+	granted := 0
+	timeout := time.After(s.RPCTimeout())
+	for i := 0; i < len(peers) && !s.isMajority(granted); i++ {
+		select {
+		case weight := <-c:
+			granted += weight
+		case <-timeout:
+			return false
+		}
+	}
+	return s.isMajority(granted)
+}
+
 // Promotes the server to a candidate and increases the election term. The
 // term and log state are returned for use in the RPCs.
 func (s *Server) promoteToCandidate() (term uint64, lastLogIndex uint64, lastLogTerm uint64) {
@@ -496,6 +3226,7 @@ func (s *Server) promoteToCandidate() (term uint64, lastLogIndex uint64, lastLog
 	s.state = Candidate
 	s.currentTerm++
 	s.votedFor = s.name
+	s.leader = ""
 
 	// Pause the election timer while we're a candidate.
 	s.electionTimer.Pause()
@@ -524,11 +3255,26 @@ func (s *Server) promoteToLeader(term uint64, lastLogIndex uint64, lastLogTerm u
 		return false
 	}
 
-	// Move server to become a leader and begin peer heartbeats.
+	// Move server to become a leader and begin peer heartbeats. Match
+	// indices from an earlier leadership may no longer hold.
 	s.state = Leader
+	s.leaderSince = time.Now()
+	s.leaseExpiration = time.Time{}
 	for _, peer := range s.peers {
+		peer.resetMatchIndex()
 		peer.resume()
 	}
+	for _, observer := range s.observers {
+		observer.resume()
+	}
+
+	// Append a no-op in the new term so that entries from earlier terms are
+	// committed once it has been replicated.
+	if entry, err := s.appendCommand(&NoopCommand{}); err != nil {
+		warn("raft.Server: %v", err)
+	} else {
+		go s.replicateInBackground(entry)
+	}
 
 	return true
 }
@@ -543,16 +3289,48 @@ func (s *Server) promoteToLeader(term uint64, lastLogIndex uint64, lastLogTerm u
 func (s *Server) RequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.trace(TraceEvent{ID: req.TraceID, Kind: TraceReceive, RPC: TraceRequestVote, Peer: req.CandidateName})
+	resp, err := s.processRequestVoteRequest(req)
+	resp.ProtocolVersion = s.maxProtocolVersion
+	return resp, err
+}
 
+// Processes a RequestVote request without a lock.
+func (s *Server) processRequestVoteRequest(req *RequestVoteRequest) (*RequestVoteResponse, error) {
 	// Fail if the server is not running.
 	if !s.Running() {
 		return NewRequestVoteResponse(s.currentTerm, false), fmt.Errorf("raft.Server: Server is stopped")
 	}
 
+	// Refuse requests from peers speaking an incompatible protocol.
+	if err := s.checkProtocolVersion(req.ProtocolVersion); err != nil {
+		return NewRequestVoteResponse(s.currentTerm, false), err
+	}
+
+	// A candidate using our name is a misconfigured server.
+	if req.CandidateName == s.name {
+		return NewRequestVoteResponse(s.currentTerm, false), ErrDuplicateName
+	}
+
 	// If the request is coming from an old term then reject it.
 	if req.Term < s.currentTerm {
 		return NewRequestVoteResponse(s.currentTerm, false), fmt.Errorf("raft.Server: Stale term: %v < %v", req.Term, s.currentTerm)
 	}
+
+	// A pre-vote asks whether the vote would be granted if the current leader
+	// were gone so only the candidate's log is checked and nothing changes.
+	// The flag is ignored if the request's version predates pre-votes.
+	if req.PreVote && requestProtocolVersion(req.ProtocolVersion) >= PreVoteProtocolVersion {
+		if err := s.checkCandidateLog(req); err != nil {
+			return NewRequestVoteResponse(s.currentTerm, false), err
+		}
+		return NewRequestVoteResponse(s.currentTerm, true), nil
+	}
+
+	// If we have recently heard from a leader then don't vote and don't adopt the candidate's term.
+	if s.leaderStickiness && s.state == Follower && time.Since(s.lastContact) < s.ElectionTimeout() {
+		return NewRequestVoteResponse(s.currentTerm, false), fmt.Errorf("raft.Server: Leader is still active")
+	}
 	s.setCurrentTerm(req.Term)
 
 	// If we've already voted for a different candidate then don't vote for this candidate.
@@ -561,22 +3339,36 @@ func (s *Server) RequestVote(req *RequestVoteRequest) (*RequestVoteResponse, err
 	}
 
 	// If the candidate's log is not at least as up-to-date as our committed log then don't vote.
-	lastCommitIndex, lastCommitTerm := s.log.CommitInfo()
-	if lastCommitIndex > req.LastLogIndex || lastCommitTerm > req.LastLogTerm {
-		return NewRequestVoteResponse(s.currentTerm, false), fmt.Errorf("raft.Server: Out-of-date log: [%v/%v] > [%v/%v]", lastCommitIndex, lastCommitTerm, req.LastLogIndex, req.LastLogTerm)
+	if err := s.checkCandidateLog(req); err != nil {
+		return NewRequestVoteResponse(s.currentTerm, false), err
 	}
 
-	// If we made it this far then cast a vote and reset our election time out.
+	// If we made it this far then cast a vote and reset our election time out
+	// so the candidate has time to win before we stand ourselves. Denied votes
+	// leave the timer alone so that failing candidates cannot delay elections.
 	s.votedFor = req.CandidateName
 	s.electionTimer.Reset()
 	return NewRequestVoteResponse(s.currentTerm, true), nil
 }
 
+// Returns an error if the candidate's log is not at least as up-to-date as
+// our committed log. An empty log is at index 0 in term 0 so every candidate
+// is at least as up-to-date.
+func (s *Server) checkCandidateLog(req *RequestVoteRequest) error {
+	lastCommitIndex, lastCommitTerm := s.log.CommitInfo()
+	if lastCommitIndex > 0 && (lastCommitIndex > req.LastLogIndex || lastCommitTerm > req.LastLogTerm) {
+		return fmt.Errorf("raft.Server: Out-of-date log: [%v/%v] > [%v/%v]", lastCommitIndex, lastCommitTerm, req.LastLogIndex, req.LastLogTerm)
+	}
+	return nil
+}
+
 // Executes the handler for sending a RequestVote RPC.
 func (s *Server) executeRequestVoteHandler(peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
 	if s.RequestVoteHandler == nil {
 		panic("raft.Server: RequestVoteHandler not registered")
 	}
+	req.TraceID = s.newTraceID()
+	s.trace(TraceEvent{ID: req.TraceID, Kind: TraceSend, RPC: TraceRequestVote, Peer: peer.Name()})
 	return s.RequestVoteHandler(s, peer, req)
 }
 
@@ -587,13 +3379,42 @@ func (s *Server) setCurrentTerm(term uint64) {
 	if term > s.currentTerm {
 		s.currentTerm = term
 		s.votedFor = ""
-		s.state = Follower
+		s.leader = ""
+		s.state = s.followerState()
 		for _, peer := range s.peers {
 			peer.pause()
 		}
 	}
 }
 
+// Retrieves the state of a server that is neither a candidate nor a leader.
+// This function does not obtain a lock so one must be obtained before
+// executing.
+func (s *Server) followerState() string {
+	if s.removed {
+		return Removed
+	}
+	return Follower
+}
+
+// Records whether the server's own removal from the cluster is committed. A
+// running server that is removed stops its election timer and one that is
+// added back becomes a follower again. This function does not obtain a lock
+// so one must be obtained before executing.
+func (s *Server) setRemoved(removed bool) {
+	s.removed = removed
+	if !s.Running() || s.state == Leader {
+		return
+	}
+	if removed {
+		s.state, s.leader = Removed, ""
+		s.electionTimer.Pause()
+	} else if s.state == Removed {
+		s.state = Follower
+		s.electionTimer.Reset()
+	}
+}
+
 // Listens to the election timeout and kicks off a new election.
 func (s *Server) electionTimeoutFunc() {
 	for {
@@ -610,9 +3431,35 @@ func (s *Server) electionTimeoutFunc() {
 			break
 		}
 
-		// If an election times out then promote this server. If the channel
-		// closes then that means the server has stopped so kill the function.
+		// If an election times out then promote this server. A server that
+		// has not been bootstrapped has no cluster to lead and a server with
+		// no priority never leads so they wait for another timeout instead.
+		// A removed server waits until it is added back. If the channel
+		// closes then that means the server has stopped so kill the
+		// function.
 		if _, ok := <- c; ok {
+			s.mutex.Lock()
+			eligible := s.bootstrapped() && s.priority > 0 && !s.removed
+			if !eligible && s.Running() && !s.removed {
+				s.electionTimer.Reset()
+			}
+			term, lastContact, delay := s.currentTerm, s.lastContact, s.electionDelay()
+			s.mutex.Unlock()
+			if !eligible {
+				continue
+			}
+
+			// Give higher priority servers a chance to be elected first and
+			// stand down if a leader or candidate is heard from meanwhile.
+			if delay > 0 {
+				time.Sleep(delay)
+				s.mutex.Lock()
+				deferred := !s.Running() || s.currentTerm != term || !s.lastContact.Equal(lastContact)
+				s.mutex.Unlock()
+				if deferred {
+					continue
+				}
+			}
 			s.promote()
 		} else {
 			break
@@ -624,7 +3471,16 @@ func (s *Server) electionTimeoutFunc() {
 // Membership
 //--------------------------------------
 
-// Connects to a given server and attempts to gain membership.
+// Checks whether the server belongs to a cluster. A server without peers or
+// log entries has neither joined itself nor been joined to another server.
+// This function does not obtain a lock so one must be obtained before
+// executing.
+func (s *Server) bootstrapped() bool {
+	return len(s.peers) > 0 || s.log.CurrentIndex() > 0
+}
+
+// Connects to a given server and attempts to gain membership. Joining again
+// after this server's join is committed has no effect so it can be retried.
 func (s *Server) Join(name string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -632,17 +3488,43 @@ func (s *Server) Join(name string) error {
 	// Exit if the server is not running.
 	if !s.Running() {
 		return errors.New("raft.Server: Cannot join while stopped")
+	}
+
+	// Joining again once our own join is committed succeeds without appending
+	// another join as long as the named server is in the same cluster.
+	current, err := s.membershipAt(s.log.CommitIndex())
+	if err != nil {
+		return err
+	}
+	members := map[string]bool{}
+	for _, member := range current {
+		members[member.Name] = true
+	}
+	if members[s.name] {
+		if members[name] {
+			return nil
+		}
+		return fmt.Errorf("raft.Server: Cannot join %s; already a member of another cluster", name)
 	} else if s.MemberCount() > 1 {
 		return errors.New("raft.Server: Cannot join; already in membership")
 	}
 
 	// The join command keeps track of the membership.
 	command := &JoinCommand{Name: s.name}
+	if s.priority != DefaultPriority {
+		priority := s.priority
+		command.Priority = &priority
+	}
+	if s.weight != DefaultWeight {
+		weight := s.weight
+		command.Weight = &weight
+	}
 
 	// If joining self then promote to leader.
 	if s.name == name {
 		s.currentTerm++
 		s.state = Leader
+		s.leaderSince = time.Now()
 		s.electionTimer.Pause()
 		s.do(command)
 		return nil
@@ -651,3 +3533,127 @@ func (s *Server) Join(name string) error {
 	// Request membership if we are joining to another server.
 	return s.executeDoHandler(NewPeer(s, name, s.heartbeatTimeout), command)
 }
+
+// Reports whether a membership change has been appended to the log but not
+// yet committed along with the index of its entry and a description such as
+// "join 4". Only the latest uncommitted change is reported.
+func (s *Server) PendingConfigChange() (bool, uint64, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := s.log.pendingConfiguration()
+	if entry == nil {
+		return false, 0, ""
+	}
+	var description string
+	switch c := entry.command.(type) {
+	case *JoinCommand:
+		description = "join " + c.Name
+	case *LeaveCommand:
+		description = "leave " + c.Name
+	}
+	return true, entry.index, description
+}
+
+// Adds a server to the cluster by committing a join command. This must be
+// called on the leader. ErrPeerExists is returned if the server is already a
+// member, including when the name is this server's own name.
+func (s *Server) AddPeer(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != Leader {
+		return &NotLeaderError{State: s.state}
+	} else if name == s.name || s.peers[name] != nil {
+		return ErrPeerExists
+	}
+
+	command := &JoinCommand{Name: name}
+	if err := command.Validate(s); err != nil {
+		return err
+	}
+	return s.do(command)
+}
+
+// Removes a server from the cluster by committing a leave command. This must
+// be called on the leader. ErrUnknownPeer is returned if the server is not a
+// member. The leader cannot remove itself.
+func (s *Server) RemovePeer(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != Leader {
+		return &NotLeaderError{State: s.state}
+	} else if name == s.name {
+		return errors.New("raft.Server: Leader cannot remove itself")
+	} else if s.peers[name] == nil {
+		return ErrUnknownPeer
+	}
+
+	command := &LeaveCommand{Name: name}
+	if err := command.Validate(s); err != nil {
+		return err
+	}
+	return s.do(command)
+}
+
+//--------------------------------------
+// Observers
+//--------------------------------------
+
+// Streams the log to a server outside of the cluster, such as an analytics
+// consumer, through AppendEntries RPCs sent by the transport while this
+// server leads. The observer should run with a priority of zero. It is not
+// part of the configuration and is never counted toward a quorum so it can
+// lag arbitrarily without delaying commits. Observers are attached to a
+// single leader and must be attached again after a new leader is elected. An
+// observer that falls behind the start of a compacted log can no longer be
+// caught up.
+func (s *Server) AttachObserver(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != Leader {
+		return &NotLeaderError{State: s.state}
+	} else if name == s.name || s.peers[name] != nil || s.observers[name] != nil {
+		return ErrPeerExists
+	}
+
+	observer := NewPeer(s, name, s.heartbeatTimeout)
+	observer.observer = true
+	s.observers[name] = observer
+	observer.resume()
+	return nil
+}
+
+// Stops streaming the log to an observer. ErrUnknownPeer is returned if the
+// observer is not attached. Nothing is sent to the observer once this
+// function returns.
+func (s *Server) DetachObserver(name string) error {
+	s.mutex.Lock()
+	observer := s.observers[name]
+	if observer == nil {
+		s.mutex.Unlock()
+		return ErrUnknownPeer
+	}
+	observer.stop()
+	delete(s.observers, name)
+	s.mutex.Unlock()
+
+	// Wait for a heartbeat in progress to finish. It obtains the server lock
+	// so the lock is released first.
+	<-observer.stopped
+	return nil
+}
+
+// Retrieves the replication state of an attached observer.
+func (s *Server) ObserverStatus(name string) (PeerStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	observer := s.observers[name]
+	if observer == nil {
+		return PeerStatus{}, ErrUnknownPeer
+	}
+	return observer.Status(), nil
+}
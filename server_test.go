@@ -1,8 +1,15 @@
 package raft
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -13,6 +20,53 @@ import (
 //
 //------------------------------------------------------------------------------
 
+//--------------------------------------
+// Constructor
+//--------------------------------------
+
+// Ensure that a server can be created from a valid configuration.
+func TestServerNewServerFromConfig(t *testing.T) {
+	transport := NewInmemTransport()
+	server, err := NewServerFromConfig(&Config{
+		Name:             "1",
+		Path:             "/tmp/raft",
+		ElectionTimeout:  TestElectionTimeout,
+		HeartbeatTimeout: TestHeartbeatTimeout,
+		Transport:        transport,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create server: %v", err)
+	}
+	if server.Name() != "1" || server.Path() != "/tmp/raft" {
+		t.Fatalf("Unexpected name/path: %v/%v", server.Name(), server.Path())
+	}
+	if server.ElectionTimeout() != TestElectionTimeout || server.HeartbeatTimeout() != TestHeartbeatTimeout {
+		t.Fatalf("Unexpected timeouts: %v/%v", server.ElectionTimeout(), server.HeartbeatTimeout())
+	}
+	if server.DoHandler == nil || server.RequestVoteHandler == nil || server.AppendEntriesHandler == nil {
+		t.Fatalf("Transport handlers not set")
+	}
+
+	// Zero timeouts use the defaults.
+	server, err = NewServerFromConfig(&Config{Name: "1"})
+	if err != nil || server.ElectionTimeout() != DefaultElectionTimeout || server.HeartbeatTimeout() != DefaultHeartbeatTimeout {
+		t.Fatalf("Unexpected default timeouts: %v/%v (%v)", server.ElectionTimeout(), server.HeartbeatTimeout(), err)
+	}
+}
+
+// Ensure that invalid configurations are rejected.
+func TestServerNewServerFromConfigValidation(t *testing.T) {
+	if _, err := NewServerFromConfig(&Config{ElectionTimeout: TestElectionTimeout}); err == nil || err.Error() != "raft.Config: Name cannot be blank" {
+		t.Fatalf("Blank name should have been rejected: %v", err)
+	}
+	if _, err := NewServerFromConfig(&Config{Name: "1", ElectionTimeout: TestHeartbeatTimeout, HeartbeatTimeout: TestHeartbeatTimeout}); err == nil || err.Error() != "raft.Config: Election timeout must exceed heartbeat timeout: (ELECTION=20ms, HEARTBEAT=20ms)" {
+		t.Fatalf("Election timeout not exceeding heartbeat timeout should have been rejected: %v", err)
+	}
+	if _, err := NewServerFromConfig(&Config{Name: "1", HeartbeatTimeout: -1}); err == nil || err.Error() != "raft.Config: Timeouts cannot be negative: (ELECTION=0s, HEARTBEAT=-1ns)" {
+		t.Fatalf("Negative timeout should have been rejected: %v", err)
+	}
+}
+
 //--------------------------------------
 // Request Vote
 //--------------------------------------
@@ -72,6 +126,61 @@ func TestServerRequestVoteApprovedIfAlreadyVotedInOlderTerm(t *testing.T) {
 	}
 }
 
+// Ensure that a follower with an active leader refuses to vote when leader stickiness is enabled.
+func TestServerRequestVoteDeniedWithActiveLeader(t *testing.T) {
+	server := newTestServer("1")
+	server.SetElectionTimeout(TestElectionTimeout)
+	server.SetLeaderStickiness(true)
+	server.Start()
+	defer server.Stop()
+
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, []*LogEntry{}, 0)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	resp, err := server.RequestVote(NewRequestVoteRequest(2, "foo", 0, 0))
+	if !(resp.Term == 1 && !resp.VoteGranted && err != nil && err.Error() == "raft.Server: Leader is still active") {
+		t.Fatalf("Vote should have been denied: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+	if server.currentTerm != 1 || server.VotedFor() != "" {
+		t.Fatalf("Denied vote should not change term or vote: %v/%v", server.currentTerm, server.VotedFor())
+	}
+
+	// Once the leader has been silent for an election timeout the vote is granted.
+	server.mutex.Lock()
+	server.lastContact = time.Now().Add(-TestElectionTimeout)
+	server.mutex.Unlock()
+	if resp, err := server.RequestVote(NewRequestVoteRequest(2, "foo", 0, 0)); !(resp.Term == 2 && resp.VoteGranted && err == nil) {
+		t.Fatalf("Vote should have been granted: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+}
+
+// Ensure that granting a vote resets the election timer and that denying one
+// does not.
+func TestServerRequestVoteResetsElectionTimerOnGrant(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	server.electionTimer.Pause()
+	if resp, err := server.RequestVote(NewRequestVoteRequest(1, "foo", 0, 0)); !(resp.VoteGranted && err == nil) {
+		t.Fatalf("Vote should have been granted (%v)", err)
+	}
+	if !server.electionTimer.Running() {
+		t.Fatalf("Granted vote did not reset the election timer")
+	}
+
+	server.electionTimer.Pause()
+	if resp, err := server.RequestVote(NewRequestVoteRequest(1, "bar", 0, 0)); resp.VoteGranted || err == nil {
+		t.Fatalf("Vote should have been denied")
+	}
+	if resp, err := server.RequestVote(NewRequestVoteRequest(0, "bar", 0, 0)); resp.VoteGranted || err == nil {
+		t.Fatalf("Stale vote should have been denied")
+	}
+	if server.electionTimer.Running() {
+		t.Fatalf("Denied vote reset the election timer")
+	}
+}
+
 // Ensure that a vote request is denied if the log is out of date.
 func TestServerRequestVoteDenyIfCandidateLogIsBehind(t *testing.T) {
 	server := newTestServerWithLog("1",
@@ -98,6 +207,225 @@ func TestServerRequestVoteDenyIfCandidateLogIsBehind(t *testing.T) {
 	}
 }
 
+// Ensure that an empty log never refuses a candidate and that an empty
+// candidate log is out-of-date against any committed entries.
+func TestServerRequestVoteWithEmptyLog(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	if resp, err := server.RequestVote(NewRequestVoteRequest(1, "foo", 0, 0)); !(resp.Term == 1 && resp.VoteGranted && err == nil) {
+		t.Fatalf("Empty log vote should have been granted: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+	if resp, err := server.RequestVote(NewRequestVoteRequest(2, "bar", 3, 2)); !(resp.Term == 2 && resp.VoteGranted && err == nil) {
+		t.Fatalf("Populated log vote should have been granted: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+
+	server = newTestServerWithLog("2",
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n")
+	server.Start()
+	defer server.Stop()
+	resp, err := server.RequestVote(NewRequestVoteRequest(1, "foo", 0, 0))
+	if !(resp.Term == 1 && !resp.VoteGranted && err != nil && err.Error() == "raft.Server: Out-of-date log: [1/1] > [0/0]") {
+		t.Fatalf("Empty candidate log vote should have been denied (%v)", err)
+	}
+}
+
+// Ensure that a vote request is refused if it uses an unsupported protocol version.
+func TestServerRequestVoteDeniedForUnsupportedProtocolVersion(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	req := NewRequestVoteRequest(1, "foo", 0, 0)
+	req.ProtocolVersion = MaxProtocolVersion + 1
+	resp, err := server.RequestVote(req)
+	if !(resp.Term == 0 && !resp.VoteGranted && resp.ProtocolVersion == MaxProtocolVersion && err != nil && err.Error() == "raft.Server: Unsupported protocol version: 4 (MIN=1, MAX=3)") {
+		t.Fatalf("Unsupported protocol version should have been denied: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+
+	// Requests without a version predate negotiation and are still accepted.
+	req.ProtocolVersion = 0
+	if resp, err := server.RequestVote(req); !(resp.Term == 1 && resp.VoteGranted && err == nil) {
+		t.Fatalf("Unversioned vote request should have been granted: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+}
+
+// Ensure that a vote request from a server using our name is refused.
+func TestServerRequestVoteDeniedForDuplicateName(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	resp, err := server.RequestVote(NewRequestVoteRequest(1, "1", 0, 0))
+	if !(resp.Term == 0 && !resp.VoteGranted && err == ErrDuplicateName) {
+		t.Fatalf("Duplicate name should have been denied: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+}
+
+//--------------------------------------
+// Quorum
+//--------------------------------------
+
+// Ensure that quorum policies which would allow non-overlapping quorums are rejected.
+func TestServerSetQuorumPolicyValidation(t *testing.T) {
+	servers, _ := newTestCluster([]string{"1", "2", "3", "4", "5"})
+	defer servers.Stop()
+	leader := servers[0]
+
+	if err := leader.SetQuorumPolicy(3, 2); err == nil || err.Error() != "raft.Server: Read and write quorums do not overlap (MEMBERS=5): (WRITE=3, READ=2)" {
+		t.Fatalf("Non-overlapping read quorum should have been rejected: %v", err)
+	}
+	if err := leader.SetQuorumPolicy(2, 4); err == nil || err.Error() != "raft.Server: Write quorum does not overlap election quorum (MEMBERS=5): (WRITE=2, ELECTION=3)" {
+		t.Fatalf("Non-overlapping write quorum should have been rejected: %v", err)
+	}
+	if err := leader.SetQuorumPolicy(6, 1); err == nil || err.Error() != "raft.Server: Quorum sizes out of range (MEMBERS=5): (WRITE=6, READ=1)" {
+		t.Fatalf("Out-of-range write quorum should have been rejected: %v", err)
+	}
+	if err := leader.SetQuorumPolicy(4, 2); err != nil {
+		t.Fatalf("Valid quorum policy should have been accepted: %v", err)
+	}
+	if leader.WriteQuorumSize() != 4 || leader.ReadQuorumSize() != 2 {
+		t.Fatalf("Unexpected quorum sizes: %v/%v", leader.WriteQuorumSize(), leader.ReadQuorumSize())
+	}
+	if err := leader.SetQuorumPolicy(0, 0); err != nil || leader.WriteQuorumSize() != 3 || leader.ReadQuorumSize() != 3 {
+		t.Fatalf("Unable to restore majority quorums: %v/%v (%v)", leader.WriteQuorumSize(), leader.ReadQuorumSize(), err)
+	}
+}
+
+// Ensure that a command is only committed once the write quorum has stored it.
+func TestServerWriteQuorumCommit(t *testing.T) {
+	down := newTestDownSet("4", "5")
+	servers, _ := newTestLeaderCluster([]string{"1", "2", "3", "4", "5"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+	if err := leader.SetQuorumPolicy(4, 2); err != nil {
+		t.Fatalf("Unable to set quorum policy: %v", err)
+	}
+
+	// A majority of three is not enough to satisfy a write quorum of four.
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != ErrCommandTimeout {
+		t.Fatalf("Command should have timed out: %v", err)
+	}
+	if leader.log.CommitIndex() != 0 {
+		t.Fatalf("Command should not have been committed: %v", leader.log.CommitIndex())
+	}
+
+	// Once a fourth server stores the entries they are committed.
+	down.set("4", false)
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if leader.log.CommitIndex() != 2 {
+		t.Fatalf("Commands should have been committed: %v", leader.log.CommitIndex())
+	}
+}
+
+// Ensure that the commit index advances to the highest index stored on a
+// majority of servers according to their match indices.
+func TestServerCommitIndexFollowsMatchIndexMajority(t *testing.T) {
+	down := newTestDownSet("2", "3", "4", "5")
+	servers, _ := newTestLeaderCluster([]string{"1", "2", "3", "4", "5"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+	for i := 0; i < 9; i++ {
+		leader.log.AppendEntry(leader.log.CreateEntry(1, &TestCommand1{"foo", i}))
+	}
+
+	// Three of five servers have stored index 7 but only two have index 9.
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	for name, index := range map[string]uint64{"2": 7, "3": 7, "4": 9, "5": 0} {
+		leader.peers[name].matchIndex = index
+	}
+	if !leader.advanceCommitIndex() || leader.log.CommitIndex() != 7 {
+		t.Fatalf("Expected commit index to advance to 7: %v", leader.log.CommitIndex())
+	}
+
+	// Once a third server stores index 9 it is committed.
+	leader.peers["2"].matchIndex = 9
+	if !leader.advanceCommitIndex() || leader.log.CommitIndex() != 9 {
+		t.Fatalf("Expected commit index to advance to 9: %v", leader.log.CommitIndex())
+	}
+	if leader.advanceCommitIndex() {
+		t.Fatalf("Commit index should not advance again")
+	}
+}
+
+// Ensure that clusters with an even number of servers commit only once a
+// strict majority has stored an entry and never on a tie.
+func TestServerCommitIndexEvenMemberCounts(t *testing.T) {
+	for _, n := range []int{2, 4, 6} {
+		names := []string{}
+		for i := 1; i <= n; i++ {
+			names = append(names, fmt.Sprintf("%d", i))
+		}
+		down := newTestDownSet()
+		for _, name := range names[1:] {
+			down.set(name, true)
+		}
+		servers, _ := newTestLeaderCluster(names, down)
+		leader := servers[0]
+		for i := 0; i < 9; i++ {
+			leader.log.AppendEntry(leader.log.CreateEntry(1, &TestCommand1{"foo", i}))
+		}
+		quorum := n/2 + 1
+		if leader.QuorumSize() != quorum {
+			t.Fatalf("%d servers: Unexpected quorum size: %v", n, leader.QuorumSize())
+		}
+
+		// Half of the servers have stored index 9 and one more has index 5.
+		leader.mutex.Lock()
+		for i, name := range names[1:] {
+			switch {
+			case i < quorum-2:
+				leader.peers[name].matchIndex = 9
+			case i == quorum-2:
+				leader.peers[name].matchIndex = 5
+			}
+		}
+		if !leader.advanceCommitIndex() || leader.log.CommitIndex() != 5 {
+			t.Fatalf("%d servers: Expected commit index to advance to 5: %v", n, leader.log.CommitIndex())
+		}
+
+		// A strict majority commits index 9.
+		leader.peers[names[quorum-1]].matchIndex = 9
+		if !leader.advanceCommitIndex() || leader.log.CommitIndex() != 9 {
+			t.Fatalf("%d servers: Expected commit index to advance to 9: %v", n, leader.log.CommitIndex())
+		}
+		leader.mutex.Unlock()
+		servers.Stop()
+	}
+}
+
+// Ensure that the leader explains why its commit index is not advancing.
+func TestServerCommitBlockReason(t *testing.T) {
+	down := newTestDownSet("2", "3")
+	servers, _ := newTestLeaderCluster([]string{"1", "2", "3"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.SetCommandTimeout(10 * time.Millisecond)
+	if reason := leader.CommitBlockReason(); reason != "" {
+		t.Fatalf("Unexpected reason with nothing to commit: %q", reason)
+	}
+	if reason := servers[1].CommitBlockReason(); reason != "not leader (follower)" {
+		t.Fatalf("Unexpected reason on a follower: %q", reason)
+	}
+
+	leader.Do(&TestCommand1{"foo", 10})
+	if reason := leader.CommitBlockReason(); reason != "waiting for quorum: 1/3 servers stored index 1, missing 2, 3" {
+		t.Fatalf("Unexpected reason without a quorum: %q", reason)
+	}
+
+	// An entry from an earlier term waits for one from the current term.
+	leader.mutex.Lock()
+	leader.peers["2"].matchIndex = 1
+	leader.currentTerm = 2
+	leader.mutex.Unlock()
+	if reason := leader.CommitBlockReason(); reason != "top-term requirement: index 1 stored on a quorum is from term 1, leader has no term 2 entry on a quorum yet" {
+		t.Fatalf("Unexpected reason for an earlier term: %q", reason)
+	}
+}
+
 //--------------------------------------
 // Promotion
 //--------------------------------------
@@ -135,6 +463,11 @@ func TestServerPromoteDoubleElection(t *testing.T) {
 	if success, err := leader.promote(); !(success && err == nil && leader.state == Leader && leader.currentTerm == 2) {
 		t.Fatalf("Server promotion in cluster failed: %v (%v)", leader.state, err)
 	}
+
+	// The last vote may still be in flight once a quorum has been reached.
+	for i := 0; i < 10 && (lookup["2"].VotedFor() != "1" || lookup["3"].VotedFor() != "1"); i++ {
+		time.Sleep(time.Millisecond)
+	}
 	if lookup["2"].VotedFor() != "1" {
 		t.Fatalf("Unexpected vote for server 2: %v", lookup["2"].VotedFor())
 	}
@@ -143,6 +476,206 @@ func TestServerPromoteDoubleElection(t *testing.T) {
 	}
 }
 
+// Ensure that a candidate that is denied a quorum retries after a backoff and
+// increments its term by exactly one per round.
+func TestServerPromoteRetriesWithBackoff(t *testing.T) {
+	servers, lookup := newTestCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	for _, follower := range servers[1:] {
+		follower.SetElectionTimeout(time.Second)
+		follower.electionTimer.Reset()
+	}
+	leader := servers[0]
+	leader.SetElectionBackoff(5 * time.Millisecond)
+	var mutex sync.Mutex
+	var terms []uint64
+	var times []time.Time
+	servers.SetRequestVoteHandler(func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		mutex.Lock()
+		if peer.Name() == "2" {
+			terms, times = append(terms, req.Term), append(times, time.Now())
+		}
+		mutex.Unlock()
+		if req.Term < 3 {
+			return NewRequestVoteResponse(req.Term, false), nil
+		}
+		return lookup[peer.Name()].RequestVote(req)
+	})
+
+	if success, err := leader.promote(); !(success && err == nil && leader.currentTerm == 3) {
+		t.Fatalf("Server promotion failed: %v/%v (%v)", leader.state, leader.currentTerm, err)
+	}
+	// The last vote request may still be in flight once a quorum is reached.
+	for i := 0; i < 10; i++ {
+		mutex.Lock()
+		n := len(terms)
+		mutex.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(terms, []uint64{1, 2, 3}) {
+		t.Fatalf("Unexpected election terms: %v", terms)
+	}
+	if d := times[1].Sub(times[0]); d < 5*time.Millisecond {
+		t.Fatalf("First retry did not back off: %v", d)
+	}
+	if d := times[2].Sub(times[1]); d < 10*time.Millisecond {
+		t.Fatalf("Second retry did not double its backoff: %v", d)
+	}
+}
+
+// Ensure that the votes from the last election can be inspected.
+func TestServerLastElection(t *testing.T) {
+	servers, lookup := newTestCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	lookup["3"].currentTerm, lookup["3"].votedFor = 1, "3"
+	servers.SetRequestVoteHandler(func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		if peer.Name() == "2" {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return lookup[peer.Name()].RequestVote(req)
+	})
+	leader := servers[0]
+	if success, err := leader.promote(); !(success && err == nil) {
+		t.Fatalf("Server promotion failed: %v (%v)", leader.state, err)
+	}
+	results := leader.LastElection()
+	if len(results) != 2 {
+		t.Fatalf("Unexpected vote results: %v", results)
+	}
+	if r := results[0]; r.Peer != "3" || r.Granted || r.Term != 1 || r.Err == nil || r.Err.Error() != "raft.Server: Already voted for 3" {
+		t.Fatalf("Unexpected denied vote: %v", r)
+	}
+	if r := results[1]; r.Peer != "2" || !r.Granted || r.Term != 1 || r.Err != nil {
+		t.Fatalf("Unexpected granted vote: %v", r)
+	}
+}
+
+// Ensure that lost and won election rounds are kept in a bounded history.
+func TestServerElectionHistory(t *testing.T) {
+	servers, lookup := newTestCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	for _, follower := range servers[1:] {
+		follower.SetElectionTimeout(time.Second)
+		follower.electionTimer.Reset()
+	}
+	leader := servers[0]
+	leader.SetElectionBackoff(time.Millisecond)
+	servers.SetRequestVoteHandler(func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		if req.Term < 2 {
+			return NewRequestVoteResponse(req.Term, false), nil
+		}
+		return lookup[peer.Name()].RequestVote(req)
+	})
+	if success, err := leader.promote(); !(success && err == nil) {
+		t.Fatalf("Server promotion failed: %v (%v)", leader.state, err)
+	}
+	history := leader.ElectionHistory()
+	if len(history) != 2 {
+		t.Fatalf("Unexpected election history: %v", history)
+	}
+	if r := history[0]; r.Term != 1 || r.Elected || r.VotesFor != 1 || r.VotesAgainst != 2 {
+		t.Fatalf("Unexpected lost election: %v", r)
+	}
+	if r := history[1]; r.Term != 2 || !r.Elected || r.VotesFor != 2 || r.VotesAgainst != 0 || r.Duration <= 0 {
+		t.Fatalf("Unexpected won election: %v", r)
+	}
+
+	// Only the most recent rounds are kept.
+	for i := 0; i < ElectionHistorySize; i++ {
+		leader.recordElection(ElectionRecord{Term: uint64(10 + i)})
+	}
+	history = leader.ElectionHistory()
+	if len(history) != ElectionHistorySize || history[0].Term != 10 || history[ElectionHistorySize-1].Term != uint64(9+ElectionHistorySize) {
+		t.Fatalf("Unexpected bounded election history: %v", history)
+	}
+}
+
+// Ensure that entries from an earlier term are only committed by committing an
+// entry from the current term. Otherwise a leader could commit an entry that a
+// later leader without it would overwrite.
+func TestServerPromoteCommitsPriorTermEntriesWithNoop(t *testing.T) {
+	servers, lookup := newTestCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	servers.SetRequestVoteHandler(func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		return lookup[peer.Name()].RequestVote(req)
+	})
+	servers.SetAppendEntriesHandler(func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		return lookup[peer.Name()].AppendEntries(req)
+	})
+	leader := servers[0]
+	for _, server := range servers {
+		server.SetElectionTimeout(time.Second)
+		server.electionTimer.Reset()
+	}
+
+	// An entry from term 1 is stored by every server but was never committed
+	// by the leader of term 1.
+	entries := []*LogEntry{NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})}
+	for _, server := range servers {
+		if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 0)); err != nil {
+			t.Fatalf("AppendEntries failed: %v", err)
+		}
+	}
+	if leader.CommitIndex() != 0 || lookup["2"].LastIndex() != 1 {
+		t.Fatalf("Prior term entry should have been stored but not committed: %v/%v", leader.CommitIndex(), lookup["2"].LastIndex())
+	}
+
+	// Once elected the leader commits it along with a no-op from its own term.
+	if success, err := leader.promote(); !(success && err == nil) {
+		t.Fatalf("Server promotion failed: %v (%v)", leader.State(), err)
+	}
+	for i := 0; i < 10 && leader.CommitIndex() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, _ = leader.LogEntries(1, 2)
+	if leader.CommitIndex() != 2 || len(entries) != 2 || entries[1].Type() != EntryNoop || entries[1].Term() != leader.Stats().Term {
+		t.Fatalf("Expected no-op to commit prior term entry: %v/%v", leader.CommitIndex(), entries)
+	}
+}
+
+// Ensure that an election can be started on demand.
+func TestServerStartElection(t *testing.T) {
+	servers, lookup := newTestCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	servers.SetRequestVoteHandler(func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		return lookup[peer.Name()].RequestVote(req)
+	})
+	server := servers[1]
+	if err := server.StartElection(); err != nil || server.State() != Leader {
+		t.Fatalf("Election failed: %v (%v)", server.State(), err)
+	}
+	if err := server.StartElection(); err == nil || err.Error() != "raft.Server: Cannot start election as leader" {
+		t.Fatalf("Election should not start on a leader: %v", err)
+	}
+
+	servers[2].Stop()
+	if err := servers[2].StartElection(); err == nil || err.Error() != "raft.Server: Cannot start election while stopped" {
+		t.Fatalf("Election should not start on a stopped server: %v", err)
+	}
+}
+
+// Ensure that a candidate adopts a higher term from a vote response and steps down.
+func TestServerPromoteStepsDownForHigherTerm(t *testing.T) {
+	servers, lookup := newTestCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	lookup["2"].currentTerm, lookup["3"].currentTerm = 100, 100
+	servers.SetRequestVoteHandler(func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		return lookup[peer.Name()].RequestVote(req)
+	})
+	leader := servers[0]
+	if success, err := leader.promote(); !(!success && err != nil && err.Error() == "raft.Server: Higher term discovered, stepping down: (100 > 1)") {
+		t.Fatalf("Server promotion should have failed: %v (%v)", leader.state, err)
+	}
+	if leader.currentTerm != 100 || leader.state != Follower || leader.VotedFor() != "" {
+		t.Fatalf("Server did not adopt the higher term: %v/%v/%v", leader.currentTerm, leader.state, leader.VotedFor())
+	}
+}
+
 //--------------------------------------
 // Append Entries
 //--------------------------------------
@@ -185,66 +718,307 @@ func TestServerAppendEntries(t *testing.T) {
 	server.Stop()
 }
 
-// Ensure that entries with stale terms are rejected.
-func TestServerAppendEntriesWithStaleTermsAreRejected(t *testing.T) {
+// Ensure that entries from a leader using our name are rejected.
+func TestServerAppendEntriesRejectedForDuplicateName(t *testing.T) {
 	server := newTestServer("1")
 	server.Start()
 	defer server.Stop()
-	server.currentTerm = 2
 
-	// Append single entry.
 	entries := []*LogEntry{NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})}
-	resp, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 0))
-	if !(resp.Term == 2 && !resp.Success && err != nil && err.Error() == "raft.Server: Stale request term") {
-		t.Fatalf("AppendEntries should have failed: %v/%v : %v", resp.Term, resp.Success, err)
-	}
-	if index, term := server.log.CommitInfo(); !(index == 0 && term == 0) {
-		t.Fatalf("Invalid commit info [IDX=%v, TERM=%v]", index, term)
+	resp, err := server.AppendEntries(NewAppendEntriesRequest(1, "1", 0, 0, entries, 0))
+	if !(resp.Term == 0 && !resp.Success && err == ErrDuplicateName && server.log.CurrentIndex() == 0) {
+		t.Fatalf("Duplicate name should have been rejected: %v/%v (%v)", resp.Term, resp.Success, err)
 	}
 }
 
-// Ensure that we reject entries if the commit log is different.
-func TestServerAppendEntriesRejectedIfAlreadyCommitted(t *testing.T) {
+// Ensure that a follower recognizes the sender of an accepted AppendEntries
+// RPC as its leader until a new term begins.
+func TestServerAppendEntriesSetsLeader(t *testing.T) {
 	server := newTestServer("1")
+	if server.Leader() != "" {
+		t.Fatalf("Stopped server should not have a leader: %v", server.Leader())
+	}
 	server.Start()
 	defer server.Stop()
-
-	// Append single entry + commit.
-	entries := []*LogEntry{
-		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
-		NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15}),
+	if server.Leader() != "" {
+		t.Fatalf("Unexpected leader: %v", server.Leader())
 	}
-	resp, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 2))
-	if !(resp.Term == 1 && resp.Success && err == nil) {
-		t.Fatalf("AppendEntries failed: %v/%v : %v", resp.Term, resp.Success, err)
+	server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, []*LogEntry{}, 0))
+	if server.Leader() != "ldr" {
+		t.Fatalf("Expected leader to be set: %v", server.Leader())
 	}
-
-	// Append entry again (post-commit).
-	entries = []*LogEntry{NewLogEntry(nil, 2, 1, &TestCommand1{"bar", 20})}
-	resp, err = server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 2, 1, entries, 1))
-	if !(resp.Term == 1 && !resp.Success && err != nil && err.Error() == "raft.Log: Cannot append entry with earlier index in the same term (1:2 <= 1:2)") {
-		t.Fatalf("AppendEntries should have failed: %v/%v : %v", resp.Term, resp.Success, err)
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(0, "old", 0, 0, []*LogEntry{}, 0)); err == nil || server.Leader() != "ldr" {
+		t.Fatalf("Stale request should not change leader: %v (%v)", server.Leader(), err)
+	}
+	if success, err := server.promote(); !(success && err == nil && server.Leader() == "1") {
+		t.Fatalf("Expected server to lead itself: %v (%v)", server.Leader(), err)
 	}
 }
 
-// Ensure that we uncommitted entries are rolled back if new entries overwrite them.
-func TestServerAppendEntriesOverwritesUncommittedEntries(t *testing.T) {
+// Ensure that a request from a newer term updates the term, clears the vote and demotes the server.
+func TestServerAppendEntriesWithNewerTermDemotes(t *testing.T) {
 	server := newTestServer("1")
 	server.Start()
 	defer server.Stop()
+	server.currentTerm, server.votedFor, server.state = 2, "1", Candidate
 
-	entry1 := NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})
-	entry2 := NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15})
-	entry3 := NewLogEntry(nil, 2, 2, &TestCommand1{"bar", 20})
-
-	// Append single entry + commit.
-	entries := []*LogEntry{entry1, entry2}
-	resp, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 1))
-	if !(resp.Term == 1 && resp.Success && err == nil && server.log.CommitIndex() == 1 && reflect.DeepEqual(server.log.entries, []*LogEntry{entry1, entry2})) {
+	entries := []*LogEntry{NewLogEntry(nil, 1, 5, &TestCommand1{"foo", 10})}
+	resp, err := server.AppendEntries(NewAppendEntriesRequest(5, "ldr", 0, 0, entries, 0))
+	if !(resp.Term == 5 && resp.Success && err == nil) {
 		t.Fatalf("AppendEntries failed: %v/%v : %v", resp.Term, resp.Success, err)
 	}
-
-	// Append entry that overwrites the second (uncommitted) entry.
+	if server.currentTerm != 5 || server.VotedFor() != "" || server.State() != Follower {
+		t.Fatalf("Server did not update term and demote: %v/%v/%v", server.currentTerm, server.VotedFor(), server.State())
+	}
+	if server.log.CurrentIndex() != 1 {
+		t.Fatalf("Entries should have been appended after adopting the term: %v", server.log.CurrentIndex())
+	}
+}
+
+// Ensure that every entry is applied in order when the commit index jumps ahead.
+func TestServerAppendEntriesAppliesInOrder(t *testing.T) {
+	server := newTestServer("1")
+	applied := []int{}
+	server.ApplyFunc = func(s *Server, c Command) {
+		applied = append(applied, c.(*TestCommand1).I)
+	}
+	server.Start()
+	defer server.Stop()
+
+	entries := []*LogEntry{
+		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 2, 1, &TestCommand1{"bar", 20}),
+		NewLogEntry(nil, 3, 1, &TestCommand1{"baz", 30}),
+	}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 0)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("Uncommitted entries should not be applied: %v", applied)
+	}
+
+	// Commit all three entries at once.
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 3, 1, []*LogEntry{}, 3)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if !reflect.DeepEqual(applied, []int{10, 20, 30}) {
+		t.Fatalf("Entries applied out of order: %v", applied)
+	}
+}
+
+// Ensure that configuration entries update the peers and no-ops are not applied.
+func TestServerAppendEntriesAppliesEntryTypes(t *testing.T) {
+	server := newTestServer("1")
+	applied := []int{}
+	server.ApplyFunc = func(s *Server, c Command) {
+		applied = append(applied, c.(*TestCommand1).I)
+	}
+	server.Start()
+	defer server.Stop()
+
+	entries := []*LogEntry{
+		NewLogEntryWithType(nil, 1, 1, EntryConfiguration, &JoinCommand{Name: "2"}),
+		NewLogEntryWithType(nil, 2, 1, EntryNoop, &NoopCommand{}),
+		NewLogEntry(nil, 3, 1, &TestCommand1{"foo", 10}),
+	}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "2", 0, 0, entries, 3)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if server.peers["2"] == nil || !reflect.DeepEqual(applied, []int{10}) {
+		t.Fatalf("Unexpected apply: %v/%v", server.MemberCount(), applied)
+	}
+}
+
+// Ensure that entries with stale terms are rejected.
+func TestServerAppendEntriesWithStaleTermsAreRejected(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	server.currentTerm = 2
+
+	// Append single entry.
+	entries := []*LogEntry{NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})}
+	resp, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 0))
+	if !(resp.Term == 2 && !resp.Success && err != nil && err.Error() == "raft.Server: Stale request term") {
+		t.Fatalf("AppendEntries should have failed: %v/%v : %v", resp.Term, resp.Success, err)
+	}
+	if index, term := server.log.CommitInfo(); !(index == 0 && term == 0) {
+		t.Fatalf("Invalid commit info [IDX=%v, TERM=%v]", index, term)
+	}
+}
+
+// Ensure that entries sent with an unsupported protocol version are rejected.
+func TestServerAppendEntriesWithUnsupportedProtocolVersionAreRejected(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	entries := []*LogEntry{NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})}
+	req := NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 0)
+	req.ProtocolVersion = MaxProtocolVersion + 1
+	resp, err := server.AppendEntries(req)
+	if !(!resp.Success && err != nil && err.Error() == "raft.Server: Unsupported protocol version: 4 (MIN=1, MAX=3)") {
+		t.Fatalf("AppendEntries should have failed: %v/%v : %v", resp.Term, resp.Success, err)
+	}
+	if !server.log.IsEmpty() {
+		t.Fatalf("Entries should not have been appended")
+	}
+}
+
+// Ensure that fields introduced after a request's protocol version are
+// ignored and the request is handled as a plain request.
+func TestServerRequestFieldsIgnoredBeforeTheirProtocolVersion(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	req := NewRequestVoteRequest(1, "foo", 0, 0)
+	req.ProtocolVersion = PreVoteProtocolVersion - 1
+	req.PreVote = true
+	if resp, err := server.RequestVote(req); !(resp.Term == 1 && resp.VoteGranted && err == nil) || server.VotedFor() != "foo" {
+		t.Fatalf("Vote request should have been handled as a vote: %v/%v/%q (%v)", resp.Term, resp.VoteGranted, server.VotedFor(), err)
+	}
+
+	entries := []*LogEntry{NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})}
+	areq := NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 0)
+	areq.ProtocolVersion = CompressionProtocolVersion - 1
+	areq.Compressed = []byte("not gzipped")
+	if resp, err := server.AppendEntries(areq); !resp.Success || err != nil {
+		t.Fatalf("AppendEntries should have ignored the compressed entries: %v (%v)", resp.Success, err)
+	}
+	if server.LastIndex() != 1 {
+		t.Fatalf("Uncompressed entries should have been appended: %v", server.LastIndex())
+	}
+}
+
+// Ensure that we reject entries if the commit log is different.
+func TestServerAppendEntriesRejectedIfAlreadyCommitted(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	// Append single entry + commit.
+	entries := []*LogEntry{
+		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15}),
+	}
+	resp, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 2))
+	if !(resp.Term == 1 && resp.Success && err == nil) {
+		t.Fatalf("AppendEntries failed: %v/%v : %v", resp.Term, resp.Success, err)
+	}
+
+	// Append entry again (post-commit).
+	entries = []*LogEntry{NewLogEntry(nil, 2, 1, &TestCommand1{"bar", 20})}
+	resp, err = server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 2, 1, entries, 1))
+	if !(resp.Term == 1 && !resp.Success && err != nil && err.Error() == "raft.Log: Cannot append entry with earlier index in the same term (1:2 <= 1:2)") {
+		t.Fatalf("AppendEntries should have failed: %v/%v : %v", resp.Term, resp.Success, err)
+	}
+}
+
+// Ensure that the first diverging index between two logs can be found.
+func TestCompareLogs(t *testing.T) {
+	a, b := newTestServer("1"), newTestServer("2")
+	a.Start()
+	defer a.Stop()
+	b.Start()
+	defer b.Stop()
+
+	if index, err := CompareLogs(a, b); index != 0 || err != nil {
+		t.Fatalf("Empty logs should not diverge: %v (%v)", index, err)
+	}
+
+	entries := []*LogEntry{
+		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15}),
+		NewLogEntry(nil, 3, 2, &TestCommand1{"bar", 20}),
+	}
+	if _, err := a.AppendEntries(NewAppendEntriesRequest(2, "ldr", 0, 0, entries, 0)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if _, err := b.AppendEntries(NewAppendEntriesRequest(2, "ldr", 0, 0, entries[:2], 0)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if index, err := CompareLogs(a, b); index != 0 || err != nil {
+		t.Fatalf("Prefix should not diverge: %v (%v)", index, err)
+	}
+
+	// Same term with a different command.
+	entries = []*LogEntry{NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 99})}
+	c := newTestServer("3")
+	c.Start()
+	defer c.Stop()
+	c.AppendEntries(NewAppendEntriesRequest(2, "ldr", 0, 0, []*LogEntry{NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})}, 0))
+	c.AppendEntries(NewAppendEntriesRequest(2, "ldr", 1, 1, entries, 0))
+	if index, err := CompareLogs(a, c); index != 2 || err != nil {
+		t.Fatalf("Expected divergence at 2: %v (%v)", index, err)
+	}
+
+	// Different term.
+	entries = []*LogEntry{NewLogEntry(nil, 3, 3, &TestCommand1{"bar", 20})}
+	b.AppendEntries(NewAppendEntriesRequest(3, "ldr", 2, 1, entries, 0))
+	if index, err := CompareLogs(b, a); index != 3 || err != nil {
+		t.Fatalf("Expected divergence at 3: %v (%v)", index, err)
+	}
+}
+
+// Ensure that the committed logs of a cluster are verified to be identical.
+func TestVerifyClusterConsistency(t *testing.T) {
+	entries := []*LogEntry{
+		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15}),
+		NewLogEntry(nil, 3, 2, &TestCommand1{"bar", 20}),
+	}
+	servers := Servers{}
+	for _, name := range []string{"1", "2", "3", "4"} {
+		server := newTestServer(name)
+		server.Start()
+		defer server.Stop()
+		servers = append(servers, server)
+	}
+	a, b, c, d := servers[0], servers[1], servers[2], servers[3]
+	a.AppendEntries(NewAppendEntriesRequest(2, "ldr", 0, 0, entries, 3))
+	b.AppendEntries(NewAppendEntriesRequest(2, "ldr", 0, 0, entries, 3))
+
+	// Uncommitted entries are not compared.
+	b.AppendEntries(NewAppendEntriesRequest(2, "ldr", 3, 2, []*LogEntry{NewLogEntry(nil, 4, 2, &TestCommand1{"baz", 30})}, 3))
+	if ok, index, err := VerifyClusterConsistency(servers[:2]); !ok || index != 0 || err != nil {
+		t.Fatalf("Identical committed logs should be consistent: %v, %v (%v)", ok, index, err)
+	}
+
+	// A server that committed a different command diverges at its index.
+	c.AppendEntries(NewAppendEntriesRequest(2, "ldr", 0, 0, []*LogEntry{entries[0], NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 99}), entries[2]}, 3))
+	if ok, index, err := VerifyClusterConsistency(servers[:3]); ok || index != 2 || err != nil {
+		t.Fatalf("Expected divergence at 2: %v, %v (%v)", ok, index, err)
+	}
+
+	// A server missing committed entries diverges after its commit index.
+	d.AppendEntries(NewAppendEntriesRequest(2, "ldr", 0, 0, entries, 2))
+	if ok, index, err := VerifyClusterConsistency(Servers{a, b, d}); ok || index != 3 || err != nil {
+		t.Fatalf("Expected divergence at 3: %v, %v (%v)", ok, index, err)
+	}
+	if _, _, err := VerifyClusterConsistency(servers[:1]); err == nil {
+		t.Fatalf("A single server should be rejected")
+	}
+}
+
+// Ensure that we uncommitted entries are rolled back if new entries overwrite them.
+func TestServerAppendEntriesOverwritesUncommittedEntries(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	entry1 := NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})
+	entry2 := NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15})
+	entry3 := NewLogEntry(nil, 2, 2, &TestCommand1{"bar", 20})
+
+	// Append single entry + commit.
+	entries := []*LogEntry{entry1, entry2}
+	resp, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 1))
+	if !(resp.Term == 1 && resp.Success && err == nil && server.log.CommitIndex() == 1 && reflect.DeepEqual(server.log.entries, []*LogEntry{entry1, entry2})) {
+		t.Fatalf("AppendEntries failed: %v/%v : %v", resp.Term, resp.Success, err)
+	}
+
+	// Append entry that overwrites the second (uncommitted) entry.
 	entries = []*LogEntry{entry3}
 	resp, err = server.AppendEntries(NewAppendEntriesRequest(2, "ldr", 1, 1, entries, 2))
 	if !(resp.Term == 2 && resp.Success && err == nil && server.log.CommitIndex() == 2 && reflect.DeepEqual(server.log.entries, []*LogEntry{entry1, entry3})) {
@@ -252,10 +1026,1922 @@ func TestServerAppendEntriesOverwritesUncommittedEntries(t *testing.T) {
 	}
 }
 
+// Ensure that a duplicate delivery of a request is acknowledged without
+// truncating entries that were appended after it.
+func TestServerAppendEntriesIgnoresDuplicateEntries(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	server.SetRollbackFunc(func(entries []*LogEntry) {
+		t.Fatalf("Unexpected rollback: %v", entries)
+	})
+
+	entry1 := NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})
+	entry2 := NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15})
+	entry3 := NewLogEntry(nil, 3, 1, &TestCommand1{"bar", 20})
+	req := NewAppendEntriesRequest(1, "ldr", 0, 0, []*LogEntry{entry1, entry2}, 1)
+	if _, err := server.AppendEntries(req); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 2, 1, []*LogEntry{entry3}, 1)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+
+	resp, err := server.AppendEntries(req)
+	if !(resp.Term == 1 && resp.Success && err == nil && server.log.CommitIndex() == 1 && reflect.DeepEqual(server.log.entries, []*LogEntry{entry1, entry2, entry3})) {
+		t.Fatalf("Duplicate AppendEntries should have succeeded: %v/%v : %v (%v)", resp.Term, resp.Success, err, server.log.entries)
+	}
+
+	// A delayed heartbeat does not discard the entries after its previous
+	// entry either.
+	for _, req := range []*AppendEntriesRequest{NewAppendEntriesRequest(1, "ldr", 0, 0, nil, 1), NewAppendEntriesRequest(1, "ldr", 2, 1, nil, 1)} {
+		resp, err = server.AppendEntries(req)
+		if !(resp.Success && err == nil && reflect.DeepEqual(server.log.entries, []*LogEntry{entry1, entry2, entry3})) {
+			t.Fatalf("Delayed heartbeat should have succeeded: %v : %v (%v)", resp.Success, err, server.log.entries)
+		}
+	}
+}
+
+// Ensure that the rollback function receives only the conflicting entries
+// that are discarded.
+func TestServerAppendEntriesCallsRollbackFunc(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	var rolledBack [][]*LogEntry
+	server.SetRollbackFunc(func(entries []*LogEntry) {
+		rolledBack = append(rolledBack, entries)
+	})
+
+	entry1 := NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10})
+	entry2 := NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 15})
+	entry3 := NewLogEntry(nil, 3, 1, &TestCommand1{"foo", 20})
+	entry4 := NewLogEntry(nil, 3, 2, &TestCommand1{"bar", 25})
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, []*LogEntry{entry1, entry2, entry3}, 1)); err != nil || len(rolledBack) != 0 {
+		t.Fatalf("Initial append should not roll back: %v (%v)", rolledBack, err)
+	}
+
+	// Resending a matching entry is not a rollback but the conflict after it is.
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(2, "ldr", 1, 1, []*LogEntry{entry2, entry4}, 1)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if len(rolledBack) != 1 || !reflect.DeepEqual(rolledBack[0], []*LogEntry{entry3}) || !reflect.DeepEqual(server.log.entries, []*LogEntry{entry1, entry2, entry4}) {
+		t.Fatalf("Unexpected rollback: %v", rolledBack)
+	}
+}
+
+//--------------------------------------
+// Log Entries
+//--------------------------------------
+
+// Ensure that we can retrieve a range of log entries from a server.
+func TestServerLogEntries(t *testing.T) {
+	server := newTestServerWithLog("1",
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n"+
+			`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n"+
+			`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n")
+	server.Start()
+	defer server.Stop()
+
+	entries, err := server.LogEntries(2, 3)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Unable to retrieve entries: %v (%v)", entries, err)
+	}
+	if !(entries[0].Index() == 2 && entries[0].Term() == 1 && entries[0].CommandName() == "cmd_2") {
+		t.Fatalf("Unexpected entry[0]: %v/%v/%v", entries[0].Index(), entries[0].Term(), entries[0].CommandName())
+	}
+	if !(entries[1].Index() == 3 && entries[1].Term() == 2 && entries[1].CommandName() == "cmd_1") {
+		t.Fatalf("Unexpected entry[1]: %v/%v/%v", entries[1].Index(), entries[1].Term(), entries[1].CommandName())
+	}
+	if _, err := server.LogEntries(0, 1); err == nil || err.Error() != "raft.Log: Invalid entry range: (START=0, END=1)" {
+		t.Fatalf("Zero start index should have failed: %v", err)
+	}
+	if _, err := server.LogEntries(2, 4); err == nil || err.Error() != "raft.Log: Entry range is beyond end of log (MAX=3): (START=2, END=4)" {
+		t.Fatalf("Out-of-range end index should have failed: %v", err)
+	}
+}
+
+//--------------------------------------
+// Propose
+//--------------------------------------
+
+// Ensure that a proposal returns its index and term before it is committed.
+func TestServerPropose(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	index, term, err := server.Propose(&TestCommand1{"foo", 10})
+	if !(index == 2 && term == 1 && err == nil) {
+		t.Fatalf("Unexpected proposal: %v/%v (%v)", index, term, err)
+	}
+	for i := 0; i < 10 && server.CommitIndex() < index; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.CommitIndex() != 2 {
+		t.Fatalf("Proposal was not committed: %v", server.CommitIndex())
+	}
+}
+
+// Ensure that a proposal to a follower returns a NotLeaderError.
+func TestServerProposeNotLeader(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	_, _, err := server.Propose(&TestCommand1{"foo", 10})
+	if e, ok := err.(*NotLeaderError); !ok || e.State != Follower || err.Error() != "raft.Server: Not leader (follower)" {
+		t.Fatalf("Expected NotLeaderError: %v", err)
+	}
+	if !server.IsLogEmpty() {
+		t.Fatalf("Proposal should not have been appended")
+	}
+}
+
+// Ensure that the apply status and result of a proposal can be polled.
+func TestServerApplyStatus(t *testing.T) {
+	server := newTestServer("1")
+	server.ApplyFunc = nil
+	server.ApplyResultFunc = func(s *Server, c Command) interface{} {
+		return c.(*TestCommand1).I * 2
+	}
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	index, _, err := server.Propose(&TestCommand1{"foo", 10})
+	if err != nil {
+		t.Fatalf("Unable to propose: %v", err)
+	}
+	if applied, result, err := server.ApplyStatus(index + 1); applied || result != nil || err != nil {
+		t.Fatalf("Unexpected status for future index: %v/%v (%v)", applied, result, err)
+	}
+	for i := 0; i < 10 && server.CommitIndex() < index; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if applied, result, err := server.ApplyStatus(index); !applied || result != 20 || err != nil {
+		t.Fatalf("Unexpected status: %v/%v (%v)", applied, result, err)
+	}
+
+	// Acknowledged results are no longer retained.
+	server.AcknowledgeApplyResult(index)
+	if applied, result, err := server.ApplyStatus(index); !applied || result != nil || err != nil {
+		t.Fatalf("Unexpected status after acknowledgement: %v/%v (%v)", applied, result, err)
+	}
+}
+
+// Ensure that entries committed together are applied in batches that are
+// split around internal commands and keep index order.
+func TestServerApplyBatchFunc(t *testing.T) {
+	server := newTestServer("1")
+	server.ApplyFunc = nil
+	var batches [][]uint64
+	server.SetApplyBatchFunc(func(entries []*LogEntry) []interface{} {
+		var indices []uint64
+		var results []interface{}
+		for _, e := range entries {
+			indices = append(indices, e.Index())
+			results = append(results, e.Index()*10)
+		}
+		batches = append(batches, indices)
+		return results
+	})
+	server.Start()
+	defer server.Stop()
+
+	entries := []*LogEntry{
+		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 2, 1, &JoinCommand{Name: "2"}),
+		NewLogEntry(nil, 3, 1, &TestCommand1{"bar", 20}),
+		NewLogEntry(nil, 4, 1, &TestCommand2{100}),
+	}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 4)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if !reflect.DeepEqual(batches, [][]uint64{{1}, {3, 4}}) || server.MemberCount() != 2 {
+		t.Fatalf("Unexpected batches: %v", batches)
+	}
+	if applied, result, _ := server.ApplyStatus(4); !applied || result != uint64(40) {
+		t.Fatalf("Unexpected apply status: %v/%v", applied, result)
+	}
+}
+
+// Ensure that the oldest apply results are evicted once the cache is full.
+func TestServerApplyStatusEviction(t *testing.T) {
+	server := newTestServer("1")
+	server.applyResultCacheSize = 2
+	for i := uint64(1); i <= 3; i++ {
+		server.cacheApplyResult(i, i)
+	}
+	if _, ok := server.applyResults[1]; ok || len(server.applyResults) != 2 {
+		t.Fatalf("Unexpected cached results: %v", server.applyResults)
+	}
+}
+
+// Ensure that Do calls are counted while pending and rejected once the limit is reached.
+func TestServerMaxPendingCommands(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	release := make(chan bool)
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		<-release
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+	leader.SetMaxPendingCommands(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leader.Do(&TestCommand1{"foo", 10})
+		}()
+	}
+	for i := 0; i < 10 && leader.PendingCommandCount() < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if leader.PendingCommandCount() != 2 {
+		t.Fatalf("Unexpected pending command count: %v", leader.PendingCommandCount())
+	}
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != ErrTooManyPending {
+		t.Fatalf("Expected too many pending commands: %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	if leader.PendingCommandCount() != 0 {
+		t.Fatalf("Unexpected pending command count after commit: %v", leader.PendingCommandCount())
+	}
+}
+
+// Ensure that the proposal filter rejects commands on the leader without
+// using a log index.
+func TestServerProposalFilter(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	var filtered []Command
+	filter := func(command Command) error {
+		filtered = append(filtered, command)
+		if c, ok := command.(*TestCommand1); ok && c.I < 0 {
+			return fmt.Errorf("Negative value: %v", c.I)
+		}
+		return nil
+	}
+	leader.SetProposalFilter(filter)
+	lookup["2"].SetProposalFilter(filter)
+
+	if err := leader.Do(&TestCommand1{"foo", -1}); err == nil || err.Error() != "Negative value: -1" || leader.LastIndex() != 0 {
+		t.Fatalf("Command should have been rejected: %v (%v)", leader.LastIndex(), err)
+	}
+	if _, _, err := leader.Propose(&TestCommand1{"foo", -2}); err == nil || leader.LastIndex() != 0 {
+		t.Fatalf("Proposal should have been rejected: %v (%v)", leader.LastIndex(), err)
+	}
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil || leader.LastIndex() != 1 || leader.CommitIndex() != 1 {
+		t.Fatalf("Command should have been committed: %v/%v (%v)", leader.LastIndex(), leader.CommitIndex(), err)
+	}
+
+	// Entries replicated to the follower are not filtered again.
+	if len(filtered) != 3 || lookup["2"].LastIndex() != 1 {
+		t.Fatalf("Unexpected filtered commands: %v", filtered)
+	}
+}
+
+// Ensure that a command returns as soon as the leader steps down instead of
+// waiting for the command timeout.
+func TestServerDoReturnsLeadershipLost(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.SetCommandTimeout(time.Second)
+
+	// A new leader in term 2 reaches the followers before the command does.
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		follower := lookup[peer.Name()]
+		follower.AppendEntries(NewAppendEntriesRequest(2, "4", 0, 0, nil, 0))
+		return follower.AppendEntries(req)
+	}
+	t0 := time.Now()
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != ErrLeadershipLost {
+		t.Fatalf("Expected leadership lost: %v", err)
+	}
+	if d := time.Since(t0); d >= time.Second {
+		t.Fatalf("Command waited for the command timeout: %v", d)
+	}
+	if leader.State() != Follower || leader.currentTerm != 2 || leader.CommitIndex() != 0 {
+		t.Fatalf("Leader should have stepped down: %v/%v/%v", leader.State(), leader.currentTerm, leader.CommitIndex())
+	}
+}
+
+// Ensure that a batch of commands occupies consecutive entries and returns
+// the result of each command once all of them are applied.
+func TestServerDoBatch(t *testing.T) {
+	server := newTestServer("1")
+	server.ApplyFunc = nil
+	server.ApplyResultFunc = func(s *Server, c Command) interface{} {
+		return c.(*TestCommand1).I * 2
+	}
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	// Commands submitted concurrently are not interleaved with the batch.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server.Do(&TestCommand1{"other", i})
+		}(i)
+	}
+	results, err := server.DoBatch([]Command{&TestCommand1{"batch", 1}, &TestCommand1{"batch", 2}, &TestCommand1{"batch", 3}})
+	wg.Wait()
+	if err != nil || !reflect.DeepEqual(results, []interface{}{2, 4, 6}) {
+		t.Fatalf("Unexpected batch results: %v (%v)", results, err)
+	}
+	entries, err := server.LogEntries(1, server.LastIndex())
+	if err != nil {
+		t.Fatalf("Unable to read log: %v", err)
+	}
+	var indices []uint64
+	for _, entry := range entries {
+		if c, ok := entry.Command().(*TestCommand1); ok && c.Val == "batch" {
+			indices = append(indices, entry.Index())
+		}
+	}
+	if len(indices) != 3 || indices[1] != indices[0]+1 || indices[2] != indices[0]+2 {
+		t.Fatalf("Batch entries are not consecutive: %v", indices)
+	}
+
+	// A rejected command fails the whole batch before anything is appended.
+	server.SetProposalFilter(func(command Command) error {
+		if command.(*TestCommand1).I < 0 {
+			return fmt.Errorf("Negative value: %v", command.(*TestCommand1).I)
+		}
+		return nil
+	})
+	index := server.log.CurrentIndex()
+	if _, err := server.DoBatch([]Command{&TestCommand1{"batch", 4}, &TestCommand1{"batch", -1}}); err == nil || err.Error() != "Negative value: -1" {
+		t.Fatalf("Batch should have been rejected: %v", err)
+	}
+	if server.log.CurrentIndex() != index {
+		t.Fatalf("Rejected batch was appended: %v != %v", server.log.CurrentIndex(), index)
+	}
+}
+
+// Ensure that no results are reported for a batch when the leader steps down
+// before it is committed.
+func TestServerDoBatchLeadershipLost(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.SetCommandTimeout(time.Second)
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		follower := lookup[peer.Name()]
+		follower.AppendEntries(NewAppendEntriesRequest(2, "4", 0, 0, nil, 0))
+		return follower.AppendEntries(req)
+	}
+	results, err := leader.DoBatch([]Command{&TestCommand1{"foo", 1}, &TestCommand1{"bar", 2}})
+	if err != ErrLeadershipLost || results != nil {
+		t.Fatalf("Expected leadership lost: %v (%v)", results, err)
+	}
+	if _, err := leader.DoBatch([]Command{&TestCommand1{"baz", 3}}); err == nil || err.Error() != "raft.Server: Not leader (follower)" {
+		t.Fatalf("Follower should have rejected the batch: %v", err)
+	}
+}
+
+// Ensure that commands are refused or wait while the uncompacted log is full.
+func TestServerMaxLogEntries(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	server.SetMaxLogEntries(3, false)
+	for i := 0; i < 2; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	if err := server.Do(&TestCommand1{"bar", 20}); err != ErrLogFull || server.LastIndex() != 3 {
+		t.Fatalf("Expected log full: %v (%v)", server.LastIndex(), err)
+	}
+
+	// Compaction makes room for more commands.
+	if err := server.CompactLogTo(2); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if err := server.Do(&TestCommand1{"bar", 20}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+
+	// A blocking limit waits for compaction until the command timeout.
+	server.SetMaxLogEntries(2, true)
+	server.SetCommandTimeout(20 * time.Millisecond)
+	if err := server.Do(&TestCommand1{"baz", 30}); err != ErrLogFull {
+		t.Fatalf("Expected log full after timeout: %v", err)
+	}
+	server.SetCommandTimeout(time.Second)
+	c := make(chan error)
+	go func() {
+		c <- server.Do(&TestCommand1{"baz", 30})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := server.CompactLogTo(4); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if err := <-c; err != nil || server.LastIndex() != 5 {
+		t.Fatalf("Blocked command should have been executed: %v (%v)", server.LastIndex(), err)
+	}
+}
+
+//--------------------------------------
+// Reads
+//--------------------------------------
+
+// Ensure that a leader read confirms leadership with a quorum before reading.
+func TestServerLeaderRead(t *testing.T) {
+	down := newTestDownSet()
+	servers, _ := newTestLeaderCluster([]string{"1", "2", "3"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+
+	reads := 0
+	if err := leader.LeaderRead(func() error { reads++; return nil }); err != nil || reads != 1 {
+		t.Fatalf("Leader read failed: %v (%v)", reads, err)
+	}
+
+	// Without a quorum the leader cannot confirm it is still the leader.
+	down.set("2", true)
+	down.set("3", true)
+	if err := leader.LeaderRead(func() error { reads++; return nil }); err == nil || err.Error() != "raft.Server: Unable to confirm leadership" || reads != 1 {
+		t.Fatalf("Leader read should have failed: %v (%v)", reads, err)
+	}
+
+	// Followers cannot serve leader reads.
+	if err := servers[1].LeaderRead(func() error { return nil }); err == nil || err.Error() != "raft.Server: Not leader (follower)" {
+		t.Fatalf("Follower read should have failed: %v", err)
+	}
+}
+
+// Ensure that a leader lease skips confirmation until it expires.
+func TestServerLeaderReadWithLease(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	for _, peer := range leader.peers {
+		peer.SetHeartbeatTimeout(time.Second)
+	}
+	var mutex sync.Mutex
+	flushes := 0
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		mutex.Lock()
+		flushes++
+		mutex.Unlock()
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+	count := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return flushes
+	}
+
+	if err := leader.SetLeaderLease(TestElectionTimeout); err == nil || err.Error() != "raft.Server: Leader lease must be less than 54ms: 60ms" {
+		t.Fatalf("Lease exceeding the election timeout should have been rejected: %v", err)
+	}
+	if err := leader.SetLeaderLease(20 * time.Millisecond); err != nil {
+		t.Fatalf("Unable to set leader lease: %v", err)
+	}
+
+	// The first read confirms leadership and acquires the lease.
+	leader.LeaderRead(func() error { return nil })
+	time.Sleep(5 * time.Millisecond)
+	n := count()
+	if n == 0 {
+		t.Fatalf("Expected leadership confirmation")
+	}
+
+	// Reads within the lease are served locally.
+	leader.LeaderRead(func() error { return nil })
+	if count() != n {
+		t.Fatalf("Expected read to be served from the lease: %v != %v", count(), n)
+	}
+
+	// Once the lease expires a fresh confirmation is required.
+	time.Sleep(20 * time.Millisecond)
+	leader.LeaderRead(func() error { return nil })
+	if count() == n {
+		t.Fatalf("Expected leadership confirmation after lease expired")
+	}
+}
+
+// Ensure that a leader read waiting on the apply queue confirms leadership
+// again if the term changed before the read executes.
+func TestServerLeaderReadAcrossTermChange(t *testing.T) {
+	transport := NewInmemTransport()
+	servers := Servers{}
+	release := make(chan bool)
+	for _, name := range []string{"1", "2", "3"} {
+		server := newTestServer(name)
+		server.SetElectionTimeout(TestElectionTimeout)
+		server.SetHeartbeatTimeout(TestHeartbeatTimeout)
+		if name == "1" {
+			server.ApplyFunc = func(s *Server, c Command) {
+				if c.(*TestCommand1).I == 1 {
+					<-release
+				}
+			}
+			server.SetAsyncApply(true)
+		} else {
+			server.SetPriority(0)
+		}
+		transport.AddServer(server)
+		server.Start()
+		server.Join("1")
+		servers = append(servers, server)
+	}
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+	leader := servers[0]
+	leader.SetCommandTimeout(TestElectionTimeout)
+
+	// The read confirms leadership and then waits for the blocked entry.
+	if _, _, err := leader.Propose(&TestCommand1{"foo", 1}); err != nil {
+		t.Fatalf("Unable to propose command: %v", err)
+	}
+	time.Sleep(TestHeartbeatTimeout)
+	reads := 0
+	c := make(chan error)
+	go func() {
+		c <- leader.LeaderRead(func() error { reads++; return nil })
+	}()
+	time.Sleep(TestHeartbeatTimeout)
+
+	// Lose and regain leadership in a later term while partitioned.
+	transport.Isolate("1")
+	leader.mutex.Lock()
+	leader.currentTerm++
+	leader.mutex.Unlock()
+	close(release)
+
+	if err := <-c; err == nil || err.Error() != "raft.Server: Unable to confirm leadership" || reads != 0 {
+		t.Fatalf("Read should not have executed with the earlier confirmation: %v (%v)", reads, err)
+	}
+}
+
+//--------------------------------------
+// Commit Channel
+//--------------------------------------
+
+// Ensure that a follower read waits until the client's write is applied.
+func TestServerFollowerRead(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	leader, follower := servers[0], lookup["2"]
+
+	index, err := leader.DoWithIndex(&TestCommand1{"foo", 10})
+	if err != nil || index != 1 {
+		t.Fatalf("Unable to execute command: %v (%v)", index, err)
+	}
+	read := false
+	if err := follower.FollowerRead(index, 100*time.Millisecond, func() error { read = true; return nil }); err != nil || !read || follower.LastApplied() < index {
+		t.Fatalf("Follower read failed: %v (%v)", follower.LastApplied(), err)
+	}
+
+	// A read for an index that is never applied times out.
+	if err := follower.FollowerRead(5, 10*time.Millisecond, func() error { return nil }); err == nil || err.Error() != "raft.Server: Timed out waiting for index to be applied (1 < 5)" {
+		t.Fatalf("Follower read should have timed out: %v", err)
+	}
+}
+
+// Ensure that commands proposed before a barrier are applied when it returns.
+func TestServerBarrier(t *testing.T) {
+	down := newTestDownSet()
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+	var applied []Command
+	leader.ApplyFunc = func(s *Server, c Command) {
+		applied = append(applied, c)
+	}
+
+	if err := lookup["2"].Barrier(time.Second); err == nil || err.Error() != "raft.Server: Not leader (follower)" {
+		t.Fatalf("Barrier on a follower should have failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := leader.Propose(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to propose command: %v", err)
+		}
+	}
+	if err := leader.Barrier(time.Second); err != nil {
+		t.Fatalf("Barrier failed: %v", err)
+	}
+	leader.mutex.Lock()
+	count := len(applied)
+	leader.mutex.Unlock()
+	if count != 3 || leader.LastApplied() != 4 {
+		t.Fatalf("Proposed commands should have been applied: %v (%v)", count, leader.LastApplied())
+	}
+
+	// A barrier without a quorum times out.
+	down.set("2", true)
+	down.set("3", true)
+	if err := leader.Barrier(10 * time.Millisecond); err != ErrCommandTimeout {
+		t.Fatalf("Barrier should have timed out: %v", err)
+	}
+}
+
+// Ensure that committed entries are sent to the commit channel in order.
+func TestServerCommitChannel(t *testing.T) {
+	server := newTestServer("1")
+	server.ApplyFunc = nil
+	c := server.CommitChannel()
+	server.Start()
+
+	// The receiver can call the server while reading the channel. A stopped
+	// server reports a commit index of zero.
+	done := make(chan []uint64)
+	go func() {
+		indices := []uint64{}
+		for entry := range c {
+			if index := server.CommitIndex(); index != 0 && index < entry.Index() {
+				t.Errorf("Entry received before it was committed: %v", entry.Index())
+			}
+			indices = append(indices, entry.Index())
+		}
+		done <- indices
+	}()
+
+	entries := []*LogEntry{
+		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 2, 1, &TestCommand1{"bar", 20}),
+		NewLogEntry(nil, 3, 1, &TestCommand2{30}),
+	}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 3)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+
+	// Stopping the server closes the channel.
+	server.Stop()
+	if indices := <-done; !reflect.DeepEqual(indices, []uint64{1, 2, 3}) {
+		t.Fatalf("Unexpected committed entries: %v", indices)
+	}
+}
+
+// Ensure that the commit channel cannot be used alongside an apply function.
+func TestServerCommitChannelWithApplyFunc(t *testing.T) {
+	server := newTestServer("1")
+	defer func() {
+		if r := recover(); r != "raft.Server: Apply function and commit channel cannot both be used" {
+			t.Fatalf("Expected panic: %v", r)
+		}
+	}()
+	server.CommitChannel()
+}
+
+//--------------------------------------
+// Compaction
+//--------------------------------------
+
+// Ensure that the log can be compacted up to the commit index and the membership is kept.
+func TestServerCompactLogTo(t *testing.T) {
+	server := newTestServer("1")
+	server.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		return nil, fmt.Errorf("Server is down: %s", peer.Name())
+	}
+	server.Start()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if err := server.AddPeer("2"); err != nil {
+		t.Fatalf("Unable to add peer: %v", err)
+	}
+	if err := server.CompactLogTo(3); err == nil || err.Error() != "raft.Server: Index is not committed (2): (IDX=3)" {
+		t.Fatalf("Compacting uncommitted entries should have failed: %v", err)
+	}
+	if err := server.CompactLogTo(2); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+
+	server.Stop()
+
+	// A new server with the compacted log rebuilds the membership.
+	server, _ = NewServer("1", server.Path())
+	server.ApplyFunc = func(s *Server, c Command) {}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer server.Stop()
+	if server.CommitIndex() != 2 || server.MemberCount() != 2 || server.IsLogEmpty() {
+		t.Fatalf("Unexpected state after restart: %v/%v", server.CommitIndex(), server.MemberCount())
+	}
+	if peers, err := server.ConfigurationAt(2); err != nil || len(peers) != 2 {
+		t.Fatalf("Unexpected configuration: %v (%v)", peers, err)
+	}
+}
+
+// Ensure that a log compacted to the first index keeps its start entry when
+// the server is restarted.
+func TestServerCompactLogToFirstIndex(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if err := server.Do(&TestCommand1{"foo", 2}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if err := server.CompactLogTo(1); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+
+	server.Stop()
+
+	server, _ = NewServer("1", server.Path())
+	server.ApplyFunc = func(s *Server, c Command) {}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer server.Stop()
+	if server.log.StartIndex() != 1 || len(server.log.Entries()) != 1 {
+		t.Fatalf("Unexpected log after restart: %v/%v", server.log.StartIndex(), len(server.log.Entries()))
+	}
+	if peers, err := server.ConfigurationAt(2); err != nil || len(peers) != 1 || peers[0].Name() != "1" {
+		t.Fatalf("Unexpected configuration: %v (%v)", peers, err)
+	}
+}
+
+// Ensure that a follower whose entire log has been compacted accepts entries
+// whose previous entry is the compaction boundary and rejects them if the
+// term at the boundary does not match.
+func TestServerAppendEntriesAtCompactionBoundary(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 2; i <= 10; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	if err := server.CompactLogTo(10); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if server.log.StartIndex() != 10 || len(server.log.Entries()) != 0 {
+		t.Fatalf("Unexpected log after compaction: %v/%v", server.log.StartIndex(), len(server.log.Entries()))
+	}
+
+	// The term at the boundary must match.
+	entries := []*LogEntry{NewLogEntry(nil, 11, 2, &TestCommand1{"bar", 11})}
+	if resp, err := server.AppendEntries(NewAppendEntriesRequest(2, "2", 10, 2, entries, 11)); resp.Success || err == nil {
+		t.Fatalf("AppendEntries with a mismatched boundary term should have failed")
+	}
+
+	// A heartbeat and an append at the boundary are both accepted.
+	if resp, err := server.AppendEntries(NewAppendEntriesRequest(2, "2", 10, 1, []*LogEntry{}, 10)); !resp.Success || err != nil {
+		t.Fatalf("Heartbeat at the compaction boundary failed: %v", err)
+	}
+	if resp, err := server.AppendEntries(NewAppendEntriesRequest(2, "2", 10, 1, entries, 11)); !resp.Success || err != nil {
+		t.Fatalf("AppendEntries at the compaction boundary failed: %v", err)
+	}
+	if server.log.CurrentIndex() != 11 || server.CommitIndex() != 11 {
+		t.Fatalf("Unexpected indices: %v/%v", server.log.CurrentIndex(), server.CommitIndex())
+	}
+}
+
+// Ensure that a server restarted from a compacted log does not reapply the
+// compacted entries and refuses entries from before the compaction.
+func TestServerCompactedLogResumesApplying(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 2; i <= 50; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	if err := server.CompactLogTo(50); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	server.Stop()
+
+	var applied []Command
+	server.ApplyFunc = func(s *Server, c Command) {
+		applied = append(applied, c)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	if server.CommitIndex() != 50 || server.LastApplied() != 50 {
+		t.Fatalf("Unexpected indices after restart: %v/%v", server.CommitIndex(), server.LastApplied())
+	}
+
+	// Entries from before the compaction are committed and cannot be replaced.
+	entries := []*LogEntry{NewLogEntry(nil, 41, 5, &TestCommand1{"bar", 41})}
+	if resp, err := server.AppendEntries(NewAppendEntriesRequest(5, "2", 40, 1, entries, 41)); resp.Success || err == nil {
+		t.Fatalf("AppendEntries before the compaction should have failed: %v", err)
+	}
+
+	// Applying resumes with the entry after the compaction.
+	entries = []*LogEntry{NewLogEntry(nil, 51, 5, &TestCommand1{"bar", 51})}
+	if resp, err := server.AppendEntries(NewAppendEntriesRequest(5, "2", 50, 1, entries, 51)); !resp.Success || err != nil {
+		t.Fatalf("AppendEntries after the compaction failed: %v", err)
+	}
+	if !reflect.DeepEqual(applied, []Command{&TestCommand1{"bar", 51}}) || server.LastApplied() != 51 {
+		t.Fatalf("Unexpected applied commands: %v (%v)", applied, server.LastApplied())
+	}
+}
+
+//--------------------------------------
+// Backup
+//--------------------------------------
+
+// Ensure that an exported log, including a compacted start, can be imported
+// into a fresh server and that corrupt or conflicting imports are refused.
+func TestServerExportImportLog(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 2; i <= 5; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	if err := server.CompactLogTo(3); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	var b bytes.Buffer
+	if err := server.ExportLog(&b); err != nil {
+		t.Fatalf("Unable to export log: %v", err)
+	}
+	if err := server.ImportLog(bytes.NewReader(b.Bytes())); err == nil || err.Error() != "raft.Server: Cannot import log while running" {
+		t.Fatalf("Import into a running server should have failed: %v", err)
+	}
+
+	restored := newTestServer("1")
+	if err := restored.ImportLog(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatalf("Unable to import log: %v", err)
+	}
+	if err := restored.ImportLog(bytes.NewReader(b.Bytes())); err == nil || err.Error() != "raft.Server: raft.Log: Cannot import into a non-empty log" {
+		t.Fatalf("Import into a non-empty log should have failed: %v", err)
+	}
+	if err := restored.Start(); err != nil {
+		t.Fatalf("Unable to start restored server: %v", err)
+	}
+	defer restored.Stop()
+	if restored.CommitIndex() != 5 || restored.FirstIndex() != 4 || restored.MemberCount() != 1 {
+		t.Fatalf("Unexpected restored log: %v/%v/%v", restored.CommitIndex(), restored.FirstIndex(), restored.MemberCount())
+	}
+	original, _ := server.LogEntries(4, 5)
+	entries, _ := restored.LogEntries(4, 5)
+	for i := range entries {
+		if entries[i].Index() != original[i].Index() || entries[i].Term() != original[i].Term() || !reflect.DeepEqual(entries[i].Command(), original[i].Command()) {
+			t.Fatalf("Unexpected restored entry: %v", entries[i])
+		}
+	}
+
+	// A corrupted entry fails the import without writing a log.
+	corrupt := bytes.Replace(b.Bytes(), []byte(`"i":5`), []byte(`"i":6`), 1)
+	other := newTestServer("1")
+	if err := other.ImportLog(bytes.NewReader(corrupt)); err == nil || !strings.Contains(err.Error(), "Invalid checksum") {
+		t.Fatalf("Corrupted import should have failed: %v", err)
+	}
+	if _, err := os.Stat(other.LogPath()); !os.IsNotExist(err) {
+		t.Fatalf("Failed import should not have written a log: %v", err)
+	}
+
+	// A backup that begins after the start of the log is refused.
+	tail := b.Bytes()[bytes.IndexByte(b.Bytes(), '\n')+1:]
+	if err := other.ImportLog(bytes.NewReader(tail)); err == nil || err.Error() != "raft.Server: raft.Log: Import does not begin at the start of the log: (IDX=4)" {
+		t.Fatalf("Import of a partial log should have failed: %v", err)
+	}
+	if _, err := os.Stat(other.LogPath()); !os.IsNotExist(err) {
+		t.Fatalf("Failed import should not have written a log: %v", err)
+	}
+}
+
+// Ensure that the committed commands of a stopped server can be replayed
+// without applying them to the server.
+func TestServerReplayInto(t *testing.T) {
+	server := newTestServer("1")
+	var applied []Command
+	server.ApplyFunc = func(s *Server, c Command) {
+		applied = append(applied, c)
+	}
+	server.Start()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 2; i <= 4; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	if err := server.ReplayInto(func(*LogEntry) {}); err == nil || err.Error() != "raft.Server: Cannot replay log while running" {
+		t.Fatalf("Replay while running should have failed: %v", err)
+	}
+	server.Stop()
+
+	var replayed []Command
+	var indices []uint64
+	err := server.ReplayInto(func(entry *LogEntry) {
+		replayed = append(replayed, entry.Command())
+		indices = append(indices, entry.Index())
+	})
+	if err != nil {
+		t.Fatalf("Unable to replay log: %v", err)
+	}
+	if !reflect.DeepEqual(replayed, applied) || !reflect.DeepEqual(indices, []uint64{2, 3, 4}) {
+		t.Fatalf("Unexpected replayed commands: %v (%v)", replayed, indices)
+	}
+	if len(applied) != 3 || server.LastApplied() != 4 {
+		t.Fatalf("Replay changed the server: %v (%v)", applied, server.LastApplied())
+	}
+}
+
+// Ensure that committed commands whose type is not registered are handled by
+// the unknown command policy.
+func TestServerUnknownCommandPolicy(t *testing.T) {
+	var b bytes.Buffer
+	for _, entry := range []*LogEntry{
+		NewLogEntry(nil, 1, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 2, 1, &UnknownCommand{Name: "test:missing", Data: []byte(`{"x":1}`)}),
+		NewLogEntry(nil, 3, 1, &TestCommand1{"bar", 20}),
+	} {
+		if err := entry.Encode(&b); err != nil {
+			t.Fatalf("Unable to encode entry: %v", err)
+		}
+	}
+	encoded := b.String()
+
+	var applied []Command
+	setup := func(policy UnknownCommandPolicy) (*Server, *AppendEntriesRequest) {
+		server := newTestServer("1")
+		applied = nil
+		server.ApplyFunc = func(s *Server, c Command) {
+			applied = append(applied, c)
+		}
+		if err := server.SetUnknownCommandPolicy(policy); err != nil {
+			t.Fatalf("Unable to set policy: %v", err)
+		}
+		server.Start()
+
+		var entries []*LogEntry
+		r := bufio.NewReader(strings.NewReader(encoded))
+		for i := 0; i < 3; i++ {
+			entry := NewLogEntry(server.log, 0, 0, nil)
+			if _, err := entry.Decode(r); err != nil {
+				t.Fatalf("Unable to decode entry: %v", err)
+			}
+			entries = append(entries, entry)
+		}
+		return server, NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 3)
+	}
+
+	// Fail stops applying at the unknown command.
+	server, req := setup(UnknownCommandFail)
+	if _, err := server.AppendEntries(req); err == nil || err.Error() != "raft.Log: Unknown command (test:missing) at index 2" {
+		t.Fatalf("Commit should have failed: %v", err)
+	}
+	if server.CommitIndex() != 1 || !reflect.DeepEqual(applied, []Command{&TestCommand1{"foo", 10}}) {
+		t.Fatalf("Unexpected apply after failure: %v (%v)", applied, server.CommitIndex())
+	}
+	server.Stop()
+
+	// Skip commits the unknown command without applying it and keeps it in
+	// the log across a restart.
+	server, req = setup(UnknownCommandSkip)
+	if _, err := server.AppendEntries(req); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if server.CommitIndex() != 3 || !reflect.DeepEqual(applied, []Command{&TestCommand1{"foo", 10}, &TestCommand1{"bar", 20}}) {
+		t.Fatalf("Unexpected apply after skip: %v (%v)", applied, server.CommitIndex())
+	}
+	server.Stop()
+	server.Start()
+	if command, ok := server.log.entries[1].command.(*UnknownCommand); !ok || command.Name != "test:missing" || string(command.Data) != `{"x":1}` {
+		t.Fatalf("Unknown command not kept: %v", server.log.entries[1].command)
+	}
+	server.Stop()
+
+	// Panic panics at the unknown command.
+	server, req = setup(UnknownCommandPanic)
+	func() {
+		defer func() {
+			if r := recover(); r != "raft.Log: Unknown command (test:missing) at index 2" {
+				t.Fatalf("Expected panic: %v", r)
+			}
+		}()
+		server.AppendEntries(req)
+	}()
+	server.Stop()
+
+	if err := newTestServer("2").SetUnknownCommandPolicy("bogus"); err == nil || err.Error() != "raft.Server: raft.Log: Invalid unknown command policy: bogus" {
+		t.Fatalf("Invalid policy should have been rejected: %v", err)
+	}
+}
+
+//--------------------------------------
+// Reset
+//--------------------------------------
+
+// Ensure that the first and last index account for compacted entries and are
+// read back from the log after a restart.
+func TestServerFirstAndLastIndex(t *testing.T) {
+	server := newTestServer("1")
+	if server.FirstIndex() != 0 || server.LastIndex() != 0 {
+		t.Fatalf("Unexpected indices on stopped server: %v/%v", server.FirstIndex(), server.LastIndex())
+	}
+	server.Start()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	if server.FirstIndex() != 1 || server.LastIndex() != 4 {
+		t.Fatalf("Unexpected indices: %v/%v", server.FirstIndex(), server.LastIndex())
+	}
+	if err := server.CompactLogTo(2); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if server.FirstIndex() != 3 || server.LastIndex() != 4 {
+		t.Fatalf("Unexpected indices after compaction: %v/%v", server.FirstIndex(), server.LastIndex())
+	}
+	server.Stop()
+	if server.FirstIndex() != 0 || server.LastIndex() != 0 {
+		t.Fatalf("Unexpected indices on stopped server: %v/%v", server.FirstIndex(), server.LastIndex())
+	}
+
+	server.Start()
+	defer server.Stop()
+	if server.FirstIndex() != 3 || server.LastIndex() != 4 {
+		t.Fatalf("Unexpected indices after restart: %v/%v", server.FirstIndex(), server.LastIndex())
+	}
+}
+
+// Ensure that entries can be matched by index and term across compaction.
+func TestServerHasEntry(t *testing.T) {
+	server := newTestServer("1")
+	if server.HasEntry(1, 0) {
+		t.Fatalf("A stopped server should not have entries")
+	}
+	server.Start()
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	term := server.currentTerm
+	if !server.HasEntry(2, term) || server.HasEntry(2, term+1) || server.HasEntry(4, term) || server.HasEntry(0, 0) {
+		t.Fatalf("Unexpected entries before compaction")
+	}
+
+	// The compacted boundary still matches but earlier entries do not.
+	if err := server.CompactLogTo(2); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if !server.HasEntry(2, term) || !server.HasEntry(3, term) || server.HasEntry(1, term) {
+		t.Fatalf("Unexpected entries after compaction")
+	}
+}
+
+// Ensure that the server stats are read consistently and serialize to JSON.
+func TestServerStats(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	leader, follower := servers[0], lookup["2"]
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+
+	stats := leader.Stats()
+	if stats.Name != "1" || stats.State != Leader || stats.Term != 1 || stats.Leader != "1" || stats.CommitIndex != 1 || stats.LastApplied != 1 || stats.Uptime <= 0 {
+		t.Fatalf("Unexpected leader stats: %v", stats)
+	}
+	stats = follower.Stats()
+	if stats.State != Follower || stats.Term != 1 || stats.Leader != "1" || stats.LastContact.IsZero() {
+		t.Fatalf("Unexpected follower stats: %v", stats)
+	}
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatalf("Unable to encode stats: %v", err)
+	}
+	var decoded ServerStats
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Unable to decode stats: %v", err)
+	}
+	if !decoded.LastContact.Equal(stats.LastContact) {
+		t.Fatalf("Unexpected decoded last contact: %v != %v", decoded.LastContact, stats.LastContact)
+	}
+	decoded.LastContact, stats.LastContact = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(decoded, stats) {
+		t.Fatalf("Unexpected decoded stats: %v != %v", decoded, stats)
+	}
+
+	follower.Stop()
+	if stats = follower.Stats(); stats.CommitIndex != 0 || stats.Uptime != 0 {
+		t.Fatalf("Unexpected stats on stopped server: %v", stats)
+	}
+}
+
+// Ensure that a stopped server can be reset and started again as a new server.
+func TestServerReset(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if err := server.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if err := server.Reset(); err == nil || err.Error() != "raft.Server: Cannot reset while running" {
+		t.Fatalf("Reset should have been refused while running: %v", err)
+	}
+
+	// Restarting without a reset keeps the log.
+	server.Stop()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to restart server: %v", err)
+	}
+	if server.CommitIndex() != 2 {
+		t.Fatalf("Log should have been reloaded: %v", server.CommitIndex())
+	}
+	for i := 0; i < 50 && server.State() != Leader; i++ {
+		time.Sleep(TestElectionTimeout / 10)
+	}
+	if len(server.ElectionHistory()) == 0 || server.ElectionsPerMinute() == 0 {
+		t.Fatalf("Restarted server should have stood for election: %v", server.State())
+	}
+
+	server.Stop()
+	if err := server.Reset(); err != nil {
+		t.Fatalf("Unable to reset: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer server.Stop()
+	if !server.IsLogEmpty() || server.currentTerm != 0 || server.VotedFor() != "" || server.MemberCount() != 1 {
+		t.Fatalf("Server was not reset: %v/%v/%v/%v", server.IsLogEmpty(), server.currentTerm, server.VotedFor(), server.MemberCount())
+	}
+	if len(server.ElectionHistory()) != 0 || len(server.LastElection()) != 0 || server.ElectionsPerMinute() != 0 {
+		t.Fatalf("Election history was not reset: %v/%v", server.ElectionHistory(), server.ElectionsPerMinute())
+	}
+	if err := server.Join("1"); err != nil || server.State() != Leader || server.CommitIndex() != 1 {
+		t.Fatalf("Unable to join after reset: %v/%v (%v)", server.State(), server.CommitIndex(), err)
+	}
+}
+
+//--------------------------------------
+// Heartbeat
+//--------------------------------------
+
+// Ensure that replicating entries counts as a heartbeat without starving idle peers.
+func TestServerHeartbeatSuppressedByReplication(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	var mutex sync.Mutex
+	flushes := 0
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		mutex.Lock()
+		flushes++
+		mutex.Unlock()
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+	count := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return flushes
+	}
+
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	n := count()
+
+	// A heartbeat timeout that fired while entries were replicated is skipped.
+	leader.peers["2"].heartbeatTimer.C() <- time.Now()
+	time.Sleep(5 * time.Millisecond)
+	if count() != n {
+		t.Fatalf("Heartbeat should have been suppressed: %v != %v", count(), n)
+	}
+
+	// An idle peer still receives heartbeats.
+	time.Sleep(TestHeartbeatTimeout * 2)
+	if count() == n {
+		t.Fatalf("Expected heartbeat to idle peer")
+	}
+}
+
+// Ensure that a slow peer that is far behind is sent bounded windows of
+// entries and still catches up.
+func TestServerMaxInflightEntries(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	for i := 0; i < 5; i++ {
+		leader.log.AppendEntry(leader.log.CreateEntry(1, &TestCommand1{"foo", i}))
+	}
+	var mutex sync.Mutex
+	max := 0
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		time.Sleep(2 * time.Millisecond)
+		mutex.Lock()
+		if len(req.Entries) > max {
+			max = len(req.Entries)
+		}
+		mutex.Unlock()
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+	leader.SetMaxInflightEntries(2)
+
+	if err := leader.Do(&TestCommand1{"bar", 5}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if max != 2 || lookup["2"].log.CurrentIndex() != 6 || leader.CommitIndex() != 6 {
+		t.Fatalf("Unexpected replication: max=%v, follower=%v, commit=%v", max, lookup["2"].log.CurrentIndex(), leader.CommitIndex())
+	}
+}
+
+// Ensure that a replication backlog is sent in requests of bounded size and
+// that the match index advances after each one.
+func TestServerMaxEntriesPerRequest(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.peers["2"].pause()
+	for i := 0; i < 9; i++ {
+		leader.log.AppendEntry(leader.log.CreateEntry(1, &TestCommand1{"foo", i}))
+	}
+	var mutex sync.Mutex
+	var sizes []int
+	var matchIndices []uint64
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(req.Entries) > 0 {
+			sizes = append(sizes, len(req.Entries))
+			matchIndices = append(matchIndices, peer.matchIndex)
+		}
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+	leader.SetMaxEntriesPerRequest(3)
+
+	if err := leader.Do(&TestCommand1{"bar", 9}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(sizes, []int{3, 3, 3, 1}) || !reflect.DeepEqual(matchIndices, []uint64{0, 3, 6, 9}) {
+		t.Fatalf("Unexpected requests: sizes=%v, match=%v", sizes, matchIndices)
+	}
+	if lookup["2"].log.CurrentIndex() != 10 || leader.CommitIndex() != 10 {
+		t.Fatalf("Unexpected replication: follower=%v, commit=%v", lookup["2"].log.CurrentIndex(), leader.CommitIndex())
+	}
+}
+
+// Ensure that an RPC to a hung peer times out without stopping heartbeats and
+// that Do only waits for the command timeout.
+func TestServerRPCAndCommandTimeouts(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.SetRPCTimeout(5 * time.Millisecond)
+	leader.SetCommandTimeout(30 * time.Millisecond)
+	hung := make(chan bool)
+	defer close(hung)
+	var mutex sync.Mutex
+	hungRequests := 0
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		mutex.Lock()
+		isHung := peer.Name() == "3" || len(req.Entries) > 0 && req.Entries[0].index > 1
+		if peer.Name() == "3" {
+			hungRequests++
+		}
+		mutex.Unlock()
+		if isHung {
+			<-hung
+		}
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+
+	// A hung peer fails once the RPC timeout expires.
+	t0 := time.Now()
+	if _, _, err := leader.peers["3"].flush(); err == nil || err.Error() != "raft.Peer: RPC timed out: 3" || time.Since(t0) > 20*time.Millisecond {
+		t.Fatalf("Expected RPC to time out: %v (%v)", err, time.Since(t0))
+	}
+
+	// A command stored on a quorum is committed despite the hung peer.
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil || leader.log.CommitIndex() != 1 {
+		t.Fatalf("Command should have been committed: %v (%v)", leader.log.CommitIndex(), err)
+	}
+
+	// Without a quorum Do returns once the command timeout expires.
+	t0 = time.Now()
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != ErrCommandTimeout || leader.log.CommitIndex() != 1 {
+		t.Fatalf("Command should not have been committed: %v (%v)", leader.log.CommitIndex(), err)
+	}
+	if d := time.Since(t0); d < 30*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("Unexpected command wait: %v", d)
+	}
+
+	// The hung peer is still retried on each heartbeat.
+	mutex.Lock()
+	n := hungRequests
+	mutex.Unlock()
+	time.Sleep(TestHeartbeatTimeout * 3)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if hungRequests <= n {
+		t.Fatalf("Expected hung peer to be retried: %v <= %v", hungRequests, n)
+	}
+}
+
+// Ensure that a paused peer receives no entries but still counts towards the
+// quorum size.
+func TestServerPauseReplication(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	if err := leader.PauseReplication("4"); err != ErrUnknownPeer {
+		t.Fatalf("Unknown peer should have been rejected: %v", err)
+	}
+
+	// The remaining servers still form a quorum.
+	leader.PauseReplication("2")
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil || leader.CommitIndex() != 1 {
+		t.Fatalf("Command should have been committed: %v (%v)", leader.CommitIndex(), err)
+	}
+	time.Sleep(TestHeartbeatTimeout * 2)
+	if lookup["2"].log.CurrentIndex() != 0 || lookup["3"].log.CurrentIndex() != 1 {
+		t.Fatalf("Unexpected replication: %v/%v", lookup["2"].log.CurrentIndex(), lookup["3"].log.CurrentIndex())
+	}
+
+	// Without the paused peer there is no quorum.
+	leader.PauseReplication("3")
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != ErrCommandTimeout || leader.CommitIndex() != 1 || leader.MemberCount() != 3 {
+		t.Fatalf("Command should not have been committed: %v (%v)", leader.CommitIndex(), err)
+	}
+
+	// A resumed peer is caught up.
+	leader.ResumeReplication("2")
+	if err := leader.Do(&TestCommand1{"baz", 30}); err != nil || leader.CommitIndex() != 3 || lookup["2"].log.CurrentIndex() != 3 {
+		t.Fatalf("Resumed peer should have been caught up: %v/%v (%v)", leader.CommitIndex(), lookup["2"].log.CurrentIndex(), err)
+	}
+}
+
+// Ensure that a peer that stops answering requests is flagged as unreachable.
+func TestServerPeerStatus(t *testing.T) {
+	down := newTestDownSet("3")
+	servers, _ := newTestLeaderCluster([]string{"1", "2", "3"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.SetElectionTimeout(10 * time.Millisecond)
+	leader.electionTimer.Pause()
+	if _, err := leader.PeerStatus("4"); err != ErrUnknownPeer {
+		t.Fatalf("Unknown peer should have been rejected: %v", err)
+	}
+
+	// Keep sending requests until the down peer has missed enough of them.
+	for i := 0; i < 5; i++ {
+		if err := leader.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, _ := leader.PeerStatus("2")
+	if !status.Reachable || status.LastAck.IsZero() || status.MatchIndex != 5 {
+		t.Fatalf("Unexpected status for reachable peer: %v", status)
+	}
+	status, _ = leader.PeerStatus("3")
+	if status.Reachable || !status.LastAck.IsZero() || status.LastAttempt.IsZero() || status.MatchIndex != 0 {
+		t.Fatalf("Unexpected status for unreachable peer: %v", status)
+	}
+
+	// A single response makes the peer reachable again.
+	down.set("3", false)
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if status, _ = leader.PeerStatus("3"); status.Reachable {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !status.Reachable || status.LastAck.IsZero() {
+		t.Fatalf("Unexpected status for recovered peer: %v", status)
+	}
+}
+
+// Ensure that large batches of entries are compressed for peers that support
+// it and are restored by the follower.
+func TestServerCompressesLargeAppendEntries(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.SetCompressionThreshold(512)
+	lookup["2"].SetProtocolVersion(MinProtocolVersion, MinProtocolVersion)
+
+	// Compressed requests are sent over the wire as JSON.
+	var mutex sync.Mutex
+	compressed := map[string]int{}
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		if req.Compressed != nil {
+			if len(req.Entries) > 0 || req.ProtocolVersion < CompressionProtocolVersion {
+				return nil, fmt.Errorf("Unexpected compressed request: %v/%v", len(req.Entries), req.ProtocolVersion)
+			}
+			b, _ := json.Marshal(req)
+			req = &AppendEntriesRequest{}
+			if err := json.Unmarshal(b, req); err != nil {
+				return nil, err
+			}
+			mutex.Lock()
+			compressed[peer.Name()]++
+			mutex.Unlock()
+		}
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+
+	// The first request downgrades the protocol used with server 2.
+	if err := leader.Do(&TestCommand1{"foo", 0}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	for i := 0; i < 10 && leader.peers["2"].ProtocolVersion() != MinProtocolVersion; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if version := leader.peers["2"].ProtocolVersion(); version != MinProtocolVersion {
+		t.Fatalf("Unexpected protocol version: %v", version)
+	}
+
+	// Single commands are below the threshold.
+	leader.PauseReplication("3")
+	for i := 1; i < 20; i++ {
+		if err := leader.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	mutex.Lock()
+	if len(compressed) != 0 {
+		t.Fatalf("Unexpected compressed requests: %v", compressed)
+	}
+	mutex.Unlock()
+
+	// Catching up the paused peer sends the whole batch.
+	leader.ResumeReplication("3")
+	time.Sleep(TestHeartbeatTimeout * 2)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if compressed["2"] != 0 || compressed["3"] == 0 {
+		t.Fatalf("Unexpected compressed requests: %v", compressed)
+	}
+	entries, err := lookup["3"].LogEntries(1, 20)
+	if err != nil || len(entries) != 20 {
+		t.Fatalf("Unexpected entries: %v (%v)", len(entries), err)
+	}
+	for i, entry := range entries {
+		if entry.Index() != uint64(i+1) || entry.Term() != 1 || !reflect.DeepEqual(entry.Command(), &TestCommand1{"foo", i}) {
+			t.Fatalf("Unexpected entry: %v/%v %v", entry.Index(), entry.Term(), entry.Command())
+		}
+	}
+}
+
+// Ensure that commit latency and replication round trip times are reported
+// to the metrics sink.
+func TestServerMetricsSink(t *testing.T) {
+	down := newTestDownSet("3")
+	servers, _ := newTestLeaderCluster([]string{"1", "2", "3"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+	metrics := newTestMetricsSink()
+	leader.SetMetricsSink(metrics)
+
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if metrics.count(MetricCommitLatency) != 1 || metrics.count(MetricReplicationRTT+"2") == 0 || metrics.count(MetricReplicationRTT+"3") != 0 {
+		t.Fatalf("Unexpected metrics: %v", metrics.durations)
+	}
+
+	// Commands that are not committed do not report a commit latency.
+	down.set("2", true)
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != ErrCommandTimeout {
+		t.Fatalf("Command should have timed out: %v", err)
+	}
+	if metrics.count(MetricCommitLatency) != 1 {
+		t.Fatalf("Unexpected commit latency: %v", metrics.durations[MetricCommitLatency])
+	}
+}
+
+// Ensure that the highest priority server is elected and that a server with
+// no priority never starts an election.
+func TestServerPriorityElection(t *testing.T) {
+	transport := NewInmemTransport()
+	priorities := map[string]int{"1": DefaultPriority, "2": 5, "3": 0}
+	servers, lookup := Servers{}, map[string]*Server{}
+	for _, name := range []string{"1", "2", "3"} {
+		server := newTestServer(name)
+		server.SetElectionTimeout(TestElectionTimeout)
+		server.SetHeartbeatTimeout(TestHeartbeatTimeout)
+		server.SetPriority(priorities[name])
+		transport.AddServer(server)
+		server.Start()
+		if err := server.Join("1"); err != nil {
+			t.Fatalf("Unable to join server[%s]: %v", name, err)
+		}
+		servers, lookup[name] = append(servers, server), server
+	}
+	defer servers.Stop()
+	time.Sleep(TestHeartbeatTimeout * 2)
+
+	// The priorities are recorded in the membership.
+	peers, err := lookup["1"].ConfigurationAt(lookup["1"].CommitIndex())
+	if err != nil || len(peers) != 3 {
+		t.Fatalf("Unexpected configuration: %v (%v)", peers, err)
+	}
+	for _, peer := range peers {
+		if peer.Priority() != priorities[peer.Name()] {
+			t.Fatalf("Unexpected priority for %s: %v", peer.Name(), peer.Priority())
+		}
+	}
+
+	// Server 3 defers to the higher priority server and never stands itself.
+	transport.Isolate("1")
+	for i := 0; i < 100 && lookup["2"].State() != Leader; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lookup["2"].State() != Leader || lookup["3"].State() != Follower || len(lookup["3"].LastElection()) != 0 {
+		t.Fatalf("Unexpected states: %v/%v", lookup["2"].State(), lookup["3"].State())
+	}
+
+	// Compaction keeps the priorities.
+	index := lookup["3"].CommitIndex()
+	if err := lookup["3"].CompactLogTo(index); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if peers, err := lookup["3"].ConfigurationAt(index); err != nil || len(peers) != 3 {
+		t.Fatalf("Unexpected configuration after compaction: %v (%v)", peers, err)
+	} else {
+		for _, peer := range peers {
+			if peer.Priority() != priorities[peer.Name()] {
+				t.Fatalf("Unexpected priority for %s after compaction: %v", peer.Name(), peer.Priority())
+			}
+		}
+	}
+}
+
+// Ensure that elections and commits require servers carrying more than half
+// of the total weight.
+func TestServerWeightedQuorum(t *testing.T) {
+	transport := NewInmemTransport()
+	weights := map[string]int{"1": 2, "2": 1, "3": 1}
+	servers, lookup := Servers{}, map[string]*Server{}
+	for _, name := range []string{"1", "2", "3"} {
+		server := newTestServer(name)
+		server.SetElectionTimeout(TestElectionTimeout)
+		server.SetHeartbeatTimeout(TestHeartbeatTimeout)
+		if err := server.SetWeight(weights[name]); err != nil {
+			t.Fatalf("Unable to set weight: %v", err)
+		}
+		transport.AddServer(server)
+		server.Start()
+		if err := server.Join("1"); err != nil {
+			t.Fatalf("Unable to join server[%s]: %v", name, err)
+		}
+		servers, lookup[name] = append(servers, server), server
+	}
+	defer servers.Stop()
+	time.Sleep(TestHeartbeatTimeout * 2)
+	if err := lookup["1"].SetWeight(0); err == nil || err.Error() != "raft.Server: Invalid weight: 0" {
+		t.Fatalf("Zero weight should have been rejected: %v", err)
+	}
+
+	peers, err := lookup["2"].ConfigurationAt(lookup["2"].CommitIndex())
+	if err != nil || len(peers) != 3 {
+		t.Fatalf("Unexpected configuration: %v (%v)", peers, err)
+	}
+	for _, peer := range peers {
+		if peer.Weight() != weights[peer.Name()] {
+			t.Fatalf("Unexpected weight for %s: %v", peer.Name(), peer.Weight())
+		}
+	}
+
+	// The heavy leader and one other server carry 3 of 4.
+	transport.Isolate("3")
+	if err := lookup["1"].Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	index := lookup["1"].CommitIndex()
+
+	// The heavy leader alone carries only half of the weight.
+	transport.Isolate("2")
+	if _, _, err := lookup["1"].Propose(&TestCommand1{"bar", 20}); err != nil {
+		t.Fatalf("Unable to propose command: %v", err)
+	}
+	time.Sleep(TestElectionTimeout)
+	if lookup["1"].CommitIndex() != index {
+		t.Fatalf("Command committed without a weighted majority: %v > %v", lookup["1"].CommitIndex(), index)
+	}
+
+	// The two light servers cannot elect a leader without the heavy one.
+	transport.Isolate("1")
+	transport.Reconnect("2")
+	transport.Reconnect("3")
+	time.Sleep(TestElectionTimeout * 5)
+	if lookup["2"].State() == Leader || lookup["3"].State() == Leader {
+		t.Fatalf("Leader elected without a weighted majority: 2=%v, 3=%v", lookup["2"].State(), lookup["3"].State())
+	}
+}
+
+// Ensure that the leader commits the removal of a peer that has been
+// unreachable past the auto-eviction timeout without shrinking the cluster
+// below its minimum size.
+func TestServerAutoEvictUnreachablePeer(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	leader := servers[0]
+	time.Sleep(TestHeartbeatTimeout * 2)
+
+	if err := leader.SetAutoEvictMinSize(0); err == nil || err.Error() != "raft.Server: Invalid minimum cluster size: 0" {
+		t.Fatalf("Invalid minimum size should have been rejected: %v", err)
+	}
+	leader.SetAutoEvictTimeout(TestElectionTimeout * 2)
+	transport.Isolate("3")
+
+	// The default minimum size keeps a three server cluster intact. The
+	// membership is read through PeerStatus since it takes the server lock.
+	time.Sleep(TestElectionTimeout * 4)
+	if _, err := leader.PeerStatus("3"); err != nil {
+		t.Fatalf("Peer evicted below the minimum size: %v", err)
+	}
+
+	if err := leader.SetAutoEvictMinSize(2); err != nil {
+		t.Fatalf("Unable to set minimum size: %v", err)
+	}
+	status := func(server *Server) error {
+		_, err := server.PeerStatus("3")
+		return err
+	}
+	for i := 0; i < 100 && status(leader) != ErrUnknownPeer; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := status(leader); err != ErrUnknownPeer {
+		t.Fatalf("Unreachable peer not evicted: %v", err)
+	}
+	time.Sleep(TestHeartbeatTimeout * 2)
+	if err := status(servers[1]); err != ErrUnknownPeer {
+		t.Fatalf("Eviction not committed on follower: %v", err)
+	}
+	if leader.State() != Leader {
+		t.Fatalf("Leader lost leadership: %v", leader.State())
+	}
+}
+
+// Ensure that catching up a far behind peer stays within the replication
+// bandwidth while heartbeats keep the cluster stable.
+func TestServerReplicationBytesPerSecond(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	leader := servers[0]
+	time.Sleep(TestHeartbeatTimeout * 2)
+
+	if err := leader.SetReplicationBytesPerSecond(-1); err == nil || err.Error() != "raft.Server: Invalid replication rate: -1" {
+		t.Fatalf("Negative rate should have been rejected: %v", err)
+	}
+
+	// Build a backlog for server 3. It does not stand for election while
+	// isolated and the followers keep the leader while it is catching up.
+	servers[2].SetPriority(0)
+	for _, server := range servers {
+		server.SetLeaderStickiness(true)
+	}
+	transport.Isolate("3")
+	prevLogIndex := servers[2].log.CurrentIndex()
+	for i := 0; i < 200; i++ {
+		if err := leader.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	entries, _ := leader.log.GetEntriesAfter(prevLogIndex)
+	total := 0
+	for _, entry := range entries {
+		size, _ := entry.encodedSize()
+		total += size
+	}
+
+	// Let the flushes queued for server 3 while it was isolated drain before
+	// it is reconnected.
+	time.Sleep(TestHeartbeatTimeout * 2)
+	const rate = 20000
+	leader.SetReplicationBytesPerSecond(rate)
+	start := time.Now()
+	transport.Reconnect("3")
+	for i := 0; i < 500 && servers[2].log.CurrentIndex() < leader.log.CurrentIndex(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	if servers[2].log.CurrentIndex() != leader.log.CurrentIndex() {
+		t.Fatalf("Peer not caught up: %v/%v", servers[2].log.CurrentIndex(), leader.log.CurrentIndex())
+	}
+	if throughput := float64(total) / elapsed.Seconds(); throughput > rate*1.1 {
+		t.Fatalf("Throughput over limit: %.0f > %v (%v bytes in %v)", throughput, rate, total, elapsed)
+	}
+	if leader.State() != Leader || servers[2].State() != Follower {
+		t.Fatalf("Unexpected states: %v/%v", leader.State(), servers[2].State())
+	}
+}
+
+// Ensure that an observer receives the committed log without becoming a
+// member or delaying commits.
+func TestServerObserver(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2"})
+	defer servers.Stop()
+	leader := servers[0]
+
+	var mutex sync.Mutex
+	var applied []Command
+	observer := newTestServer("obs")
+	observer.SetElectionTimeout(TestElectionTimeout)
+	observer.SetPriority(0)
+	observer.ApplyFunc = func(s *Server, c Command) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		applied = append(applied, c)
+	}
+	appliedCommands := func() []Command {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]Command{}, applied...)
+	}
+	transport.AddServer(observer)
+	observer.Start()
+	defer observer.Stop()
+
+	if err, ok := servers[1].AttachObserver("obs").(*NotLeaderError); !ok {
+		t.Fatalf("Follower should not attach an observer: %v", err)
+	}
+	if err := leader.AttachObserver("obs"); err != nil {
+		t.Fatalf("Unable to attach observer: %v", err)
+	}
+	if err := leader.AttachObserver("2"); err != ErrPeerExists {
+		t.Fatalf("Member should not be attached as an observer: %v", err)
+	}
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	time.Sleep(TestHeartbeatTimeout * 3)
+	if applied := appliedCommands(); observer.CommitIndex() != leader.CommitIndex() || !reflect.DeepEqual(applied, []Command{&TestCommand1{"foo", 10}}) {
+		t.Fatalf("Observer not caught up: %v/%v (%v)", observer.CommitIndex(), leader.CommitIndex(), applied)
+	}
+	if status, err := leader.ObserverStatus("obs"); err != nil || status.MatchIndex != leader.CommitIndex() {
+		t.Fatalf("Unexpected observer status: %v (%v)", status, err)
+	}
+	if leader.MemberCount() != 2 || leader.QuorumSize() != 2 {
+		t.Fatalf("Observer counted as a member: %v/%v", leader.MemberCount(), leader.QuorumSize())
+	}
+
+	// An unreachable observer does not delay commits.
+	transport.Isolate("obs")
+	start := time.Now()
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > TestHeartbeatTimeout {
+		t.Fatalf("Commit delayed by observer: %v", elapsed)
+	}
+
+	// A detached observer no longer receives entries. Detaching waits for
+	// a heartbeat in progress so nothing arrives afterwards.
+	if err := leader.DetachObserver("obs"); err != nil {
+		t.Fatalf("Unable to detach observer: %v", err)
+	}
+	transport.Reconnect("obs")
+	time.Sleep(TestHeartbeatTimeout * 3)
+	if applied := appliedCommands(); len(applied) != 1 {
+		t.Fatalf("Detached observer received entries: %v", applied)
+	}
+	if err := leader.DetachObserver("obs"); err != ErrUnknownPeer {
+		t.Fatalf("Unexpected detach error: %v", err)
+	}
+}
+
+// Ensure that the membership can be exported and used to bootstrap a
+// replacement cluster.
+func TestServerConfigurationSnapshot(t *testing.T) {
+	servers, _ := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	b, err := servers[0].ConfigurationSnapshot()
+	if err != nil || string(b) != `[{"name":"1","priority":1},{"name":"2","priority":1},{"name":"3","priority":1}]` {
+		t.Fatalf("Unexpected configuration: %s (%v)", b, err)
+	}
+
+	// Only empty servers that are members of the configuration are restored.
+	transport := NewInmemTransport()
+	replacements := Servers{}
+	for _, name := range []string{"1", "2", "3", "4"} {
+		server := newTestServer(name)
+		server.SetElectionTimeout(TestElectionTimeout)
+		server.SetHeartbeatTimeout(TestHeartbeatTimeout)
+		transport.AddServer(server)
+		server.Start()
+		replacements = append(replacements, server)
+	}
+	defer replacements.Stop()
+	if err := replacements[3].RestoreConfiguration(b); err == nil || err.Error() != "raft.Server: Server is not a member of the configuration: 4" {
+		t.Fatalf("Restoring a non-member should have failed: %v", err)
+	}
+	for _, server := range replacements[:3] {
+		if err := server.RestoreConfiguration(b); err != nil {
+			t.Fatalf("Unable to restore configuration: %v", err)
+		}
+		if server.MemberCount() != 3 || server.CommitIndex() != 3 {
+			t.Fatalf("Unexpected membership: %v/%v", server.MemberCount(), server.CommitIndex())
+		}
+	}
+	if err := replacements[0].RestoreConfiguration(b); err == nil || err.Error() != "raft.Server: Cannot restore configuration; already in membership" {
+		t.Fatalf("Restoring twice should have failed: %v", err)
+	}
+
+	// The replacement cluster elects a leader that can commit commands.
+	var leader *Server
+	for i := 0; i < 50 && leader == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		for _, server := range replacements[:3] {
+			if server.State() == Leader {
+				leader = server
+			}
+		}
+	}
+	if leader == nil {
+		t.Fatalf("Replacement cluster did not elect a leader")
+	}
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+}
+
 //--------------------------------------
 // Membership
 //--------------------------------------
 
+// Ensure that a server that has not joined a cluster does not elect itself
+// and refuses commands.
+func TestServerNotBootstrapped(t *testing.T) {
+	server := newTestServer("1")
+	server.SetElectionTimeout(TestElectionTimeout)
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(TestElectionTimeout * 4)
+	if server.State() != Follower || server.currentTerm != 0 {
+		t.Fatalf("Server should not have started an election: %v (term=%v)", server.State(), server.currentTerm)
+	}
+	if err := server.Do(&TestCommand1{"foo", 10}); err != ErrNotBootstrapped {
+		t.Fatalf("Command should have been rejected: %v", err)
+	}
+	if err := server.StartElection(); err != ErrNotBootstrapped {
+		t.Fatalf("Election should have been rejected: %v", err)
+	}
+
+	// Joining itself bootstraps the cluster.
+	if err := server.Join("1"); err != nil || server.State() != Leader {
+		t.Fatalf("Unable to join: %v (%v)", server.State(), err)
+	}
+	if err := server.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+}
+
 // Ensure that we can start a single server and append to its log.
 func TestServerSingleNode(t *testing.T) {
 	server := newTestServer("1")
@@ -275,14 +2961,164 @@ func TestServerSingleNode(t *testing.T) {
 	if err := server.Join("1"); err != nil {
 		t.Fatalf("Unable to join: %v", err)
 	}
-	if server.state != Leader {
-		t.Fatalf("Unexpected server state: %v", server.state)
+	if server.state != Leader {
+		t.Fatalf("Unexpected server state: %v", server.state)
+	}
+
+	// Stop the server.
+	server.Stop()
+	if server.state != Stopped {
+		t.Fatalf("Unexpected server state: %v", server.state)
+	}
+}
+
+// Ensure that joining again after the join is committed is a no-op and that
+// joining a different cluster is refused.
+func TestServerJoinIsIdempotent(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+	for i := 0; i < 3; i++ {
+		if err := server.Join("1"); err != nil {
+			t.Fatalf("Unable to join: %v", err)
+		}
+	}
+	if count, index := server.MemberCount(), server.CommitIndex(); count != 1 || index != 1 {
+		t.Fatalf("Repeated join changed the membership: %v/%v", count, index)
+	}
+	if err := server.Join("2"); err == nil || err.Error() != "raft.Server: Cannot join 2; already a member of another cluster" {
+		t.Fatalf("Join to another cluster should have failed: %v", err)
+	}
+}
+
+// Ensure that we can retrieve the membership as of a committed index.
+func TestServerConfigurationAt(t *testing.T) {
+	server := newTestServer("1")
+	server.Start()
+	defer server.Stop()
+
+	entries := []*LogEntry{
+		NewLogEntry(nil, 1, 1, &JoinCommand{Name: "ldr"}),
+		NewLogEntry(nil, 2, 1, &TestCommand1{"foo", 10}),
+		NewLogEntry(nil, 3, 1, &JoinCommand{Name: "1"}),
+		NewLogEntry(nil, 4, 1, &JoinCommand{Name: "2"}),
+	}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "ldr", 0, 0, entries, 3)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+
+	names := func(peers []*Peer) []string {
+		s := []string{}
+		for _, peer := range peers {
+			s = append(s, peer.Name())
+		}
+		return s
+	}
+	if peers, err := server.ConfigurationAt(0); err != nil || len(peers) != 0 {
+		t.Fatalf("Unexpected configuration at 0: %v (%v)", names(peers), err)
+	}
+	if peers, err := server.ConfigurationAt(2); err != nil || !reflect.DeepEqual(names(peers), []string{"ldr"}) {
+		t.Fatalf("Unexpected configuration at 2: %v (%v)", names(peers), err)
+	}
+	if peers, err := server.ConfigurationAt(3); err != nil || !reflect.DeepEqual(names(peers), []string{"ldr", "1"}) {
+		t.Fatalf("Unexpected configuration at 3: %v (%v)", names(peers), err)
+	}
+	if _, err := server.ConfigurationAt(4); err == nil || err.Error() != "raft.Server: Index is not committed (3): (IDX=4)" {
+		t.Fatalf("Uncommitted index should have been rejected: %v", err)
+	}
+}
+
+// Ensure that peers can be added and removed and that duplicate or unknown peers are rejected.
+func TestServerAddRemovePeer(t *testing.T) {
+	down := newTestDownSet("3")
+	servers, _ := newTestLeaderCluster([]string{"1", "2"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+
+	if err := leader.AddPeer("3"); err != nil || leader.MemberCount() != 3 {
+		t.Fatalf("Unable to add peer: %v (%v)", leader.MemberCount(), err)
+	}
+	if err := leader.AddPeer("3"); err != ErrPeerExists {
+		t.Fatalf("Duplicate peer should have been rejected: %v", err)
+	}
+	if err := leader.AddPeer("1"); err != ErrPeerExists {
+		t.Fatalf("Adding self should have been rejected: %v", err)
+	}
+	if err := leader.Do(&JoinCommand{Name: "1"}); err != ErrDuplicateName {
+		t.Fatalf("Joining with the leader's name should have been rejected: %v", err)
+	}
+	if err := leader.RemovePeer("4"); err != ErrUnknownPeer {
+		t.Fatalf("Unknown peer should have been rejected: %v", err)
+	}
+	if err := leader.RemovePeer("3"); err != nil || leader.MemberCount() != 2 || leader.peers["3"] != nil {
+		t.Fatalf("Unable to remove peer: %v (%v)", leader.MemberCount(), err)
+	}
+	if peers, err := leader.ConfigurationAt(leader.CommitIndex()); err != nil || len(peers) != 0 {
+		t.Fatalf("Removed peer should not be in the configuration: %v (%v)", peers, err)
+	}
+	if err := servers[1].AddPeer("4"); err == nil || err.Error() != "raft.Server: Not leader (follower)" {
+		t.Fatalf("Follower should not add peers: %v", err)
+	}
+}
+
+// Ensure that an uncommitted membership change is reported until it commits.
+func TestServerPendingConfigChange(t *testing.T) {
+	server := newTestServerWithLog("1", `6e848ea2 0000000000000001 0000000000000001 raft:join {"Name":"1"}`+"\n"+
+		`440aaa3f 0000000000000002 0000000000000001 raft:join {"Name":"2"}`+"\n")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer server.Stop()
+	if active, index, description := server.PendingConfigChange(); active {
+		t.Fatalf("Unexpected pending change: %v %q", index, description)
+	}
+
+	// Append an uncommitted join followed by a command.
+	entries := []*LogEntry{NewLogEntry(nil, 3, 1, &JoinCommand{Name: "3"}), NewLogEntry(nil, 4, 1, &TestCommand1{"foo", 10})}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "2", 2, 1, entries, 2)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if active, index, description := server.PendingConfigChange(); !active || index != 3 || description != "join 3" {
+		t.Fatalf("Unexpected pending change: %v %v %q", active, index, description)
+	}
+
+	// Commit the join.
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "2", 4, 1, []*LogEntry{}, 3)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if active, index, description := server.PendingConfigChange(); active {
+		t.Fatalf("Committed change should not be pending: %v %q", index, description)
+	}
+}
+
+// Ensure that the membership is rebuilt from committed entries on startup and
+// that uncommitted membership changes are not counted until they commit.
+func TestServerStartLoadsCommittedMembership(t *testing.T) {
+	server := newTestServerWithLog("1", `6e848ea2 0000000000000001 0000000000000001 raft:join {"Name":"1"}`+"\n"+
+		`440aaa3f 0000000000000002 0000000000000001 raft:join {"Name":"2"}`+"\n")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer server.Stop()
+	if server.MemberCount() != 2 || server.peers["2"] == nil {
+		t.Fatalf("Unexpected membership after restart: %v", server.MemberCount())
+	}
+
+	// Append an uncommitted join.
+	entries := []*LogEntry{NewLogEntry(nil, 3, 1, &JoinCommand{Name: "3"})}
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "2", 2, 1, entries, 2)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if server.MemberCount() != 2 {
+		t.Fatalf("Uncommitted join should not be counted: %v", server.MemberCount())
 	}
 
-	// Stop the server.
-	server.Stop()
-	if server.state != Stopped {
-		t.Fatalf("Unexpected server state: %v", server.state)
+	// Commit the join.
+	if _, err := server.AppendEntries(NewAppendEntriesRequest(1, "2", 3, 1, []*LogEntry{}, 3)); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if server.MemberCount() != 3 {
+		t.Fatalf("Committed join should be counted: %v", server.MemberCount())
 	}
 }
 
@@ -352,3 +3188,627 @@ func TestServerMultiNode(t *testing.T) {
 		server.Stop()
 	}
 }
+
+// Ensure that a leader can check whether the remaining servers could elect a
+// new leader without disturbing them.
+func TestServerCanFormQuorum(t *testing.T) {
+	down := newTestDownSet()
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, down)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.RequestVoteHandler = func(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+		if !req.PreVote {
+			return nil, fmt.Errorf("Unexpected vote request: %v", req)
+		} else if down.get(peer.Name()) {
+			return nil, fmt.Errorf("Server is down: %s", peer.Name())
+		}
+		return lookup[peer.Name()].RequestVote(req)
+	}
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if !leader.CanFormQuorum() {
+		t.Fatalf("Quorum should be reachable")
+	}
+	for _, name := range []string{"2", "3"} {
+		if server := lookup[name]; server.Stats().Term != 1 || server.VotedFor() != "" || server.State() != Follower {
+			t.Fatalf("Pre-vote changed server %s: %v/%q/%s", name, server.Stats().Term, server.VotedFor(), server.State())
+		}
+	}
+
+	// The two remaining servers cannot form a quorum without one of them.
+	down.set("3", true)
+	if leader.CanFormQuorum() {
+		t.Fatalf("Quorum should not be reachable")
+	}
+	if lookup["2"].CanFormQuorum() {
+		t.Fatalf("Follower should not report a quorum")
+	}
+}
+
+// Ensure that a pre-vote is answered without changing the term or vote.
+func TestServerRequestVotePreVoteDoesNotChangeState(t *testing.T) {
+	server := newTestServerWithLog("1",
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n")
+	server.Start()
+	defer server.Stop()
+	term := server.currentTerm
+
+	req := NewRequestVoteRequest(term+1, "foo", 0, 0)
+	req.PreVote = true
+	resp, err := server.RequestVote(req)
+	if !(!resp.VoteGranted && err != nil && err.Error() == "raft.Server: Out-of-date log: [1/1] > [0/0]") {
+		t.Fatalf("Out-of-date pre-vote should have been denied (%v)", err)
+	}
+	req = NewRequestVoteRequest(term+1, "foo", 1, 1)
+	req.PreVote = true
+	if resp, err = server.RequestVote(req); !(resp.Term == term && resp.VoteGranted && err == nil) {
+		t.Fatalf("Matching log pre-vote should have been granted: %v/%v (%v)", resp.Term, resp.VoteGranted, err)
+	}
+	if server.currentTerm != term || server.votedFor != "" {
+		t.Fatalf("Pre-vote changed server state: %v/%q", server.currentTerm, server.votedFor)
+	}
+}
+
+// Ensure that entries applied asynchronously are applied in order while the
+// commit index advances and that Do waits for its entry to be applied.
+func TestServerAsyncApply(t *testing.T) {
+	server := newTestServer("1")
+	release := make(chan bool)
+	var mutex sync.Mutex
+	var applied []int
+	server.ApplyFunc = func(s *Server, c Command) {
+		if c.(*TestCommand1).I == 1 {
+			<-release
+		}
+		mutex.Lock()
+		applied = append(applied, c.(*TestCommand1).I)
+		mutex.Unlock()
+	}
+	if err := server.SetAsyncApply(true); err != nil {
+		t.Fatalf("Unable to enable asynchronous apply: %v", err)
+	}
+	server.Start()
+	defer server.Stop()
+	if err := server.SetAsyncApply(false); err == nil || err.Error() != "raft.Server: Cannot change apply mode while running" {
+		t.Fatalf("Apply mode should not change while running: %v", err)
+	}
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	// A slow apply does not hold back commits.
+	for i := 1; i <= 2; i++ {
+		if _, _, err := server.Propose(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to propose command: %v", err)
+		}
+	}
+	for i := 0; i < 10 && server.CommitIndex() != 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if commitIndex, lastApplied := server.CommitIndex(), server.LastApplied(); commitIndex != 3 || lastApplied != 1 {
+		t.Fatalf("Unexpected indices while applying: %v/%v", commitIndex, lastApplied)
+	}
+
+	close(release)
+	index, err := server.DoWithIndex(&TestCommand1{"foo", 3})
+	if err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if lastApplied := server.LastApplied(); index != 4 || lastApplied != 4 {
+		t.Fatalf("Do returned before its entry was applied: %v/%v", index, lastApplied)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(applied, []int{1, 2, 3}) {
+		t.Fatalf("Unexpected apply order: %v", applied)
+	}
+}
+
+// Ensure that a command can be followed through the trace events of the
+// leader and the follower.
+func TestServerTracer(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2"}, nil)
+	defer servers.Stop()
+	var mutex sync.Mutex
+	var events []TraceEvent
+	tracer := func(event TraceEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	}
+	for _, server := range servers {
+		server.SetTracer(tracer)
+	}
+	if err := lookup["1"].Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	var appended, committed bool
+	var sent *TraceEvent
+	for i, event := range events {
+		switch {
+		case event.Kind == TraceAppend && event.Server == "1" && event.Index == 1:
+			appended = true
+		case event.Kind == TraceSend && event.Server == "1" && event.Peer == "2" && event.RPC == TraceAppendEntries && event.Count == 1:
+			sent = &events[i]
+		case event.Kind == TraceCommit && event.Server == "1" && event.Index == 1:
+			committed = true
+		}
+	}
+	if !appended || sent == nil || sent.ID == "" || !committed {
+		t.Fatalf("Missing leader trace events: %v", events)
+	}
+	for _, event := range events {
+		if event.Kind == TraceReceive && event.Server == "2" && event.ID == sent.ID {
+			if event.Peer != "1" || event.RPC != TraceAppendEntries || event.Index != 0 || event.Count != 1 {
+				t.Fatalf("Unexpected receive trace event: %v", event)
+			}
+			return
+		}
+	}
+	t.Fatalf("Missing follower trace event for %s: %v", sent.ID, events)
+}
+
+// Ensure that a leader partitioned from the majority steps down when quorum
+// checking is enabled.
+func TestServerCheckQuorumStepsDownPartitionedLeader(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	for _, server := range servers {
+		server.SetCheckQuorum(true)
+	}
+	time.Sleep(100 * time.Millisecond)
+	leader := servers[0]
+	if leader.State() != Leader {
+		t.Fatalf("Expected server 1 to remain leader: %v", leader.State())
+	}
+
+	transport.Isolate("1")
+	for i := 0; i < 50 && leader.State() == Leader; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leader.State() == Leader {
+		t.Fatalf("Partitioned leader did not step down")
+	}
+	if _, _, err := leader.Propose(&TestCommand1{"foo", 10}); err == nil {
+		t.Fatalf("Partitioned server should have rejected the command")
+	} else if _, ok := err.(*NotLeaderError); !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Ensures that Do fails at once on a leader that cannot reach a quorum.
+func TestServerFailWithoutQuorum(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	for _, server := range servers {
+		server.SetFailWithoutQuorum(true)
+	}
+	servers[1].SetPriority(0)
+	servers[2].SetPriority(0)
+	time.Sleep(100 * time.Millisecond)
+	leader := servers[0]
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to commit with a quorum: %v", err)
+	}
+
+	// A missed heartbeat does not fail commands.
+	transport.Isolate("1")
+	time.Sleep(TestHeartbeatTimeout + 5*time.Millisecond)
+	leader.mutex.Lock()
+	ok := leader.canCommit()
+	leader.mutex.Unlock()
+	if !ok {
+		t.Fatalf("Leader failed commands after a single missed heartbeat")
+	}
+
+	time.Sleep(TestElectionTimeout)
+	index := leader.log.CurrentIndex()
+	t0 := time.Now()
+	if err := leader.Do(&TestCommand1{"bar", 20}); err != ErrNoQuorum {
+		t.Fatalf("Expected ErrNoQuorum: %v", err)
+	}
+	if elapsed := time.Since(t0); elapsed > TestHeartbeatTimeout {
+		t.Fatalf("Command did not fail immediately: %v", elapsed)
+	}
+	if leader.log.CurrentIndex() != index {
+		t.Fatalf("Rejected command was appended: %v != %v", leader.log.CurrentIndex(), index)
+	}
+	if leader.State() != Leader {
+		t.Fatalf("Leader stepped down without quorum checking: %v", leader.State())
+	}
+
+	transport.Reconnect("1")
+	time.Sleep(TestHeartbeatTimeout * 2)
+	if err := leader.Do(&TestCommand1{"baz", 30}); err != nil {
+		t.Fatalf("Unable to commit after the quorum returned: %v", err)
+	}
+}
+
+// Ensure that a removed server stops standing for election until it is added
+// back to the cluster.
+func TestServerRemovedServerStopsElections(t *testing.T) {
+	servers, _ := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+	leader, removed := servers[0], servers[2]
+
+	if err := leader.RemovePeer("3"); err != nil {
+		t.Fatalf("Unable to remove peer: %v", err)
+	}
+	time.Sleep(TestHeartbeatTimeout * 2)
+	if removed.State() != Removed {
+		t.Fatalf("Removed server should be in the removed state: %v", removed.State())
+	}
+
+	// The removed server hears from nobody and still does not campaign.
+	term := removed.Stats().Term
+	time.Sleep(TestElectionTimeout * 4)
+	if removed.State() != Removed || removed.Stats().Term != term || len(removed.ElectionHistory()) != 0 {
+		t.Fatalf("Removed server held an election: %v (term %v -> %v)", removed.State(), term, removed.Stats().Term)
+	}
+	if leader.State() != Leader {
+		t.Fatalf("Leader was disrupted: %v", leader.State())
+	}
+
+	// Adding the server back makes it a follower again.
+	if err := leader.AddPeer("3"); err != nil {
+		t.Fatalf("Unable to add peer: %v", err)
+	}
+	time.Sleep(TestHeartbeatTimeout * 2)
+	if removed.State() != Follower || removed.Leader() != "1" {
+		t.Fatalf("Re-added server should follow the leader: %v (%v)", removed.State(), removed.Leader())
+	}
+}
+
+// Ensure that a restarted server applies only the committed entries after the
+// persisted applied index.
+func TestServerPersistAppliedIndex(t *testing.T) {
+	server := newTestServer("1")
+	if err := server.SetPersistAppliedIndex(true); err != nil {
+		t.Fatalf("Unable to enable applied index persistence: %v", err)
+	}
+	server.Start()
+	if err := server.SetPersistAppliedIndex(false); err == nil || err.Error() != "raft.Server: Cannot change applied index persistence while running" {
+		t.Fatalf("Setting should not change while running: %v", err)
+	}
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := server.Do(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to execute command: %v", err)
+		}
+	}
+	server.Stop()
+
+	var applied []int
+	server.ApplyFunc = func(s *Server, c Command) {
+		applied = append(applied, c.(*TestCommand1).I)
+	}
+
+	// Every applied entry was recorded so nothing is applied again.
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	if len(applied) != 0 || server.LastApplied() != 4 {
+		t.Fatalf("Recorded entries were applied again: %v (%v)", applied, server.LastApplied())
+	}
+	server.Stop()
+
+	// The last entry was committed but the server stopped before recording it.
+	if err := server.writeAppliedIndex(3); err != nil {
+		t.Fatalf("Unable to write applied index: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	if !reflect.DeepEqual(applied, []int{3}) || server.LastApplied() != 4 {
+		t.Fatalf("Unexpected applied entries: %v (%v)", applied, server.LastApplied())
+	}
+	server.Stop()
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer server.Stop()
+	if !reflect.DeepEqual(applied, []int{3}) {
+		t.Fatalf("Entry was applied twice: %v", applied)
+	}
+}
+
+// Ensure that entries still queued for asynchronous apply when the server
+// stops are recorded as applied.
+func TestServerPersistAppliedIndexOnStop(t *testing.T) {
+	server := newTestServer("1")
+	release := make(chan bool)
+	server.ApplyFunc = func(s *Server, c Command) {
+		if c.(*TestCommand1).I == 1 {
+			<-release
+		}
+	}
+	if err := server.SetAsyncApply(true); err != nil {
+		t.Fatalf("Unable to enable asynchronous apply: %v", err)
+	}
+	if err := server.SetPersistAppliedIndex(true); err != nil {
+		t.Fatalf("Unable to enable applied index persistence: %v", err)
+	}
+	server.Start()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, _, err := server.Propose(&TestCommand1{"foo", i}); err != nil {
+			t.Fatalf("Unable to propose command: %v", err)
+		}
+	}
+	for i := 0; i < 10 && server.CommitIndex() != 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	server.Stop()
+
+	if index, ok, err := server.readAppliedIndex(); err != nil || !ok || index != 3 {
+		t.Fatalf("Unexpected persisted applied index: %v/%v (%v)", index, ok, err)
+	}
+}
+
+// Ensure that a server repeatedly timing out stops standing for election once
+// it reaches the election rate limit.
+func TestServerElectionRateLimit(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+	server := servers[2]
+	if err := server.SetElectionRateLimit(-1); err == nil || err.Error() != "raft.Server: Invalid election rate limit: -1" {
+		t.Fatalf("Negative limit should have been rejected: %v", err)
+	}
+	if err := server.SetElectionRateLimit(2); err != nil {
+		t.Fatalf("Unable to set election rate limit: %v", err)
+	}
+
+	// The isolated server campaigns twice and then remains a follower.
+	term := server.Stats().Term
+	transport.Isolate("3")
+	time.Sleep(TestElectionTimeout * 10)
+	if n := server.ElectionsPerMinute(); n != 2 {
+		t.Fatalf("Expected 2 elections in the last minute: %v", n)
+	}
+	if server.State() != Follower || server.Stats().Term != term+2 {
+		t.Fatalf("Throttled server should remain a follower: %v (term %v -> %v)", server.State(), term, server.Stats().Term)
+	}
+}
+
+// Ensure that the leader reports whether every member has applied the latest
+// configuration and which members are lagging.
+func TestServerConfigurationAppliedOnAll(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+	leader := servers[0]
+	if leader.State() != Leader {
+		t.Fatalf("Expected server 1 to lead: %v", leader.State())
+	}
+	if _, _, err := servers[1].ConfigurationAppliedOnAll(0); err == nil {
+		t.Fatalf("Follower should not report configuration status")
+	}
+
+	// Server 3 misses the join of server 4. It never stands for election so
+	// that the missing heartbeats leave the leader in place.
+	servers[2].SetPriority(0)
+	if err := leader.PauseReplication("3"); err != nil {
+		t.Fatalf("Unable to pause replication: %v", err)
+	}
+	server := newTestServer("4")
+	server.SetElectionTimeout(TestElectionTimeout)
+	server.SetHeartbeatTimeout(TestHeartbeatTimeout)
+	transport.AddServer(server)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer server.Stop()
+	if err := server.Join("1"); err != nil {
+		t.Fatalf("Unable to join server: %v", err)
+	}
+	index := leader.CommitIndex()
+
+	ok, applied, err := leader.ConfigurationAppliedOnAll(100 * time.Millisecond)
+	if err != nil || ok {
+		t.Fatalf("Lagging follower should not have applied the configuration: %v (%v)", applied, err)
+	}
+	if len(applied) != 4 || applied["1"] < index || applied["2"] < index || applied["4"] < index || applied["3"] >= index {
+		t.Fatalf("Unexpected applied indices (%v): %v", index, applied)
+	}
+
+	// The follower catches up with the next command once replication resumes.
+	leader.ResumeReplication("3")
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to submit command: %v", err)
+	}
+	ok, applied, err = leader.ConfigurationAppliedOnAll(time.Second)
+	if err != nil || !ok || applied["3"] < index {
+		t.Fatalf("Follower should have applied the configuration: %v (%v)", applied, err)
+	}
+}
+
+// Ensure that reads waiting on a confirmation round share the next round but
+// are never served by a round that started before they were submitted.
+func TestServerLeaderReadBatching(t *testing.T) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		time.Sleep(20 * time.Millisecond)
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+
+	read := func(wg *sync.WaitGroup) {
+		defer wg.Done()
+		if err := leader.LeaderRead(func() error { return nil }); err != nil {
+			t.Errorf("Unable to read: %v", err)
+		}
+	}
+
+	// The first read starts a round and the reads submitted while it is in
+	// progress are confirmed together by a second round.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go read(&wg)
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go read(&wg)
+	}
+	wg.Wait()
+	if rounds := atomic.LoadUint64(&leader.readRound); rounds != 2 {
+		t.Fatalf("Expected 2 confirmation rounds: %v", rounds)
+	}
+
+	// A read submitted after the rounds completed needs a round of its own.
+	wg.Add(1)
+	read(&wg)
+	if rounds := atomic.LoadUint64(&leader.readRound); rounds != 3 {
+		t.Fatalf("Expected 3 confirmation rounds: %v", rounds)
+	}
+}
+
+// Measures the throughput of reads submitted one at a time.
+func BenchmarkServerLeaderRead(b *testing.B) {
+	benchmarkServerLeaderRead(b, false)
+}
+
+// Measures the throughput of concurrent reads which share confirmation rounds.
+func BenchmarkServerLeaderReadParallel(b *testing.B) {
+	benchmarkServerLeaderRead(b, true)
+}
+
+// Measures read throughput against followers that take a millisecond to
+// answer each AppendEntries RPC.
+func benchmarkServerLeaderRead(b *testing.B, parallel bool) {
+	servers, lookup := newTestLeaderCluster([]string{"1", "2", "3"}, nil)
+	defer servers.Stop()
+	leader := servers[0]
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		time.Sleep(time.Millisecond)
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+	read := func() {
+		if err := leader.LeaderRead(func() error { return nil }); err != nil {
+			b.Errorf("Unable to read: %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	if !parallel {
+		for i := 0; i < b.N; i++ {
+			read()
+		}
+		return
+	}
+	b.SetParallelism(8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			read()
+		}
+	})
+}
+
+// Ensure that the leader reports a peer once when it becomes unreachable and
+// once when it answers again.
+func TestServerReachabilityEvents(t *testing.T) {
+	servers, transport := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	time.Sleep(100 * time.Millisecond)
+	leader := servers[0]
+	if leader.State() != Leader {
+		t.Fatalf("Expected server 1 to lead: %v", leader.State())
+	}
+
+	var mutex sync.Mutex
+	var events []string
+	leader.SetReachabilityFunc(func(name string, event string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, name+" "+event)
+	})
+
+	// The isolated server never stands for election so the leader keeps
+	// sending it heartbeats until it is reconnected.
+	servers[1].SetPriority(0)
+	transport.Isolate("2")
+	time.Sleep(UnreachableElectionTimeouts*TestElectionTimeout + 200*time.Millisecond)
+	transport.Reconnect("2")
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(events, []string{"2 " + PeerUnreachable, "2 " + PeerReachable}) {
+		t.Fatalf("Unexpected reachability events: %v", events)
+	}
+}
+
+// Ensure that an idle leader slows its heartbeats and returns to the normal
+// rate once a command is appended.
+func TestServerQuiescentHeartbeat(t *testing.T) {
+	servers, _ := newTestTransportCluster([]string{"1", "2", "3"})
+	defer servers.Stop()
+	for _, server := range servers {
+		server.SetElectionTimeout(300 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	leader := servers[0]
+	if leader.State() != Leader {
+		t.Fatalf("Expected server 1 to lead: %v", leader.State())
+	}
+	leader.electionTimer.Pause()
+	if err := leader.SetQuiescentHeartbeat(50*time.Millisecond, 200*time.Millisecond); err == nil {
+		t.Fatalf("Slow interval above half the election timeout should be rejected")
+	}
+	if err := leader.SetQuiescentHeartbeat(50*time.Millisecond, 150*time.Millisecond); err != nil {
+		t.Fatalf("Unable to set quiescent heartbeat: %v", err)
+	}
+
+	var mutex sync.Mutex
+	sent := 0
+	leader.SetTracer(func(event TraceEvent) {
+		if event.Kind == TraceSend && event.RPC == TraceAppendEntries {
+			mutex.Lock()
+			sent++
+			mutex.Unlock()
+		}
+	})
+	count := func(d time.Duration) int {
+		mutex.Lock()
+		sent = 0
+		mutex.Unlock()
+		time.Sleep(d)
+		mutex.Lock()
+		defer mutex.Unlock()
+		return sent
+	}
+
+	// Two peers heartbeated every 20ms would receive 60 requests in 600ms.
+	time.Sleep(100 * time.Millisecond)
+	if n := count(600 * time.Millisecond); n > 12 {
+		t.Fatalf("Idle leader should slow its heartbeats: %v requests", n)
+	} else if n < 4 {
+		t.Fatalf("Idle leader should keep heartbeating at the slow interval: %v requests", n)
+	}
+	if err := leader.Do(&TestCommand1{"foo", 10}); err != nil {
+		t.Fatalf("Unable to submit command: %v", err)
+	}
+	if n := count(40 * time.Millisecond); n < 2 {
+		t.Fatalf("Leader should heartbeat normally after a write: %v requests", n)
+	}
+	for _, server := range servers {
+		if server != leader && server.State() != Follower {
+			t.Fatalf("Followers should not have timed out: %v", server.State())
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package raft
 
+import (
+	"errors"
+	"fmt"
+)
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -15,6 +20,17 @@ type Servers []*Server
 //
 //------------------------------------------------------------------------------
 
+//--------------------------------------
+// State
+//--------------------------------------
+
+// Stops a set of servers.
+func (s Servers) Stop() {
+	for _, server := range s {
+		server.Stop()
+	}
+}
+
 //--------------------------------------
 // Handlers
 //--------------------------------------
@@ -26,9 +42,145 @@ func (s Servers) SetApplyFunc(f func(*Server, Command)) {
 	}
 }
 
+// Sets the transport for a set of servers.
+func (s Servers) SetTransport(t Transport) {
+	for _, server := range s {
+		server.SetTransport(t)
+	}
+}
+
 // Sets the RequestVoteHandler for a set of servers.
 func (s Servers) SetRequestVoteHandler(f func(*Server, *Peer, *RequestVoteRequest) (*RequestVoteResponse, error)) {
 	for _, server := range s {
 		server.RequestVoteHandler = f
 	}
 }
+
+// Sets the AppendEntriesHandler for a set of servers.
+func (s Servers) SetAppendEntriesHandler(f func(*Server, *Peer, *AppendEntriesRequest) (*AppendEntriesResponse, error)) {
+	for _, server := range s {
+		server.AppendEntriesHandler = f
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Finds the first index at which the logs of two servers disagree on the term
+// or the command of an entry, such as when confirming whether a split brain
+// overwrote committed entries. Zero is returned if one log is a prefix of the
+// other. Compacted entries cannot be compared so only the term is checked at
+// the later compaction point and an error is returned if the logs no longer
+// overlap.
+func CompareLogs(a, b *Server) (uint64, error) {
+	return compareLogs("raft.CompareLogs", a, b, false)
+}
+
+// Verifies that every server has committed exactly the same entries, such as
+// before a cluster is torn down and one log is archived as its backup. Each
+// log is compared with the first by index, term and checksum up to the lower
+// of their commit indices. The first divergent index is returned if any log
+// disagrees. A log that has committed fewer entries is reported at the index
+// following its commit index since it is missing committed entries.
+func VerifyClusterConsistency(servers []*Server) (bool, uint64, error) {
+	if len(servers) < 2 {
+		return false, 0, errors.New("raft.VerifyClusterConsistency: Two servers required")
+	}
+	for _, server := range servers {
+		if server == nil {
+			return false, 0, errors.New("raft.VerifyClusterConsistency: Server required")
+		}
+	}
+
+	divergence := uint64(0)
+	diverge := func(index uint64) {
+		if divergence == 0 || index < divergence {
+			divergence = index
+		}
+	}
+	first := servers[0].CommitIndex()
+	for _, server := range servers[1:] {
+		index, err := compareLogs("raft.VerifyClusterConsistency", servers[0], server, true)
+		if err != nil {
+			return false, 0, err
+		} else if index > 0 {
+			diverge(index)
+		}
+		if commitIndex := server.CommitIndex(); commitIndex < first {
+			diverge(commitIndex + 1)
+		} else if commitIndex > first {
+			diverge(first + 1)
+		}
+	}
+	return divergence == 0, divergence, nil
+}
+
+// Finds the first index at which two logs disagree. Only committed entries
+// are compared when committed is set. Errors are reported under the name of
+// the calling function.
+func compareLogs(name string, a, b *Server, committed bool) (uint64, error) {
+	if a == nil || b == nil {
+		return 0, fmt.Errorf("%s: Two servers required", name)
+	}
+
+	a.log.mutex.Lock()
+	defer a.log.mutex.Unlock()
+	if a.log != b.log {
+		b.log.mutex.Lock()
+		defer b.log.mutex.Unlock()
+	}
+
+	start, end := a.log.startIndex(), a.log.startIndex()+uint64(len(a.log.entries))
+	if index := b.log.startIndex(); index > start {
+		start = index
+	}
+	if index := b.log.startIndex() + uint64(len(b.log.entries)); index < end {
+		end = index
+	}
+	if committed {
+		if a.log.commitIndex < end {
+			end = a.log.commitIndex
+		}
+		if b.log.commitIndex < end {
+			end = b.log.commitIndex
+		}
+	}
+	if end == 0 {
+		return 0, nil
+	} else if start > end {
+		return 0, fmt.Errorf("%s: Logs do not overlap: (START=%v, END=%v)", name, start, end)
+	}
+
+	// Compare the terms at the compaction point.
+	if start > 0 {
+		aTerm, _ := a.log.termAt(start)
+		bTerm, _ := b.log.termAt(start)
+		if aTerm != bTerm {
+			return start, nil
+		}
+	}
+
+	// Compare the remaining entries by term and then by checksum.
+	for index := start + 1; index <= end; index++ {
+		aEntry := a.log.entries[index-a.log.startIndex()-1]
+		bEntry := b.log.entries[index-b.log.startIndex()-1]
+		if aEntry.term != bEntry.term {
+			return index, nil
+		}
+		aChecksum, err := aEntry.checksum()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		bChecksum, err := bEntry.checksum()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		if aChecksum != bChecksum {
+			return index, nil
+		}
+	}
+	return 0, nil
+}
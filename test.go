@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -90,6 +91,100 @@ func newTestCluster(names []string) (Servers, map[string]*Server) {
 	return servers, lookup
 }
 
+func newTestTransportCluster(names []string) (Servers, *InmemTransport) {
+	transport := NewInmemTransport()
+	servers := make(Servers, 0)
+	for _, name := range names {
+		server := newTestServer(name)
+		server.SetElectionTimeout(TestElectionTimeout)
+		server.SetHeartbeatTimeout(TestHeartbeatTimeout)
+		transport.AddServer(server)
+		if err := server.Start(); err != nil {
+			panic(fmt.Sprintf("Unable to start server[%s]: %v", name, err))
+		}
+		if err := server.Join(names[0]); err != nil {
+			panic(fmt.Sprintf("Unable to join server[%s]: %v", name, err))
+		}
+		servers = append(servers, server)
+	}
+	return servers, transport
+}
+
+// A set of servers that are down which can be changed while RPCs are being
+// delivered. A nil set has no servers down.
+type testDownSet struct {
+	mutex sync.Mutex
+	down  map[string]bool
+}
+
+func newTestDownSet(names ...string) *testDownSet {
+	d := &testDownSet{down: make(map[string]bool)}
+	for _, name := range names {
+		d.down[name] = true
+	}
+	return d
+}
+
+func (d *testDownSet) set(name string, down bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.down[name] = down
+}
+
+func (d *testDownSet) get(name string) bool {
+	if d == nil {
+		return false
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.down[name]
+}
+
+// Creates a cluster where the first server is the leader in term 1 and all
+// servers have long election timeouts. AppendEntries RPCs from the leader are
+// delivered directly to the followers except for those marked as down.
+func newTestLeaderCluster(names []string, down *testDownSet) (Servers, map[string]*Server) {
+	servers, lookup := newTestCluster(names)
+	for _, server := range servers[1:] {
+		server.SetElectionTimeout(10 * time.Second)
+	}
+	leader := servers[0]
+	leader.electionTimer.Pause()
+	leader.currentTerm, leader.state = 1, Leader
+	leader.AppendEntriesHandler = func(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+		if down.get(peer.Name()) {
+			return nil, fmt.Errorf("Server is down: %s", peer.Name())
+		}
+		return lookup[peer.Name()].AppendEntries(req)
+	}
+	return servers, lookup
+}
+
+//--------------------------------------
+// Metrics
+//--------------------------------------
+
+type testMetricsSink struct {
+	mutex     sync.Mutex
+	durations map[string][]time.Duration
+}
+
+func newTestMetricsSink() *testMetricsSink {
+	return &testMetricsSink{durations: make(map[string][]time.Duration)}
+}
+
+func (m *testMetricsSink) ObserveDuration(name string, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.durations[name] = append(m.durations[name], d)
+}
+
+func (m *testMetricsSink) count(name string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.durations[name])
+}
+
 //--------------------------------------
 // Command1
 //--------------------------------------
@@ -62,32 +62,50 @@ func (t *Timer) C() chan time.Time {
 	return t.c
 }
 
+// Sets the random source used to choose the duration between the minimum and
+// maximum duration. This allows the timer's durations to be reproduced.
+func (t *Timer) SetRand(r *rand.Rand) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rand = r
+}
+
 // Retrieves the minimum duration of the timer.
 func (t *Timer) MinDuration() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	return t.minDuration
 }
 
 // Sets the minimum duration of the timer.
 func (t *Timer) SetMinDuration(duration time.Duration) {
+	t.mutex.Lock()
 	t.minDuration = duration
+	t.mutex.Unlock()
 	t.Reset()
 }
 
 // Retrieves the maximum duration of the timer.
 func (t *Timer) MaxDuration() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	return t.maxDuration
 }
 
 // Sets the maximum duration of the timer.
 func (t *Timer) SetMaxDuration(duration time.Duration) {
+	t.mutex.Lock()
 	t.maxDuration = duration
+	t.mutex.Unlock()
 	t.Reset()
 }
 
 // Sets the minimum and maximum duration of the timer.
 func (t *Timer) SetDuration(duration time.Duration) {
+	t.mutex.Lock()
 	t.minDuration = duration
 	t.maxDuration = duration
+	t.mutex.Unlock()
 	t.Reset()
 }
 
@@ -140,11 +158,7 @@ func (t *Timer) Reset() {
 	}
 
 	// Start a timer that will go off between the min and max duration.
-	d := t.minDuration
-	if t.maxDuration > t.minDuration {
-		d += time.Duration(t.rand.Int63n(int64(t.maxDuration-t.minDuration)))
-	}
-	t.internalTimer = time.NewTimer(d)
+	t.internalTimer = time.NewTimer(t.duration())
 	go func() {
 		defer func() {
 			recover()
@@ -156,13 +170,39 @@ func (t *Timer) Reset() {
 		t.mutex.Unlock()
 
 		// If the timer exists then grab the value from the channel and pass
-		// it through to the timer's external channel.
+		// it through to the timer's external channel. A value that is still
+		// waiting to be received already signals the timeout so the new one
+		// is dropped rather than blocking while the lock is held.
 		if internalTimer != nil {
 			if v, ok := <-internalTimer.C; ok {
 				t.mutex.Lock()
-				t.c <- v
+				select {
+				case t.c <- v:
+				default:
+				}
 				t.mutex.Unlock()
 			}
 		}
 	}()
 }
+
+// Chooses a random duration less than the given duration from the timer's
+// random source.
+func (t *Timer) random(d time.Duration) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(t.rand.Int63n(int64(d)))
+}
+
+// Chooses a random duration between the min and max duration. This function
+// does not obtain a lock so one must be obtained before executing.
+func (t *Timer) duration() time.Duration {
+	d := t.minDuration
+	if t.maxDuration > t.minDuration {
+		d += time.Duration(t.rand.Int63n(int64(t.maxDuration - t.minDuration)))
+	}
+	return d
+}
@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"math/rand"
 	"sync"
 	"testing"
 	"time"
@@ -94,3 +95,20 @@ func TestTimerPause(t *testing.T) {
 
 	timer.Stop()
 }
+
+// Ensure that timers with the same random source choose the same durations.
+func TestTimerSetRand(t *testing.T) {
+	timer1 := NewTimer(5*time.Millisecond, 10*time.Millisecond)
+	timer2 := NewTimer(5*time.Millisecond, 10*time.Millisecond)
+	timer1.SetRand(rand.New(rand.NewSource(1)))
+	timer2.SetRand(rand.New(rand.NewSource(1)))
+	for i := 0; i < 10; i++ {
+		d1, d2 := timer1.duration(), timer2.duration()
+		if d1 != d2 {
+			t.Fatalf("Durations should match with the same seed: %v != %v", d1, d2)
+		}
+		if d1 < 5*time.Millisecond || d1 >= 10*time.Millisecond {
+			t.Fatalf("Duration out of range: %v", d1)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A token bucket limits the rate at which bytes are sent. The bucket refills
+// at the rate each second and holds at most one second of tokens.
+type tokenBucket struct {
+	rate   int
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the rate in bytes per second. Zero means there is no limit.
+func (b *tokenBucket) Rate() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.rate
+}
+
+// Sets the rate in bytes per second and empties the bucket.
+func (b *tokenBucket) SetRate(rate int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rate = rate
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Takes tokens for as many of the sizes as fit in the bucket, in order, and
+// returns how many fit. A size larger than the bucket is taken alone once the
+// bucket is full so that it is not withheld forever.
+func (b *tokenBucket) take(sizes []int) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.rate <= 0 {
+		return len(sizes)
+	}
+
+	// Refill the bucket for the time since the last call.
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+
+	n := 0
+	for _, size := range sizes {
+		if float64(size) > b.tokens {
+			break
+		}
+		b.tokens -= float64(size)
+		n++
+	}
+	if n == 0 && len(sizes) > 0 && b.tokens >= float64(b.rate) {
+		b.tokens -= float64(sizes[0])
+		n++
+	}
+	return n
+}
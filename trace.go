@@ -0,0 +1,44 @@
+package raft
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The kinds of trace events. A command can be followed from the leader
+// appending it through each AppendEntries RPC that carries its index to the
+// commit of its index.
+const (
+	TraceAppend  = "append"
+	TraceSend    = "send"
+	TraceReceive = "receive"
+	TraceCommit  = "commit"
+)
+
+// The RPCs reported in send and receive trace events.
+const (
+	TraceAppendEntries = "appendEntries"
+	TraceRequestVote   = "requestVote"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An event reported to a server's tracer. The send and receive events for an
+// RPC share its trace ID and name the server at the other end as the peer.
+// For AppendEntries RPCs the index is the previous log index and the count is
+// the number of entries carried. For append and commit events the index is
+// the appended or committed index.
+type TraceEvent struct {
+	ID     string
+	Kind   string
+	RPC    string
+	Server string
+	Peer   string
+	Index  uint64
+	Count  int
+}
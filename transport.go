@@ -0,0 +1,15 @@
+package raft
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A transport is responsible for delivering RPCs from a server to its peers.
+// It can be used in place of setting each of the server handlers individually.
+type Transport interface {
+	SendDo(server *Server, peer *Peer, command Command) error
+	SendRequestVote(server *Server, peer *Peer, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	SendAppendEntries(server *Server, peer *Peer, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+}
@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const (
+	// Applying stops at an unknown command and the commit returns an error.
+	UnknownCommandFail UnknownCommandPolicy = "fail"
+
+	// An unknown command is logged and committed without being applied.
+	UnknownCommandSkip UnknownCommandPolicy = "skip"
+
+	// Applying an unknown command panics.
+	UnknownCommandPanic UnknownCommandPolicy = "panic"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// The policy determines how a committed command whose type has not been
+// registered is handled when it would be applied.
+type UnknownCommandPolicy string
+
+// An unknown command holds an entry whose command type has not been
+// registered, such as after a downgrade, so that the entry can be kept in the
+// log unchanged.
+type UnknownCommand struct {
+	Name string
+	Data json.RawMessage
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// This function marks the command as internal so that it is never passed to
+// the state machine.
+func (c *UnknownCommand) InternalCommand() bool {
+	return true
+}
+
+// The name of the command in the log.
+func (c *UnknownCommand) CommandName() string {
+	return c.Name
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// An unknown command cannot be validated.
+func (c *UnknownCommand) Validate(server *Server) error {
+	return fmt.Errorf("raft.UnknownCommand: Unregistered command type: %s", c.Name)
+}
+
+// An unknown command does not change the state machine.
+func (c *UnknownCommand) Apply(server *Server) {
+}
+
+// Encodes the original command data.
+func (c *UnknownCommand) MarshalJSON() ([]byte, error) {
+	if c.Data == nil {
+		return []byte("null"), nil
+	}
+	return c.Data, nil
+}
+
+// Keeps the command data as it was read.
+func (c *UnknownCommand) UnmarshalJSON(b []byte) error {
+	c.Data = append(json.RawMessage(nil), b...)
+	return nil
+}